@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/msepp/stopwatch/stopwatchdb"
+	model "github.com/msepp/stopwatch/stopwatchmodel"
 )
 
 const dateFmt = "2006-01-02"
@@ -22,6 +25,28 @@ func main() {
 	var startStr string
 	var endStr string
 	var dumpType string
+	var timezone string
+	var loc *time.Location
+	var parallel string
+	var parallelMode stopwatchdb.ParallelMode
+	var backupDir string
+	var snapshot string
+	var force bool
+	var importFile string
+	var merge bool
+	var dryRun bool
+	var trackerDateFmt string
+	var timewDir string
+	var timewRule string
+	var note string
+	var parentID int
+	var costCode string
+	var newCode string
+	var includeTags string
+	var excludeTags string
+	var format string
+	var delimiter string
+	var csvOpts stopwatchdb.CSVOptions
 	var err error
 
 	// Define and parse supported command line flags.
@@ -30,20 +55,98 @@ func main() {
 	flag.StringVar(&endStr, "end", "", "end date (YYYY-MM-DD for reports, RFC 3339 for slices). Defaults to now for reports.")
 	flag.IntVar(&groupID, "groupID", 0, "Group ID to dump/modify")
 	flag.IntVar(&taskID, "taskID", 0, "Task ID to dump/modify")
-	flag.StringVar(&dumpType, "type", "report", "operation type. 'slices' returns recorded slices, 'report' gives a nice report, 'setslice' allows setting a slice and 'rmslice' removes slice.")
+	flag.StringVar(&dumpType, "type", "report", "operation type. 'slices' returns recorded slices, 'report' gives a nice report, rolling up the groups below the group, 'tags' gives a report by task tag, 'groups' lists the groups as a tree and 'movegroup' moves a group under -parent. 'setslice' allows setting a slice, 'setnote' sets the note of a slice and 'rmslice' removes slice. 'version' reports the database schema version and 'migrate' runs pending schema migrations. 'check' reports inconsistencies and 'repair' fixes them. 'audit' lists recorded changes, optionally for a group or task. 'undo' reverts the latest change and 'redo' applies it again. 'backup' takes a snapshot of the database, 'restore' lists snapshots or restores the one given with -snapshot. 'export' writes the whole database as JSON and 'import' reads such a document from -file. 'importics' adds the events of the iCalendar file given with -file as slices of a task. 'importtracker' adds the entries of a Toggl or Clockify detailed CSV export given with -file, creating missing groups and tasks. 'timewimport' reads the Timewarrior data directory given with -timew and 'timewexport' writes slices to it. 'costcodes' lists the cost code registry, 'importcodes' adds or updates codes from the CSV list given with -file and 'renamecode' renames -code to -to, also on tasks. 'setcode' assigns -code to a task from the -start date on.")
+	flag.StringVar(&costCode, "code", "", "cost code to rename with 'renamecode', or to assign with 'setcode'")
+	flag.StringVar(&newCode, "to", "", "new name of the cost code for 'renamecode'")
+	flag.IntVar(&parentID, "parent", 0, "ID of the new parent group for 'movegroup', 0 for the top level")
+	flag.StringVar(&note, "note", "", "note describing the work done, for 'setnote'. Empty removes the note.")
+	flag.StringVar(&includeTags, "include", "", "comma separated tags, 'tags' reports only tasks with any of them")
+	flag.StringVar(&excludeTags, "exclude", "", "comma separated tags, 'tags' leaves out tasks with any of them")
+	flag.StringVar(&timezone, "tz", "UTC", "time zone for splitting days in reports and for dates without a zone, eg. 'Europe/Helsinki'. Use 'Local' for system time zone.")
+	flag.StringVar(&parallel, "parallel", "full", "how time of tasks running at the same time is reported. 'full' counts it for each task, 'split' divides it between the tasks.")
+	flag.StringVar(&backupDir, "backups", "", "directory for database snapshots. Defaults to a backups directory next to the database.")
+	flag.StringVar(&snapshot, "snapshot", "", "snapshot to restore, as a path or a file name in the backups directory")
+	flag.BoolVar(&force, "force", false, "restore the snapshot even if 'check' finds problems in it, to repair it afterwards")
+	flag.StringVar(&importFile, "file", "", "file to import, an export document, an iCalendar file or a time tracker CSV export")
+	flag.StringVar(&format, "format", "json", "output format. 'csv' is supported for 'report' and 'slices', 'ics' for 'slices'.")
+	flag.StringVar(&delimiter, "delimiter", ",", "field delimiter for CSV output and the 'importcodes' list")
+	flag.StringVar(&csvOpts.TimeFormat, "timefmt", time.RFC3339, "layout of times in CSV output, as a Go time layout")
+	flag.StringVar(&csvOpts.DurationFormat, "durfmt", stopwatchdb.DurationDecimal, "format of durations in CSV output. 'decimal' for decimal hours, 'clock' for h:mm:ss, 'minutes' for whole minutes.")
+	flag.StringVar(&trackerDateFmt, "datefmt", "", "layout of dates in the 'importtracker' export, as a Go time layout, eg. '02/01/2006'. Detected if not set, refusing dates that read differently in several layouts.")
+	flag.BoolVar(&dryRun, "dryrun", false, "only report what 'importtracker' or 'timewimport' would do")
+	flag.StringVar(&timewDir, "timew", "", "Timewarrior data directory, eg. ~/.timewarrior/data")
+	flag.StringVar(&timewRule, "timewrule", stopwatchdb.DefaultTimewRule, "mapping of Timewarrior tags to group, task and cost code, as field=prefix pairs. Fields with an empty prefix take the remaining tags in order.")
+	flag.BoolVar(&merge, "merge", false, "merge the imported document into an existing database, matching groups and tasks by name")
 	flag.Parse()
 
-	// We require a group ID for all operations
-	if groupID <= 0 {
-		log.Fatalf("groupID needs to be a positive non-zero integer")
+	if loc, err = time.LoadLocation(timezone); err != nil {
+		log.Fatalf("Invalid time zone: %s", err)
+	}
+
+	if parallelMode, err = stopwatchdb.ParseParallelMode(parallel); err != nil {
+		log.Fatalf("Invalid parallel mode: %s", err)
+	}
+
+	switch format {
+	case "json":
+	case "csv":
+		if dumpType != "report" && dumpType != "slices" {
+			log.Fatalf("CSV output is only supported for reports and slices")
+		}
+
+		if csvOpts.Delimiter, err = stopwatchdb.ParseDelimiter(delimiter); err != nil {
+			log.Fatalf("Invalid delimiter: %s", err)
+		}
+
+		if _, err = stopwatchdb.ParseDurationFormat(csvOpts.DurationFormat); err != nil {
+			log.Fatalf("Invalid duration format: %s", err)
+		}
+		csvOpts.Location = loc
+
+	case "ics":
+		if dumpType != "slices" {
+			log.Fatalf("iCalendar output is only supported for slices")
+		}
+
+	default:
+		log.Fatalf("Invalid output format")
+	}
+
+	// We require a group ID for all but database wide operations
+	switch dumpType {
+	case "groups", "version", "migrate", "check", "repair", "audit", "undo", "redo", "backup", "restore", "export", "import", "importtracker", "timewimport", "timewexport", "costcodes", "importcodes", "renamecode":
+	default:
+		if groupID <= 0 {
+			log.Fatalf("groupID needs to be a positive non-zero integer")
+		}
 	}
 
 	// Current time for convenience.
-	now := time.Now()
+	now := time.Now().In(loc)
 
 	// Check rest of the command-line based on operation type
 	switch dumpType {
-	case "setslice", "rmslice":
+	case "importics":
+		// Events are added to a task
+		if taskID <= 0 {
+			log.Fatalf("taskID needs to be a positive non-zero integer")
+		}
+
+	case "setcode":
+		// Cost codes are assigned to a task from the start of a date, by
+		// default the current one.
+		if taskID <= 0 {
+			log.Fatalf("taskID needs to be a positive non-zero integer")
+		}
+
+		start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+		if startStr != "" {
+			if start, err = time.ParseInLocation(dateFmt, startStr, loc); err != nil {
+				log.Fatalf("Invalid start date: %s", err)
+			}
+		}
+
+	case "setslice", "setnote", "rmslice":
 		// slice operations require a task ID
 		if taskID <= 0 {
 			log.Fatalf("taskID needs to be a positive non-zero integer")
@@ -53,8 +156,9 @@ func main() {
 			log.Fatalf("Invalid start datetime: %s", err)
 		}
 
-		// Only parse end datetime if not removing a slice. rmslice doesn't need it.
-		if dumpType != "rmslice" {
+		// Only parse end datetime when setting a slice. Other slice operations
+		// don't need it.
+		if dumpType == "setslice" {
 			if end, err = time.Parse(time.RFC3339, endStr); err != nil {
 				log.Fatalf("Invalid end datetime: %s", err)
 			}
@@ -63,30 +167,104 @@ func main() {
 	default:
 		// Other operations take a date only format. These also accept defaults.
 		if startStr == "" {
-			start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+			start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
 		} else {
-			if start, err = time.Parse(dateFmt, startStr); err != nil {
+			if start, err = time.ParseInLocation(dateFmt, startStr, loc); err != nil {
 				log.Fatalf("Invalid start date: %s", err)
 			}
 		}
 
 		if endStr == "" {
-			end = time.Now()
+			end = now
 
 		} else {
-			if end, err = time.Parse(dateFmt, endStr); err != nil {
+			if end, err = time.ParseInLocation(dateFmt, endStr, loc); err != nil {
 				log.Fatalf("Invalid end date: %s", err)
 			}
 		}
 	}
 
 	// Check that the database file exists first. This is to prevent the db lib
-	// from creating an empty database if non-existing path was given.
-	if st, err := os.Stat(dbPath); err != nil || st.IsDir() {
+	// from creating an empty database if non-existing path was given. Imports
+	// without merge may create a new database.
+	if st, err := os.Stat(dbPath); (err != nil && (dumpType != "import" || merge)) || (err == nil && st.IsDir()) {
 		log.Fatalf("Invalid database path")
 	}
 
-	db := stopwatchdb.New()
+	var doc *stopwatchdb.Export
+	var events []stopwatchdb.ICalEvent
+	var entries []stopwatchdb.TrackerEntry
+	var intervals []stopwatchdb.TimewInterval
+	var rule stopwatchdb.TimewRule
+	var codes []model.CostCode
+	switch dumpType {
+	case "import":
+		if doc, err = readExport(importFile); err != nil {
+			log.Fatalf("Invalid import file: %s", err)
+		}
+
+	case "importics":
+		if events, err = readICal(importFile, loc); err != nil {
+			log.Fatalf("Invalid import file: %s", err)
+		}
+
+	case "importtracker":
+		if entries, err = readTrackerCSV(importFile, loc, trackerDateFmt); err != nil {
+			log.Fatalf("Invalid import file: %s", err)
+		}
+
+	case "importcodes":
+		if codes, err = readCostCodes(importFile, delimiter); err != nil {
+			log.Fatalf("Invalid import file: %s", err)
+		}
+
+	case "timewimport", "timewexport":
+		if timewDir == "" {
+			log.Fatalf("Timewarrior data directory is required")
+		}
+
+		if rule, err = stopwatchdb.ParseTimewRule(timewRule); err != nil {
+			log.Fatalf("Invalid Timewarrior rule: %s", err)
+		}
+
+		if dumpType == "timewimport" {
+			if intervals, err = stopwatchdb.ReadTimewData(timewDir); err != nil {
+				log.Fatalf("Unable to read Timewarrior data: %s", err)
+			}
+		}
+	}
+
+	// Restores work on the files without opening the database, so that a file
+	// that can't be opened can be restored.
+	if dumpType == "restore" {
+		var result interface{}
+		if snapshot == "" {
+			result, err = stopwatchdb.ListBackups(dbPath, backupDir)
+		} else {
+			result, err = restore(dbPath, backupDir, snapshot, force)
+		}
+		if err != nil {
+			log.Fatalf("Operation '%s' failed: %s", dumpType, err)
+		}
+
+		writeJSON(result)
+		return
+	}
+
+	var db stopwatchdb.Store = stopwatchdb.New()
+	db.SetLocation(loc)
+	db.SetParallelMode(parallelMode)
+	db.SetSource(stopwatchdb.SourceDumper)
+	if dumpType == "importics" || dumpType == "importtracker" || dumpType == "timewimport" || dumpType == "importcodes" {
+		db.SetSource(stopwatchdb.SourceImport)
+	}
+	db.SetBackupDir(backupDir)
+
+	// Leave migrations to be run explicitly when inspecting the schema.
+	if dumpType == "version" || dumpType == "migrate" {
+		db.SetAutoMigrate(false)
+	}
+
 	if err = db.Open(dbPath); err != nil {
 		log.Fatalf("Opening database failed: %s", err)
 	}
@@ -99,12 +277,91 @@ func main() {
 	case "slices":
 		result, err = db.GetSlices(groupID, start, end)
 
+	case "tags":
+		filter := stopwatchdb.TagFilter{Include: strings.Split(includeTags, ","), Exclude: strings.Split(excludeTags, ",")}
+		result, err = db.GetTagUsage(groupID, start, end, filter)
+
+	case "groups":
+		result, err = db.ReadGroupTree(true)
+
+	case "movegroup":
+		result, err = db.MoveGroup(groupID, parentID)
+
 	case "setslice":
 		result, err = db.SetSlice(groupID, taskID, start, end)
 
+	case "setnote":
+		result, err = db.SetSliceNote(groupID, taskID, start, note)
+
 	case "rmslice":
 		result, err = db.RemoveSlice(groupID, taskID, start)
 
+	case "version":
+		result, err = schemaVersion(db)
+
+	case "migrate":
+		result, err = db.Migrate()
+
+	case "check":
+		result, err = db.Check()
+
+	case "repair":
+		result, err = db.Repair()
+
+	case "undo":
+		result, err = db.Undo()
+
+	case "redo":
+		result, err = db.Redo()
+
+	case "backup":
+		result, err = db.Backup(stopwatchdb.BackupManual)
+
+	case "export":
+		result, err = db.Export()
+
+	case "import":
+		result, err = db.Import(doc, merge)
+
+	case "importics":
+		result, err = stopwatchdb.ImportICal(db, groupID, taskID, events)
+
+	case "importtracker":
+		result, err = stopwatchdb.ImportTracker(db, entries, dryRun)
+
+	case "costcodes":
+		result, err = db.ReadCostCodes(true)
+
+	case "importcodes":
+		result, err = db.ImportCostCodes(codes)
+
+	case "setcode":
+		result, err = db.SetTaskCostCode(groupID, taskID, costCode, start)
+
+	case "renamecode":
+		var n int
+		if n, err = db.RenameCostCode(costCode, newCode); err == nil {
+			result = map[string]interface{}{"code": newCode, "tasks": n}
+		}
+
+	case "timewimport":
+		var ignored int
+		var res *stopwatchdb.TrackerResult
+		if res, ignored, err = stopwatchdb.ImportTimew(db, intervals, rule, dryRun); ignored > 0 {
+			log.Printf("%d open or unmapped intervals ignored", ignored)
+		}
+		result = res
+
+	case "timewexport":
+		result, err = stopwatchdb.WriteTimewData(db, timewDir, rule, start, end)
+
+	case "audit":
+		// End date is inclusive.
+		if endStr != "" {
+			end = end.AddDate(0, 0, 1)
+		}
+		result, err = db.ReadAudit(stopwatchdb.AuditFilter{Start: start, End: end, GroupID: groupID, TaskID: taskID})
+
 	default:
 		log.Fatalf("Invalid dump type")
 	}
@@ -113,7 +370,135 @@ func main() {
 		log.Fatalf("Operation '%s' failed: %s", dumpType, err)
 	}
 
+	if format == "csv" {
+		if err = writeCSV(db, result, csvOpts); err != nil {
+			log.Fatalf("Writing CSV failed: %s", err)
+		}
+		return
+	}
+
+	if format == "ics" {
+		if err = stopwatchdb.WriteICal(os.Stdout, groupID, result.([]stopwatchdb.TaskSlices)); err != nil {
+			log.Fatalf("Writing iCalendar failed: %s", err)
+		}
+		return
+	}
+
+	writeJSON(result)
+}
+
+// writeJSON writes a result to stdout as indented JSON.
+func writeJSON(result interface{}) {
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetIndent("", "  ")
 	enc.Encode(result)
 }
+
+// schemaVersion reports the database schema version and pending migrations.
+func schemaVersion(db stopwatchdb.Store) (interface{}, error) {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		Version int
+		Latest  int
+		Pending []stopwatchdb.Migration
+	}{version, stopwatchdb.LatestSchemaVersion(), pending}, nil
+}
+
+// restore replaces the database file with given snapshot. Snapshots can be
+// given as a path or by name in the backup directory. Returns the restored
+// snapshot.
+func restore(dbPath, backupDir, snapshot string, force bool) (interface{}, error) {
+	snapshot, err := stopwatchdb.RestoreFile(dbPath, snapshot, backupDir, force)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("database restored from %s", snapshot)
+	return snapshot, nil
+}
+
+// writeCSV writes a usage report or slices to stdout as CSV.
+func writeCSV(db stopwatchdb.Store, result interface{}, opts stopwatchdb.CSVOptions) error {
+	switch res := result.(type) {
+	case *stopwatchdb.UsageReport:
+		return stopwatchdb.WriteUsageCSV(os.Stdout, res, opts)
+
+	case []stopwatchdb.TaskSlices:
+		group, err := db.GetGroup(groupID)
+		if err != nil {
+			return err
+		}
+		return stopwatchdb.WriteSlicesCSV(os.Stdout, group.Name, res, opts)
+	}
+
+	return errors.New("unsupported result")
+}
+
+// readExport reads an export document from a file.
+func readExport(path string) (*stopwatchdb.Export, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	doc := &stopwatchdb.Export{}
+	if err = json.NewDecoder(f).Decode(doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// readICal reads the events of an iCalendar file.
+func readICal(path string, loc *time.Location) ([]stopwatchdb.ICalEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return stopwatchdb.ReadICal(f, loc)
+}
+
+// readTrackerCSV reads the entries of a time tracker CSV export.
+func readTrackerCSV(path string, loc *time.Location, dateFmt string) ([]stopwatchdb.TrackerEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	format, entries, err := stopwatchdb.ReadTrackerCSV(f, loc, dateFmt)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("read %d entries from %s export", len(entries), format)
+	return entries, nil
+}
+
+// readCostCodes reads a cost code list from a CSV file.
+func readCostCodes(path, delimiter string) ([]model.CostCode, error) {
+	r := []rune(delimiter)
+	if len(r) != 1 {
+		return nil, errors.New("delimiter must be a single character")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return stopwatchdb.ReadCostCodeCSV(f, r[0])
+}
@@ -3,29 +3,60 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path"
 	"time"
 
 	app "github.com/msepp/stopwatch/stopwatchapp"
 	"github.com/msepp/stopwatch/stopwatchdb"
+	model "github.com/msepp/stopwatch/stopwatchmodel"
 )
 
 // HandleGUIMessage is called when we receive messages from the user interface.
+// Messages are handled one at a time, and not while timers are checked.
 func HandleGUIMessage(msg *app.Message) (interface{}, error) {
+	gState.mu.Lock()
+	defer gState.mu.Unlock()
+
 	switch msg.Key {
 
 	case app.RequestActiveTask:
 		return HandleGetActiveTask(msg)
 
+	case app.RequestActiveTasks:
+		return HandleGetActiveTasks(msg)
+
 	case app.RequestAddGroup:
 		return HandleAddGroup(msg)
 
 	case app.RequestAddTask:
 		return HandleAddTask(msg)
 
+	case app.RequestArchiveGroup:
+		return HandleArchiveGroup(msg, true)
+
+	case app.RequestArchiveTask:
+		return HandleArchiveTask(msg, true)
+
+	case app.RequestDeleteGroup:
+		return HandleDeleteGroup(msg)
+
+	case app.RequestDeleteTask:
+		return HandleDeleteTask(msg)
+
 	case app.RequestAppVersions:
 		return HandleGetAppVersions(msg)
 
+	case app.RequestExportCSV:
+		return HandleExportCSV(msg)
+
+	case app.RequestGetAudit:
+		return HandleGetAudit(msg)
+
+	case app.RequestGetCostCodes:
+		return HandleGetCostCodes(msg)
+
 	case app.RequestGetHistory:
 		return HandleGetHistory(msg)
 
@@ -35,6 +66,9 @@ func HandleGUIMessage(msg *app.Message) (interface{}, error) {
 	case app.RequestGroupTasks:
 		return HandleGetGroupTasks(msg)
 
+	case app.RequestGetTagUsage:
+		return HandleGetTagUsage(msg)
+
 	case app.RequestGetTask:
 		return HandleGetTask(msg)
 
@@ -44,15 +78,45 @@ func HandleGUIMessage(msg *app.Message) (interface{}, error) {
 	case app.RequestOpenDatabase:
 		return HandleOpenDatabase(msg)
 
+	case app.RequestRedo:
+		return HandleRedo(msg)
+
+	case app.RequestResolveGap:
+		return HandleResolveGap(msg)
+
+	case app.RequestRenameCostCode:
+		return HandleRenameCostCode(msg)
+
+	case app.RequestSaveCostCode:
+		return HandleSaveCostCode(msg)
+
 	case app.RequestSetHistory:
 		return HandleSetHistory(msg)
 
+	case app.RequestSetSliceNote:
+		return HandleSetSliceNote(msg)
+
+	case app.RequestSetTaskTags:
+		return HandleSetTaskTags(msg)
+
 	case app.RequestStartTask:
 		return HandleStartTask(msg)
 
 	case app.RequestStopTask:
 		return HandleStopTask(msg)
 
+	case app.RequestUndo:
+		return HandleUndo(msg)
+
+	case app.RequestUnarchiveGroup:
+		return HandleArchiveGroup(msg, false)
+
+	case app.RequestUnarchiveTask:
+		return HandleArchiveTask(msg, false)
+
+	case app.RequestMoveGroup:
+		return HandleMoveGroup(msg)
+
 	case app.RequestUpdateGroup:
 		return HandleUpdateGroup(msg)
 
@@ -75,33 +139,100 @@ func HandleGetAppVersions(msg *app.Message) (interface{}, error) {
 }
 
 // HandleOpenDatabase attempts to open database. Returns if the operation
-// succeeded.
+// succeeded. The database is only made available once it's open.
 func HandleOpenDatabase(msg *app.Message) (interface{}, error) {
-	if gState.db == nil {
-		gState.db = stopwatchdb.New()
-	}
+	if gState.db != nil && gState.db.IsOpen() {
+		return nil, nil
+	}
+
+	db := stopwatchdb.New()
+	db.SetLocation(gState.location)
+	db.SetMultiTimer(gState.multiTimer)
+	db.SetStrictCostCodes(gState.strictCodes)
+	db.SetParallelMode(gState.parallel)
+	db.SetMaxDuration(gState.maxDuration)
+	db.SetDayEnd(gState.dayEnd)
+	db.SetGapThreshold(gState.gapThreshold)
+	db.SetSource(stopwatchdb.SourceGUI)
+	db.SetUndoLimit(gState.undoLimit)
+	db.SetBackupDir(gState.backupDir)
+	db.SetBackupRetention(gState.backupKeep)
+	db.SetAutoBackup(true)
 
 	if gState.databasePath == "" {
 		rootdir := gState.app.WorkingDir()
 		gState.databasePath = path.Join(rootdir, "data.dat")
 	}
 
-	if err := gState.db.Open(gState.databasePath); err != nil {
-		gState.db = nil
+	if err := db.Open(gState.databasePath); err != nil {
 		return nil, fmt.Errorf("failed to open database: %s", err)
 	}
+	gState.db = db
+
+	// Timers may have been left running while the app was closed.
+	capForgottenTimers()
+	checkTimerGap()
 
 	return nil, nil
 }
 
+// HandleGetCostCodes returns the registered cost codes
+func HandleGetCostCodes(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadGetCostCodes
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	return gState.db.ReadCostCodes(payload.Inactive)
+}
+
+// HandleSaveCostCode adds or updates a registered cost code
+func HandleSaveCostCode(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadSaveCostCode
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	code := &model.CostCode{Code: payload.Code, Description: payload.Description, Active: payload.Active}
+	return code, gState.db.SaveCostCode(code)
+}
+
+// HandleRenameCostCode renames a cost code, also on the tasks using it.
+// Returns the number of tasks updated.
+func HandleRenameCostCode(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadRenameCostCode
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	return gState.db.RenameCostCode(payload.Code, payload.NewCode)
+}
+
 // HandleGetHistory returns task history
 func HandleGetHistory(msg *app.Message) (interface{}, error) {
 	if gState.db == nil {
 		return nil, fmt.Errorf("no database")
 	}
 
+	var payload ReqPayloadGetHistory
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
 	// Retrieve task usage
-	history, err := gState.db.ReadHistory()
+	history, err := gState.db.ReadHistory(payload.Archived)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to read history: %s", err)
 	}
@@ -135,8 +266,21 @@ func HandleGetGroups(msg *app.Message) (interface{}, error) {
 		return nil, fmt.Errorf("no database")
 	}
 
+	var payload ReqPayloadGetGroups
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	if payload.Tree {
+		tree, err := gState.db.ReadGroupTree(payload.Archived)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read groups: %s", err)
+		}
+		return tree, nil
+	}
+
 	// Retrieve groups
-	groups, err := gState.db.ReadGroups()
+	groups, err := gState.db.ReadGroups(payload.Archived)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to read groups: %s", err)
 	}
@@ -170,6 +314,9 @@ func HandleGetActiveTask(msg *app.Message) (interface{}, error) {
 		return nil, fmt.Errorf("no database")
 	}
 
+	// Running timer may need attention after a crash or suspend.
+	checkTimerGap()
+
 	// Get active task
 	at, err := gState.db.GetActiveTask()
 	if err != nil {
@@ -179,6 +326,59 @@ func HandleGetActiveTask(msg *app.Message) (interface{}, error) {
 	return at, nil
 }
 
+// HandleGetActiveTasks returns all active tasks.
+func HandleGetActiveTasks(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	// Get active tasks
+	tasks, err := gState.db.GetActiveTasks()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read active tasks: %s", err)
+	}
+
+	return tasks, nil
+}
+
+// HandleResolveGap handles timers that kept running while the app wasn't
+// responding, using the action chosen by the user.
+func HandleResolveGap(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadResolveGap
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	// The action only applies to the gap the user was asked about.
+	offered := gState.lastGap
+	if payload.LastSeen != "" {
+		var err error
+		if offered, err = time.Parse(time.RFC3339Nano, payload.LastSeen); err != nil {
+			return nil, fmt.Errorf("last seen invalid: %s", err)
+		}
+	}
+
+	gap, err := gState.db.CheckGap()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to check gap: %s", err)
+	}
+	if gap == nil || offered.IsZero() || !gap.LastSeen.Equal(offered) {
+		return nil, errors.New("gap has changed, no action taken")
+	}
+
+	tasks, err := gState.db.ResolveGap(payload.Action)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve gap: %s", err)
+	}
+	gState.lastGap = time.Time{}
+
+	return tasks, nil
+}
+
 // HandleGetGroupTasks returns list of tasks for a group
 func HandleGetGroupTasks(msg *app.Message) (interface{}, error) {
 	if gState.db == nil {
@@ -191,7 +391,7 @@ func HandleGetGroupTasks(msg *app.Message) (interface{}, error) {
 	}
 
 	// Retrieve tasks
-	tlist, err := gState.db.ReadTasks(payload.GroupID)
+	tlist, err := gState.db.ReadTasks(payload.GroupID, payload.Archived)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to read tasks: %s", err)
 	}
@@ -245,6 +445,69 @@ func HandleUpdateGroup(msg *app.Message) (interface{}, error) {
 	return grp, gState.db.SaveGroup(grp)
 }
 
+// HandleMoveGroup moves a group under another group. Returns the moved group.
+func HandleMoveGroup(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadMoveGroup
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	if payload.GroupID <= 0 || payload.ParentID < 0 {
+		return nil, fmt.Errorf("group id must be non-zero positive integer")
+	}
+
+	return gState.db.MoveGroup(payload.GroupID, payload.ParentID)
+}
+
+// HandleArchiveGroup archives or restores a group
+func HandleArchiveGroup(msg *app.Message, archived bool) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadArchiveGroup
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	if payload.GroupID <= 0 {
+		return nil, fmt.Errorf("group id must be non-zero positive integer")
+	}
+
+	grp, err := gState.db.SetGroupArchived(payload.GroupID, archived)
+	if err != nil {
+		return nil, fmt.Errorf("failed to archive group: %s", err)
+	}
+
+	return grp, nil
+}
+
+// HandleDeleteGroup removes a group and everything recorded for it
+func HandleDeleteGroup(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadDeleteGroup
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	if payload.GroupID <= 0 {
+		return nil, fmt.Errorf("group id must be non-zero positive integer")
+	}
+
+	if err := gState.db.DeleteGroup(payload.GroupID); err != nil {
+		return nil, fmt.Errorf("failed to delete group: %s", err)
+	}
+
+	return nil, nil
+}
+
 // HandleUpdateTask updates task value in database
 func HandleUpdateTask(msg *app.Message) (interface{}, error) {
 	if gState.db == nil {
@@ -270,11 +533,95 @@ func HandleUpdateTask(msg *app.Message) (interface{}, error) {
 		return nil, fmt.Errorf("task not found: %s", err)
 	}
 
+	// A changed cost code applies from the effective date on, so that reports
+	// of earlier time don't change.
+	loc := gState.db.Location()
+	now := time.Now().In(loc)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if payload.Effective != "" {
+		if from, err = time.ParseInLocation("2006-01-02", payload.Effective, loc); err != nil {
+			return nil, fmt.Errorf("effective date invalid: %s", err)
+		}
+	}
+
 	// Save with new name
 	task.Name = payload.Name
 	task.CostCode = payload.CostCode
+	if payload.Description != nil {
+		task.Description = *payload.Description
+	}
+	if payload.Reference != nil {
+		task.Reference = *payload.Reference
+	}
+	if payload.Billable != nil {
+		task.Billable = *payload.Billable
+	}
+
+	// The code and the other fields change together.
+	return task, gState.db.SaveTaskFrom(task, from)
+}
+
+// HandleSetTaskTags replaces the tags of a task. Returns the updated task.
+func HandleSetTaskTags(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadSetTaskTags
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
 
-	return task, gState.db.SaveTask(task)
+	if payload.GroupID <= 0 || payload.TaskID <= 0 {
+		return nil, fmt.Errorf("group id and task id must be non-zero positive integers")
+	}
+
+	return gState.db.SetTaskTags(payload.GroupID, payload.TaskID, payload.Tags)
+}
+
+// HandleArchiveTask archives or restores a task
+func HandleArchiveTask(msg *app.Message, archived bool) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadArchiveTask
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	if payload.GroupID <= 0 || payload.TaskID <= 0 {
+		return nil, fmt.Errorf("group id and task id must be non-zero positive integers")
+	}
+
+	task, err := gState.db.SetTaskArchived(payload.GroupID, payload.TaskID, archived)
+	if err != nil {
+		return nil, fmt.Errorf("failed to archive task: %s", err)
+	}
+
+	return task, nil
+}
+
+// HandleDeleteTask removes a task and everything recorded for it
+func HandleDeleteTask(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadDeleteTask
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	if payload.GroupID <= 0 || payload.TaskID <= 0 {
+		return nil, fmt.Errorf("group id and task id must be non-zero positive integers")
+	}
+
+	if err := gState.db.DeleteTask(payload.GroupID, payload.TaskID); err != nil {
+		return nil, fmt.Errorf("failed to delete task: %s", err)
+	}
+
+	return nil, nil
 }
 
 // HandleAddTask adds a task for a group using details from msg data
@@ -318,36 +665,13 @@ func HandleStartTask(msg *app.Message) (interface{}, error) {
 		return nil, fmt.Errorf("group and task IDs must be non-zero positive integers")
 	}
 
-	// Locate task
-	task, err := gState.db.GetTask(payload.GroupID, payload.TaskID)
+	// Stop current task and start the given one
+	task, err := gState.db.SwitchTask(payload.GroupID, payload.TaskID)
 	if err != nil {
 		return nil, fmt.Errorf("failure starting task: %s", err)
 	}
 
-	activeTask, err := gState.db.GetActiveTask()
-	if err != nil {
-		return nil, fmt.Errorf("Unable test active task: %s", err)
-	}
-
-	// Stop active task if not the same as current task
-	if activeTask != nil {
-		if activeTask.ID == task.ID && activeTask.GroupID == task.GroupID {
-			if activeTask.Running != nil {
-				return activeTask, nil
-			}
-		} else {
-			if _, err = gState.db.StopTask(activeTask.GroupID, activeTask.ID); err != nil {
-				return nil, fmt.Errorf("unable to stop current task: %s", err)
-			}
-		}
-	}
-
-	if err = gState.db.SetActiveTask(task.GroupID, task.ID); err != nil {
-		return nil, fmt.Errorf("unable to set active task: %s", err)
-	}
-
-	// Mark running
-	return gState.db.StartTask(task.GroupID, task.ID)
+	return task, nil
 }
 
 // HandleStopTask stops a task
@@ -365,29 +689,36 @@ func HandleStopTask(msg *app.Message) (interface{}, error) {
 		return nil, fmt.Errorf("group and task IDs must be non-zero positive integers")
 	}
 
-	// Locate task
-	task, err := gState.db.GetTask(payload.GroupID, payload.TaskID)
+	// Stop task, clears active task if it matches the given task
+	task, err := gState.db.StopTaskNote(payload.GroupID, payload.TaskID, payload.Note)
 	if err != nil {
 		return nil, fmt.Errorf("failure stopping task: %s", err)
 	}
 
-	// Stop active task if it matches current task
-	activeTask, err := gState.db.GetActiveTask()
-	if err != nil {
-		return nil, fmt.Errorf("Unable test active task: %s", err)
+	return task, nil
+}
+
+// HandleSetSliceNote sets the note of a slice. Returns the updated slice.
+func HandleSetSliceNote(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
 	}
 
-	// Stop active task if it matches the given task
-	if activeTask != nil {
-		if activeTask.ID == task.ID && activeTask.GroupID == task.GroupID {
-			if err := gState.db.SetActiveTask(0, 0); err != nil {
-				return nil, fmt.Errorf("unable to clear active task: %s", err)
-			}
-		}
+	var payload ReqPayloadSetSliceNote
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	if payload.GroupID <= 0 || payload.TaskID <= 0 {
+		return nil, fmt.Errorf("group and task IDs must be non-zero positive integers")
+	}
+
+	start, err := time.Parse(time.RFC3339Nano, payload.Start)
+	if err != nil {
+		return nil, fmt.Errorf("start invalid: %s", err)
 	}
 
-	// Mark running
-	return gState.db.StopTask(task.GroupID, task.ID)
+	return gState.db.SetSliceNote(payload.GroupID, payload.TaskID, start, payload.Note)
 }
 
 // HandleGetUsage handle request for usage statistics
@@ -422,3 +753,164 @@ func HandleGetUsage(msg *app.Message) (interface{}, error) {
 
 	return gState.db.GetUsage(payload.GroupID, start, end)
 }
+
+// HandleGetTagUsage handles request for usage statistics by tag
+func HandleGetTagUsage(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadGetTagUsage
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	if payload.GroupID <= 0 {
+		return nil, errors.New("invalid group id")
+	}
+
+	var start time.Time
+	var end time.Time
+	var err error
+
+	if start, err = time.Parse("2006-01-02", payload.StartDate); err != nil {
+		return nil, fmt.Errorf("start date invalid: %s", err)
+	}
+	if end, err = time.Parse("2006-01-02", payload.EndDate); err != nil {
+		return nil, fmt.Errorf("end date invalid: %s", err)
+	}
+
+	filter := stopwatchdb.TagFilter{Include: payload.Include, Exclude: payload.Exclude}
+	return gState.db.GetTagUsage(payload.GroupID, start, end, filter)
+}
+
+// HandleExportCSV writes a usage report or the slices of a group to a CSV file.
+// Returns the path written.
+func HandleExportCSV(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadExportCSV
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	if payload.GroupID <= 0 {
+		return nil, errors.New("invalid group id")
+	}
+
+	if payload.Path == "" {
+		return nil, errors.New("path can't be empty")
+	}
+
+	opts := stopwatchdb.CSVOptions{
+		TimeFormat: payload.TimeFormat,
+		Location:   gState.db.Location(),
+	}
+
+	var err error
+	if opts.DurationFormat, err = stopwatchdb.ParseDurationFormat(payload.DurationFormat); err != nil {
+		return nil, err
+	}
+
+	if opts.Delimiter, err = stopwatchdb.ParseDelimiter(payload.Delimiter); err != nil {
+		return nil, err
+	}
+
+	var start time.Time
+	var end time.Time
+
+	if start, err = time.Parse("2006-01-02", payload.StartDate); err != nil {
+		return nil, fmt.Errorf("start date invalid: %s", err)
+	}
+	if end, err = time.Parse("2006-01-02", payload.EndDate); err != nil {
+		return nil, fmt.Errorf("end date invalid: %s", err)
+	}
+
+	// Read everything before creating the file, so that a failed export
+	// doesn't leave an empty file behind.
+	var write func(w io.Writer) error
+	switch payload.Type {
+	case "report":
+		rep, err := gState.db.GetUsage(payload.GroupID, start, end)
+		if err != nil {
+			return nil, err
+		}
+		write = func(w io.Writer) error { return stopwatchdb.WriteUsageCSV(w, rep, opts) }
+
+	case "slices":
+		group, err := gState.db.GetGroup(payload.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		slices, err := gState.db.GetSlices(payload.GroupID, start, end)
+		if err != nil {
+			return nil, err
+		}
+		write = func(w io.Writer) error { return stopwatchdb.WriteSlicesCSV(w, group.Name, slices, opts) }
+
+	default:
+		return nil, fmt.Errorf("unknown export type '%s'", payload.Type)
+	}
+
+	f, err := os.Create(payload.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = write(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return payload.Path, f.Close()
+}
+
+// HandleGetAudit returns the audit log entries matching the request.
+func HandleGetAudit(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	var payload ReqPayloadGetAudit
+	if err := msg.Into(&payload); err != nil {
+		return nil, fmt.Errorf("payload invalid: %s", err)
+	}
+
+	filter := stopwatchdb.AuditFilter{GroupID: payload.GroupID, TaskID: payload.TaskID}
+	loc := gState.db.Location()
+	var err error
+
+	if payload.StartDate != "" {
+		if filter.Start, err = time.ParseInLocation("2006-01-02", payload.StartDate, loc); err != nil {
+			return nil, fmt.Errorf("start date invalid: %s", err)
+		}
+	}
+	if payload.EndDate != "" {
+		if filter.End, err = time.ParseInLocation("2006-01-02", payload.EndDate, loc); err != nil {
+			return nil, fmt.Errorf("end date invalid: %s", err)
+		}
+		filter.End = filter.End.AddDate(0, 0, 1)
+	}
+
+	return gState.db.ReadAudit(filter)
+}
+
+// HandleUndo reverts the latest change. Returns the reverted change.
+func HandleUndo(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	return gState.db.Undo()
+}
+
+// HandleRedo applies the latest reverted change again. Returns the change.
+func HandleRedo(msg *app.Message) (interface{}, error) {
+	if gState.db == nil {
+		return nil, fmt.Errorf("no database")
+	}
+
+	return gState.db.Redo()
+}
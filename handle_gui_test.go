@@ -0,0 +1,296 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	app "github.com/msepp/stopwatch/stopwatchapp"
+	"github.com/msepp/stopwatch/stopwatchdb"
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// useMemoryDB replaces the global database with an in-memory one. The returned
+// function restores the previous database.
+func useMemoryDB(t *testing.T) func() {
+	db := stopwatchdb.NewMemory()
+	if err := db.Open(""); err != nil {
+		t.Fatalf("Unable to open database: %s", err)
+	}
+
+	prev := gState.db
+	gState.db = db
+
+	return func() {
+		db.Close()
+		gState.db = prev
+	}
+}
+
+func taskStatusMsg(key app.Key, group, task int) *app.Message {
+	return &app.Message{ID: "1", Key: key, Data: map[string]interface{}{
+		"groupid": group,
+		"id":      task,
+	}}
+}
+
+func TestHandleStartStopTask(t *testing.T) {
+	defer useMemoryDB(t)()
+
+	g, _ := gState.db.AddGroup("group")
+	a, _ := gState.db.AddTask(g.ID, "a", "code")
+	b, _ := gState.db.AddTask(g.ID, "b", "code")
+
+	if _, err := HandleStartTask(taskStatusMsg(app.RequestStartTask, g.ID, a.ID)); err != nil {
+		t.Fatalf("Unable to start a: %s", err)
+	}
+
+	res, err := HandleStartTask(taskStatusMsg(app.RequestStartTask, g.ID, b.ID))
+	if err != nil {
+		t.Fatalf("Unable to start b: %s", err)
+	}
+	if task, ok := res.(*model.Task); !ok || task.ID != b.ID || task.Running == nil {
+		t.Errorf("Wrong task started: %+v", res)
+	}
+
+	// Starting a task stops the previous one.
+	if a, _ = gState.db.GetTask(g.ID, a.ID); a.Running != nil {
+		t.Errorf("Previous task still running: %+v", a)
+	}
+
+	if res, _ = HandleGetActiveTask(nil); res.(*model.Task) == nil || res.(*model.Task).ID != b.ID {
+		t.Errorf("Wrong active task: %+v", res)
+	}
+
+	if _, err = HandleStopTask(taskStatusMsg(app.RequestStopTask, g.ID, b.ID)); err != nil {
+		t.Fatalf("Unable to stop b: %s", err)
+	}
+
+	if res, _ = HandleGetActiveTask(nil); res.(*model.Task) != nil {
+		t.Errorf("Active task left after stop: %+v", res)
+	}
+}
+
+func TestHandleStartTaskInvalid(t *testing.T) {
+	defer useMemoryDB(t)()
+
+	if _, err := HandleStartTask(taskStatusMsg(app.RequestStartTask, 0, 1)); err == nil {
+		t.Errorf("Expected error for zero group ID")
+	}
+
+	if _, err := HandleStartTask(taskStatusMsg(app.RequestStartTask, 1, 1)); err == nil {
+		t.Errorf("Expected error for missing task")
+	}
+}
+
+func TestHandleExportCSV(t *testing.T) {
+	defer useMemoryDB(t)()
+
+	g, _ := gState.db.AddGroup("group")
+	a, _ := gState.db.AddTask(g.ID, "a", "code")
+	start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+	gState.db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+
+	dir, err := ioutil.TempDir("", "stopwatch")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "slices.csv")
+	msg := &app.Message{ID: "1", Key: app.RequestExportCSV, Data: map[string]interface{}{
+		"groupid":   g.ID,
+		"type":      "slices",
+		"start":     "2017-12-05",
+		"end":       "2017-12-05",
+		"path":      path,
+		"delimiter": ";",
+		"durfmt":    "minutes",
+	}}
+
+	if _, err = HandleExportCSV(msg); err != nil {
+		t.Fatalf("Unable to export: %s", err)
+	}
+
+	buf, _ := ioutil.ReadFile(path)
+	if !strings.HasSuffix(string(buf), "group;a;code;2017-12-05T08:00:00Z;2017-12-05T09:00:00Z;60;\n") {
+		t.Errorf("Wrong CSV written: %s", buf)
+	}
+
+	// Failed exports don't create the file.
+	msg.Data.(map[string]interface{})["type"] = "unknown"
+	msg.Data.(map[string]interface{})["path"] = filepath.Join(dir, "unknown.csv")
+	if _, err = HandleExportCSV(msg); err == nil {
+		t.Errorf("Expected error for unknown type")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "unknown.csv")); err == nil {
+		t.Errorf("File created by a failed export")
+	}
+}
+
+func TestHandleUpdateTask(t *testing.T) {
+	defer useMemoryDB(t)()
+
+	g, _ := gState.db.AddGroup("group")
+	a, _ := gState.db.AddTask(g.ID, "a", "code")
+
+	msg := &app.Message{ID: "1", Key: app.RequestUpdateTask, Data: map[string]interface{}{
+		"groupid":     g.ID,
+		"id":          a.ID,
+		"name":        "a",
+		"costcode":    "code",
+		"description": "longer description",
+		"reference":   "TICKET-1",
+	}}
+
+	// Billable is kept when not given.
+	if _, err := HandleUpdateTask(msg); err != nil {
+		t.Fatalf("Unable to update task: %s", err)
+	}
+	if a, _ = gState.db.GetTask(g.ID, a.ID); !a.Billable || a.Description != "longer description" || a.Reference != "TICKET-1" {
+		t.Errorf("Wrong task after update: %+v", a)
+	}
+
+	msg.Data.(map[string]interface{})["billable"] = false
+	if _, err := HandleUpdateTask(msg); err != nil {
+		t.Fatalf("Unable to update task: %s", err)
+	}
+	if a, _ = gState.db.GetTask(g.ID, a.ID); a.Billable {
+		t.Errorf("Billable flag not cleared: %+v", a)
+	}
+
+	// Description and reference are kept when not given, and cleared when
+	// given empty.
+	msg.Data = map[string]interface{}{"groupid": g.ID, "id": a.ID, "name": "a", "costcode": "code", "reference": ""}
+	if _, err := HandleUpdateTask(msg); err != nil {
+		t.Fatalf("Unable to update task: %s", err)
+	}
+	if a, _ = gState.db.GetTask(g.ID, a.ID); a.Description != "longer description" || a.Reference != "" {
+		t.Errorf("Wrong task after partial update: %+v", a)
+	}
+}
+
+func TestHandleUpdateTaskCostCode(t *testing.T) {
+	defer useMemoryDB(t)()
+
+	g, _ := gState.db.AddGroup("group")
+	a, _ := gState.db.AddTask(g.ID, "a", "old")
+	start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+	gState.db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+
+	msg := &app.Message{ID: "1", Key: app.RequestUpdateTask, Data: map[string]interface{}{
+		"groupid":     g.ID,
+		"id":          a.ID,
+		"name":        "renamed",
+		"costcode":    "new",
+		"effective":   "2017-12-06",
+		"description": "",
+	}}
+
+	res, err := HandleUpdateTask(msg)
+	if err != nil {
+		t.Fatalf("Unable to update task: %s", err)
+	}
+	if task := res.(*model.Task); task.Name != "renamed" || task.CostCode != "new" {
+		t.Errorf("Wrong task after update: %+v", task)
+	}
+
+	if rep, _ := gState.db.GetUsage(g.ID, start, start); len(rep.CostCodes) != 1 || rep.CostCodes[0].CostCode != "old" {
+		t.Errorf("Earlier report changed: %+v", rep.CostCodes)
+	}
+
+	// The code and the name are changed, and undone, together.
+	if _, err = gState.db.Undo(); err != nil {
+		t.Fatalf("Unable to undo update: %s", err)
+	}
+	if a, _ = gState.db.GetTask(g.ID, a.ID); a.Name != "a" || a.CostCode != "old" || len(a.CostCodes) != 0 {
+		t.Errorf("Wrong task after undo: %+v", a)
+	}
+
+	msg.Data.(map[string]interface{})["costcode"] = "newer"
+	msg.Data.(map[string]interface{})["effective"] = "6.12.2017"
+	if _, err = HandleUpdateTask(msg); err == nil {
+		t.Errorf("Expected error for invalid effective date")
+	}
+}
+
+func TestHandleOpenDatabaseFailure(t *testing.T) {
+	defer useMemoryDB(t)()
+	gState.db = nil
+
+	dir, err := ioutil.TempDir("", "stopwatch")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	prev := gState.databasePath
+	gState.databasePath = dir
+	defer func() { gState.databasePath = prev }()
+
+	// A directory can't be opened as a database.
+	if _, err = HandleOpenDatabase(nil); err == nil {
+		t.Fatalf("Expected error opening a directory")
+	}
+	if gState.db != nil {
+		t.Errorf("Database published after a failed open")
+	}
+
+	// Timer checks skip a missing database.
+	checkTimers()
+}
+
+func TestHandleResolveGapChanged(t *testing.T) {
+	defer useMemoryDB(t)()
+
+	// Gap already resolved elsewhere or never offered.
+	gState.lastGap = time.Now().Add(-time.Hour)
+	defer func() { gState.lastGap = time.Time{} }()
+
+	msg := &app.Message{Key: app.RequestResolveGap, Data: map[string]interface{}{"action": "keep"}}
+	if _, err := HandleResolveGap(msg); err == nil {
+		t.Errorf("Expected error resolving a gap that is gone")
+	}
+
+	msg.Data = map[string]interface{}{"action": "keep", "lastseen": "yesterday"}
+	if _, err := HandleResolveGap(msg); err == nil {
+		t.Errorf("Expected error for invalid last seen")
+	}
+}
+
+func TestHandleDeleteGroupAndTask(t *testing.T) {
+	defer useMemoryDB(t)()
+
+	g, _ := gState.db.AddGroup("group")
+	a, _ := gState.db.AddTask(g.ID, "a", "code")
+	b, _ := gState.db.AddTask(g.ID, "b", "code")
+	gState.db.SwitchTask(g.ID, a.ID)
+
+	if _, err := HandleGUIMessage(taskStatusMsg(app.RequestDeleteTask, g.ID, 0)); err == nil {
+		t.Errorf("Expected error for zero task ID")
+	}
+
+	if _, err := HandleGUIMessage(taskStatusMsg(app.RequestDeleteTask, g.ID, a.ID)); err != nil {
+		t.Fatalf("Unable to delete task: %s", err)
+	}
+	if task, _ := gState.db.GetTask(g.ID, a.ID); task != nil {
+		t.Errorf("Deleted task found: %+v", task)
+	}
+	if active, _ := gState.db.GetActiveTasks(); len(active) != 0 {
+		t.Errorf("Deleted task still active: %+v", active)
+	}
+
+	msg := &app.Message{ID: "1", Key: app.RequestDeleteGroup, Data: map[string]interface{}{"id": g.ID}}
+	if _, err := HandleGUIMessage(msg); err != nil {
+		t.Fatalf("Unable to delete group: %s", err)
+	}
+	if groups, _ := gState.db.ReadGroups(true); len(groups) != 0 {
+		t.Errorf("Deleted group listed: %+v", groups)
+	}
+	if task, _ := gState.db.GetTask(g.ID, b.ID); task != nil {
+		t.Errorf("Task of deleted group found: %+v", task)
+	}
+}
@@ -6,25 +6,69 @@ package main
 import (
 	"flag"
 	"log"
+	"sync"
+	"time"
 
 	app "github.com/msepp/stopwatch/stopwatchapp"
 	"github.com/msepp/stopwatch/stopwatchdb"
 )
 
-// Various handles that are used globally
+// Various handles that are used globally. GUI messages and timer checks hold mu
+// while they use the state.
 var gState = struct {
+	mu           sync.Mutex
 	app          *app.App
-	db           *stopwatchdb.StopwatchDB
+	db           stopwatchdb.Store
 	databasePath string
 	workDir      string
+	location     *time.Location
+	multiTimer   bool
+	strictCodes  bool
+	parallel     stopwatchdb.ParallelMode
+	maxDuration  time.Duration
+	dayEnd       time.Duration
+	gapThreshold time.Duration
+	lastGap      time.Time
+	undoLimit    int
+	backupDir    string
+	backupKeep   int
 }{}
 
 func main() {
+	var timezone string
+	var parallel string
+	var dayEnd string
+	var err error
+
 	flag.StringVar(&gState.workDir, "work", "", "Working directory. If not set, an attempt is made to guess users home.")
 	flag.StringVar(&gState.databasePath, "db", "", "Database path. If none given, a database is created under working dir.")
+	flag.StringVar(&timezone, "tz", "UTC", "Time zone for splitting days in reports, eg. 'Europe/Helsinki'. Use 'Local' for system time zone.")
+	flag.BoolVar(&gState.multiTimer, "multi", false, "Allow running several tasks at the same time.")
+	flag.BoolVar(&gState.strictCodes, "strictcodes", false, "Only allow active cost codes of the registry, or no code, on tasks.")
+	flag.StringVar(&parallel, "parallel", "full", "How time of tasks running at the same time is reported. 'full' counts it for each task, 'split' divides it between the tasks.")
+	flag.DurationVar(&gState.maxDuration, "maxrun", 0, "Stop timers that have been running longer than this, eg. '10h'. Zero disables.")
+	flag.StringVar(&dayEnd, "dayend", "", "End of working day, eg. '18:00'. Timers left running over night are stopped at this time.")
+	flag.DurationVar(&gState.gapThreshold, "gap", 5*time.Minute, "Ask what to do with running timers when the app has not been running for longer than this.")
+	flag.IntVar(&gState.undoLimit, "undo", 20, "Number of changes that can be undone. Zero disables undo.")
+	flag.StringVar(&gState.backupDir, "backups", "", "Directory for database snapshots. If not set, a backups directory is created next to the database.")
+	flag.IntVar(&gState.backupKeep, "keep", 14, "Number of database snapshots to keep for each reason, eg. daily or before migrations. Zero keeps all.")
 	// Init
 	flag.Parse()
 
+	if gState.location, err = time.LoadLocation(timezone); err != nil {
+		log.Fatalf("Invalid time zone: %s", err)
+	}
+
+	if gState.parallel, err = stopwatchdb.ParseParallelMode(parallel); err != nil {
+		log.Fatalf("Invalid parallel mode: %s", err)
+	}
+
+	if dayEnd != "" {
+		if gState.dayEnd, err = stopwatchdb.ParseTimeOfDay(dayEnd); err != nil {
+			log.Fatalf("Invalid end of day: %s", err)
+		}
+	}
+
 	// Init new application
 	gState.app = app.New(Asset, RestoreAsset, HandleGUIMessage)
 
@@ -38,11 +82,20 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	// Check for forgotten timers while running
+	go watchTimers(time.Minute)
+
 	// Wait for app to exit
 	gState.app.Wait()
 
 	// Close database
+	gState.mu.Lock()
+	defer gState.mu.Unlock()
 	if gState.db != nil {
+		// Timers left running aren't a gap on the next start.
+		if err := gState.db.Shutdown(); err != nil {
+			log.Printf("Unable to record shutdown: %s", err)
+		}
 		gState.db.Close()
 	}
 }
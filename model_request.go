@@ -18,10 +18,48 @@ type ReqPayloadUpdateGroup struct {
 	Name string `json:"name" mapstructure:"name"`
 }
 
+// ReqPayloadDeleteGroup defines data fields required to delete a group
+type ReqPayloadDeleteGroup struct {
+	// GroupID is the groups ID. Required.
+	GroupID int `json:"id" mapstructure:"id"`
+}
+
+// ReqPayloadArchiveGroup defines data fields required to archive or restore a
+// group
+type ReqPayloadArchiveGroup struct {
+	// GroupID is the groups ID. Required.
+	GroupID int `json:"id" mapstructure:"id"`
+}
+
+// ReqPayloadGetGroups defines data fields available when reading groups
+type ReqPayloadGetGroups struct {
+	// Archived includes archived groups when true.
+	Archived bool `json:"archived" mapstructure:"archived"`
+	// Tree returns the groups as a tree of parents and children when true.
+	Tree bool `json:"tree" mapstructure:"tree"`
+}
+
+// ReqPayloadMoveGroup defines data fields required to move a group under
+// another group
+type ReqPayloadMoveGroup struct {
+	// GroupID is the groups ID. Required.
+	GroupID int `json:"id" mapstructure:"id"`
+	// ParentID of the new parent. Zero moves the group to the top level.
+	ParentID int `json:"parentid" mapstructure:"parentid"`
+}
+
 // ReqPayloadGetGroupTasks defines data fields available when reading groups tasks
 type ReqPayloadGetGroupTasks struct {
 	// GroupID of the group to fetch. Required.
 	GroupID int `json:"id" mapstructure:"id"`
+	// Archived includes archived tasks when true.
+	Archived bool `json:"archived" mapstructure:"archived"`
+}
+
+// ReqPayloadGetHistory defines data fields available when reading task history
+type ReqPayloadGetHistory struct {
+	// Archived includes archived tasks when true.
+	Archived bool `json:"archived" mapstructure:"archived"`
 }
 
 // ReqPayloadSetHistory is the payload for updating task usage history
@@ -45,6 +83,21 @@ type ReqPayloadSetTaskStatus struct {
 	GroupID int `json:"groupid" mapstructure:"groupid"`
 	// TaskID of the target task. Required.
 	TaskID int `json:"taskid" mapstructure:"id"`
+	// Note for the stopped slice. Only used when stopping a task.
+	Note string `json:"note" mapstructure:"note"`
+}
+
+// ReqPayloadSetSliceNote defines data fields required for setting the note of
+// a slice
+type ReqPayloadSetSliceNote struct {
+	// GroupID of the target task. Required.
+	GroupID int `json:"groupid" mapstructure:"groupid"`
+	// TaskID of the target task. Required.
+	TaskID int `json:"taskid" mapstructure:"id"`
+	// Start of the slice in RFC 3339 format. Required.
+	Start string `json:"start" mapstructure:"start"`
+	// Note of the slice. Empty removes the note.
+	Note string `json:"note" mapstructure:"note"`
 }
 
 // ReqPayloadGetTask defines data fields required for reading task details
@@ -65,6 +118,44 @@ type ReqPayloadUpdateTask struct {
 	Name string `json:"name" mapstructure:"name"`
 	// CostCode for the task.
 	CostCode string `json:"costcode" mapstructure:"costcode"`
+	// Effective is the date a changed cost code applies from, as YYYY-MM-DD.
+	// Defaults to the current date.
+	Effective string `json:"effective" mapstructure:"effective"`
+	// Description of the task. Left unchanged if not given.
+	Description *string `json:"description" mapstructure:"description"`
+	// Reference is an external ticket reference or URL. Left unchanged if not
+	// given.
+	Reference *string `json:"reference" mapstructure:"reference"`
+	// Billable flag of the task. Left unchanged if not given.
+	Billable *bool `json:"billable" mapstructure:"billable"`
+}
+
+// ReqPayloadSetTaskTags defines data fields required for replacing the tags of
+// a task
+type ReqPayloadSetTaskTags struct {
+	// GroupID of the target task. Required.
+	GroupID int `json:"groupid" mapstructure:"groupid"`
+	// TaskID of the target task. Required.
+	TaskID int `json:"taskid" mapstructure:"id"`
+	// Tags of the task. Empty removes all tags.
+	Tags []string `json:"tags" mapstructure:"tags"`
+}
+
+// ReqPayloadArchiveTask defines data fields required to archive or restore a
+// task
+type ReqPayloadArchiveTask struct {
+	// GroupID of the target task. Required.
+	GroupID int `json:"groupid" mapstructure:"groupid"`
+	// TaskID of the target task. Required.
+	TaskID int `json:"taskid" mapstructure:"id"`
+}
+
+// ReqPayloadDeleteTask defines data fields required to delete a task
+type ReqPayloadDeleteTask struct {
+	// GroupID of the target task. Required.
+	GroupID int `json:"groupid" mapstructure:"groupid"`
+	// TaskID of the target task. Required.
+	TaskID int `json:"taskid" mapstructure:"id"`
 }
 
 // ReqPayloadGetUsage defines fields for requesting usage statistics for a group
@@ -76,3 +167,87 @@ type ReqPayloadGetUsage struct {
 	// EndDate is the end date. Required.
 	EndDate string `json:"end" mapstructure:"end"`
 }
+
+// ReqPayloadGetTagUsage defines fields for requesting usage statistics for a
+// group by tag
+type ReqPayloadGetTagUsage struct {
+	// GroupID of the target group. Required.
+	GroupID int `json:"groupid" mapstructure:"groupid"`
+	// StartDate is the starting date. Required.
+	StartDate string `json:"start" mapstructure:"start"`
+	// EndDate is the end date. Required.
+	EndDate string `json:"end" mapstructure:"end"`
+	// Include selects tasks with any of the tags.
+	Include []string `json:"include" mapstructure:"include"`
+	// Exclude leaves out tasks with any of the tags.
+	Exclude []string `json:"exclude" mapstructure:"exclude"`
+}
+
+// ReqPayloadExportCSV defines fields for writing a usage report or the slices
+// of a group to a CSV file
+type ReqPayloadExportCSV struct {
+	// GroupID of the target group. Required.
+	GroupID int `json:"groupid" mapstructure:"groupid"`
+	// Type is either "report" or "slices". Required.
+	Type string `json:"type" mapstructure:"type"`
+	// StartDate is the starting date. Required.
+	StartDate string `json:"start" mapstructure:"start"`
+	// EndDate is the end date. Required.
+	EndDate string `json:"end" mapstructure:"end"`
+	// Path of the file to write. Required.
+	Path string `json:"path" mapstructure:"path"`
+	// Delimiter separates the fields. Defaults to a comma.
+	Delimiter string `json:"delimiter" mapstructure:"delimiter"`
+	// TimeFormat is the Go time layout of slice times. Defaults to RFC 3339.
+	TimeFormat string `json:"timefmt" mapstructure:"timefmt"`
+	// DurationFormat is "decimal", "clock" or "minutes". Defaults to decimal
+	// hours.
+	DurationFormat string `json:"durfmt" mapstructure:"durfmt"`
+}
+
+// ReqPayloadGetAudit defines fields for reading the audit log. Empty fields
+// don't limit the entries.
+type ReqPayloadGetAudit struct {
+	// GroupID limits entries to a group.
+	GroupID int `json:"groupid" mapstructure:"groupid"`
+	// TaskID limits entries to a task.
+	TaskID int `json:"taskid" mapstructure:"taskid"`
+	// StartDate is the first date to include.
+	StartDate string `json:"start" mapstructure:"start"`
+	// EndDate is the last date to include.
+	EndDate string `json:"end" mapstructure:"end"`
+}
+
+// ReqPayloadResolveGap defines fields for resolving a gap in timer heartbeats
+type ReqPayloadResolveGap struct {
+	// Action is one of "end", "keep" or "split". Required.
+	Action string `json:"action" mapstructure:"action"`
+	// LastSeen identifies the offered gap, in RFC 3339 format. Defaults to the
+	// last gap alerted.
+	LastSeen string `json:"lastseen" mapstructure:"lastseen"`
+}
+
+// ReqPayloadGetCostCodes defines data fields available when reading cost codes
+type ReqPayloadGetCostCodes struct {
+	// Inactive includes inactive codes when true.
+	Inactive bool `json:"inactive" mapstructure:"inactive"`
+}
+
+// ReqPayloadSaveCostCode defines data fields required to add or update a cost
+// code
+type ReqPayloadSaveCostCode struct {
+	// Code is the cost code. Required.
+	Code string `json:"code" mapstructure:"code"`
+	// Description of the code.
+	Description string `json:"description" mapstructure:"description"`
+	// Active codes can be set on tasks.
+	Active bool `json:"active" mapstructure:"active"`
+}
+
+// ReqPayloadRenameCostCode defines data fields required to rename a cost code
+type ReqPayloadRenameCostCode struct {
+	// Code is the current cost code. Required.
+	Code string `json:"code" mapstructure:"code"`
+	// NewCode is the new cost code. Required.
+	NewCode string `json:"newcode" mapstructure:"newcode"`
+}
@@ -0,0 +1,26 @@
+package stopwatchapp
+
+// Alert kinds
+const (
+	AlertSlicesCapped = "slices.capped"
+	AlertTimerGap     = "timer.gap"
+)
+
+// AlertInfo describes something the user should be notified about
+type AlertInfo struct {
+	// Kind tells what the alert is about
+	Kind string `json:"kind"`
+	// Text is a human readable description of the alert
+	Text string `json:"text"`
+	// Data contains details of the alert, depending on kind
+	Data interface{} `json:"data,omitempty"`
+}
+
+// NewAlertInfo generates an new alert message of given kind
+func NewAlertInfo(kind, text string, data interface{}) *Message {
+	return NewAlert(&AlertInfo{
+		Kind: kind,
+		Text: text,
+		Data: data,
+	})
+}
@@ -11,19 +11,38 @@ const (
 // Request keys
 const (
 	RequestActiveTask     = Key("get.active.task")
+	RequestActiveTasks    = Key("get.active.tasks")
 	RequestAppVersions    = Key("get.versions")
+	RequestMoveGroup      = Key("move.group")
 	RequestOpenDatabase   = Key("open.database")
+	RequestRedo           = Key("redo")
+	RequestRenameCostCode = Key("rename.costcode")
+	RequestResolveGap     = Key("resolve.gap")
+	RequestSaveCostCode   = Key("save.costcode")
 	RequestAddTask        = Key("add.task")
 	RequestAddGroup       = Key("add.group")
+	RequestArchiveGroup   = Key("archive.group")
+	RequestArchiveTask    = Key("archive.task")
+	RequestDeleteGroup    = Key("delete.group")
+	RequestDeleteTask     = Key("delete.task")
+	RequestExportCSV      = Key("export.csv")
+	RequestGetAudit       = Key("get.audit")
+	RequestGetCostCodes   = Key("get.costcodes")
 	RequestGetHistory     = Key("get.history")
+	RequestGetTagUsage    = Key("get.tag.usage")
 	RequestGetTask        = Key("get.task")
 	RequestGetUsage       = Key("get.usage")
 	RequestGroups         = Key("get.groups")
 	RequestGroupTasks     = Key("get.group.tasks")
 	RequestSetHistory     = Key("set.history")
+	RequestSetSliceNote   = Key("set.slice.note")
+	RequestSetTaskTags    = Key("set.task.tags")
 	RequestStartTask      = Key("start.task")
 	RequestStopTask       = Key("stop.task")
 	RequestTaskSlices     = Key("get.task.slices")
+	RequestUndo           = Key("undo")
+	RequestUnarchiveGroup = Key("unarchive.group")
+	RequestUnarchiveTask  = Key("unarchive.task")
 	RequestUpdateGroup    = Key("update.group")
 	RequestUpdateTask     = Key("update.task")
 	RequestWindowClose    = Key("window.close")
@@ -0,0 +1,227 @@
+package stopwatchdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// BucketAudit holds the audit log. Entries are keyed by the time of the change
+// followed by a sequence number, so they are ordered by time.
+const BucketAudit = "audit"
+
+// Sources of changes recorded in the audit log.
+const (
+	SourceGUI    = "gui"
+	SourceDumper = "dumper"
+	SourceImport = "import"
+)
+
+// Operations recorded in the audit log and the undo history. Heartbeats are
+// bookkeeping and are not recorded.
+const (
+	AuditAddGroup        = "add.group"
+	AuditAddTask         = "add.task"
+	AuditSaveGroup       = "save.group"
+	AuditSaveTask        = "save.task"
+	AuditArchiveGroup    = "archive.group"
+	AuditArchiveTask     = "archive.task"
+	AuditDeleteGroup     = "delete.group"
+	AuditDeleteTask      = "delete.task"
+	AuditStartTask       = "start.task"
+	AuditStopTask        = "stop.task"
+	AuditSwitchTask      = "switch.task"
+	AuditCapTask         = "cap.task"
+	AuditSetActive       = "set.active"
+	AuditSaveHistory     = "save.history"
+	AuditSetSlice        = "set.slice"
+	AuditRemoveSlice     = "remove.slice"
+	AuditSetSliceNote    = "set.slice.note"
+	AuditRepair          = "repair"
+	AuditMigrate         = "migrate"
+	AuditResolveGap      = "resolve.gap"
+	AuditUndo            = "undo"
+	AuditRedo            = "redo"
+	AuditImport          = "import"
+	AuditSetTags         = "set.tags"
+	AuditMoveGroup       = "move.group"
+	AuditSaveCostCode    = "save.costcode"
+	AuditRenameCostCode  = "rename.costcode"
+	AuditSetCostCode     = "set.costcode"
+	AuditImportCostCodes = "import.costcodes"
+	AuditImportSlices    = "import.slices"
+)
+
+// AuditEntry describes a single change to the database. Before and After hold
+// the changed value as JSON, and are empty when the value didn't exist.
+type AuditEntry struct {
+	Time    time.Time       `json:"time"`
+	Op      string          `json:"op"`
+	Source  string          `json:"source"`
+	GroupID int             `json:"groupid,omitempty"`
+	TaskID  int             `json:"taskid,omitempty"`
+	Before  json.RawMessage `json:"before,omitempty"`
+	After   json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditFilter selects audit entries. Zero values match everything. End is
+// exclusive.
+type AuditFilter struct {
+	Start   time.Time
+	End     time.Time
+	GroupID int
+	TaskID  int
+}
+
+// Match returns if the entry is selected by the filter.
+func (f AuditFilter) Match(e AuditEntry) bool {
+	if !f.Start.IsZero() && e.Time.Before(f.Start) {
+		return false
+	}
+	if !f.End.IsZero() && !e.Time.Before(f.End) {
+		return false
+	}
+	if f.GroupID != 0 && e.GroupID != f.GroupID {
+		return false
+	}
+	if f.TaskID != 0 && e.TaskID != f.TaskID {
+		return false
+	}
+	return true
+}
+
+// SetSource sets the source recorded for changes made through this handle,
+// eg. SourceGUI.
+func (db *StopwatchDB) SetSource(source string) {
+	db.source = source
+}
+
+// ReadAudit returns the audit entries matching the filter, oldest first.
+func (db *StopwatchDB) ReadAudit(filter AuditFilter) ([]AuditEntry, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	res := []AuditEntry{}
+	err := db.db.View(func(tx kvTx) error {
+		c := tx.Bucket([]byte(BucketAudit)).Cursor()
+
+		k, v := c.First()
+		if !filter.Start.IsZero() {
+			k, v = c.Seek(auditKey(filter.Start, 0))
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			var e AuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+
+			if !filter.End.IsZero() && !e.Time.Before(filter.End) {
+				break
+			}
+
+			if filter.Match(e) {
+				res = append(res, e)
+			}
+		}
+
+		return nil
+	})
+
+	return res, err
+}
+
+// audit appends an entry to the audit log within a transaction. Nil before or
+// after values are left empty.
+func (db *StopwatchDB) audit(tx kvTx, op string, group, task int, before, after interface{}) error {
+	return db.auditAs(tx, db.source, op, group, task, before, after)
+}
+
+// auditAs appends an entry to the audit log with the given source.
+func (db *StopwatchDB) auditAs(tx kvTx, source, op string, group, task int, before, after interface{}) error {
+	b := tx.Bucket([]byte(BucketAudit))
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	e := AuditEntry{
+		Time:    time.Now().UTC(),
+		Op:      op,
+		Source:  source,
+		GroupID: group,
+		TaskID:  task,
+	}
+
+	if e.Before, err = auditValue(before); err != nil {
+		return err
+	}
+	if e.After, err = auditValue(after); err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(auditKey(e.Time, seq), buf)
+}
+
+// auditValue encodes v as JSON. Nil values, including nil pointers and empty
+// raw values, are returned as empty.
+func auditValue(v interface{}) (json.RawMessage, error) {
+	if raw, ok := v.(json.RawMessage); v == nil || ok && len(raw) == 0 {
+		return nil, nil
+	}
+
+	buf, err := json.Marshal(v)
+	if err != nil || bytes.Equal(buf, []byte("null")) {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// deletedTask is the audit value of a deleted task, including its slices.
+type deletedTask struct {
+	Task   json.RawMessage `json:"task"`
+	Slices []Slice         `json:"slices"`
+}
+
+// readDeletedTask reads a task and its slices for the audit log before they
+// are deleted.
+func readDeletedTask(tx kvTx, group, task int) (*deletedTask, error) {
+	d := &deletedTask{Slices: []Slice{}}
+
+	if bt := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(group)); bt != nil {
+		d.Task = append(json.RawMessage{}, bt.Get(Itob(task))...)
+	}
+
+	bs := tx.Bucket([]byte(BucketSlices)).Bucket(sliceBucketID(group, task))
+	if bs == nil {
+		return d, nil
+	}
+
+	err := bs.ForEach(func(k, v []byte) error {
+		start, r, err := decodeSliceEntry(k, v)
+		if err != nil {
+			return err
+		}
+		d.Slices = append(d.Slices, sliceFromRecord(start, r))
+		return nil
+	})
+
+	return d, err
+}
+
+// auditKey returns the audit bucket key for an entry at t with given sequence.
+func auditKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
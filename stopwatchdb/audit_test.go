@@ -0,0 +1,86 @@
+package stopwatchdb
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+func TestAudit(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		db.SetSource(SourceDumper)
+
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		b, _ := db.AddTask(g.ID, "b", "code")
+
+		start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+		db.SetSlice(g.ID, a.ID, start, start.Add(2*time.Hour))
+
+		a, _ = db.GetTask(g.ID, a.ID)
+		a.Name = "renamed"
+		db.SaveTask(a)
+
+		// Failed changes are not recorded.
+		if _, err := db.SetSlice(g.ID, 99, start, start.Add(time.Hour)); err == nil {
+			t.Fatalf("Expected error for missing task")
+		}
+
+		entries, err := db.ReadAudit(AuditFilter{TaskID: a.ID})
+		if err != nil {
+			t.Fatalf("Unable to read audit log: %s", err)
+		}
+
+		ops := []string{AuditAddTask, AuditSetSlice, AuditSetSlice, AuditSaveTask}
+		if len(entries) != len(ops) {
+			t.Fatalf("Expected %d entries, got %+v", len(ops), entries)
+		}
+		for i, e := range entries {
+			if e.Op != ops[i] || e.Source != SourceDumper || e.GroupID != g.ID {
+				t.Errorf("Wrong entry %d: %+v", i, e)
+			}
+		}
+
+		var before, after Slice
+		json.Unmarshal(entries[2].Before, &before)
+		json.Unmarshal(entries[2].After, &after)
+		if before.End.Sub(before.Start) != time.Hour || after.End.Sub(after.Start) != 2*time.Hour {
+			t.Errorf("Wrong slice edit recorded: %s -> %s", entries[2].Before, entries[2].After)
+		}
+
+		var old model.Task
+		json.Unmarshal(entries[3].Before, &old)
+		if old.Name != "a" {
+			t.Errorf("Previous name not recorded: %s", entries[3].Before)
+		}
+
+		// Deleting a task records its slices.
+		db.DeleteGroup(g.ID)
+		if entries, _ = db.ReadAudit(AuditFilter{TaskID: a.ID}); entries[len(entries)-1].Op != AuditDeleteTask {
+			t.Fatalf("Task deletion not recorded: %+v", entries)
+		}
+		var deleted deletedTask
+		json.Unmarshal(entries[len(entries)-1].Before, &deleted)
+		if len(deleted.Slices) != 1 {
+			t.Errorf("Deleted slices not recorded: %s", entries[len(entries)-1].Before)
+		}
+
+		if entries, _ = db.ReadAudit(AuditFilter{TaskID: b.ID}); len(entries) != 2 {
+			t.Errorf("Expected add and delete for b, got %+v", entries)
+		}
+
+		// Time range
+		if entries, _ = db.ReadAudit(AuditFilter{Start: time.Now().Add(time.Hour)}); len(entries) != 0 {
+			t.Errorf("Expected no entries in the future, got %+v", entries)
+		}
+		if entries, _ = db.ReadAudit(AuditFilter{End: time.Now().Add(-time.Hour)}); len(entries) != 0 {
+			t.Errorf("Expected no entries in the past, got %+v", entries)
+		}
+		if entries, _ = db.ReadAudit(AuditFilter{Start: time.Now().Add(-time.Hour)}); len(entries) != 9 {
+			t.Errorf("Expected all entries, got %d", len(entries))
+		}
+	})
+}
@@ -0,0 +1,394 @@
+package stopwatchdb
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reasons for taking a snapshot, used in snapshot file names.
+const (
+	BackupOpen    = "open"
+	BackupDaily   = "daily"
+	BackupMigrate = "migrate"
+	BackupManual  = "manual"
+	BackupRestore = "restore"
+)
+
+// backupTimeFmt is the time layout of snapshot file names.
+const backupTimeFmt = "20060102T150405.000Z"
+
+// defaultBackupRetention is the number of snapshots kept by default.
+const defaultBackupRetention = 14
+
+// Snapshot describes a backup of the database.
+type Snapshot struct {
+	Path   string
+	Time   time.Time
+	Reason string
+	Size   int64
+}
+
+// SetBackupDir sets the directory snapshots are written to. Defaults to a
+// "backups" directory next to the database file.
+func (db *StopwatchDB) SetBackupDir(dir string) {
+	db.backupDir = dir
+}
+
+// SetBackupRetention sets the number of snapshots kept for each reason, so
+// frequent snapshots don't rotate out the ones taken before migrations and
+// restores. Older snapshots are removed when a new one is taken. Zero keeps
+// all. Defaults to 14.
+func (db *StopwatchDB) SetBackupRetention(n int) {
+	db.backupKeep = n
+}
+
+// SetAutoBackup enables or disables taking snapshots when the database is
+// opened and daily with AutoBackup. Snapshots are always taken before
+// migrations. Disabled by default.
+func (db *StopwatchDB) SetAutoBackup(enabled bool) {
+	db.autoBackup = enabled
+}
+
+// BackupDir returns the directory snapshots are written to.
+func (db *StopwatchDB) BackupDir() string {
+	if db.path == "" {
+		return db.backupDir
+	}
+
+	return backupDir(db.path, db.backupDir)
+}
+
+// backupDir returns dir, or the default backup directory of a database file if
+// it is empty.
+func backupDir(path, dir string) string {
+	if dir != "" {
+		return dir
+	}
+
+	return filepath.Join(filepath.Dir(path), "backups")
+}
+
+// Backup writes a consistent snapshot of the database using a read
+// transaction, so it can be taken while the database is in use. Old snapshots
+// are rotated out afterwards.
+func (db *StopwatchDB) Backup(reason string) (*Snapshot, error) {
+	db.backupMu.Lock()
+	defer db.backupMu.Unlock()
+
+	return db.backup(reason)
+}
+
+// backup takes a snapshot. Caller holds backupMu.
+func (db *StopwatchDB) backup(reason string) (*Snapshot, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	dir := db.BackupDir()
+	if dir == "" {
+		return nil, errors.New("no backup directory")
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	s := &Snapshot{
+		Path:   snapshotPath(dir, db.backupBase(), now, reason),
+		Time:   now,
+		Reason: reason,
+	}
+
+	// Write to a temporary file first, so an interrupted backup isn't mistaken
+	// for a snapshot.
+	tmp := s.Path + ".tmp"
+	if err := db.db.View(func(tx kvTx) error {
+		return tx.CopyFile(tmp, 0600)
+	}); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, s.Path); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	if st, err := os.Stat(s.Path); err == nil {
+		s.Size = st.Size()
+	}
+
+	db.lastBackup = now
+	log.Printf("database backed up to %s", s.Path)
+
+	return s, db.rotateBackups()
+}
+
+// AutoBackup takes a daily snapshot if automatic backups are enabled and the
+// latest snapshot is more than a day old. Returns nil if no snapshot was due.
+func (db *StopwatchDB) AutoBackup() (*Snapshot, error) {
+	if !db.autoBackup {
+		return nil, nil
+	}
+
+	// Runs from the timer goroutine, so guard against a concurrent backup.
+	db.backupMu.Lock()
+	defer db.backupMu.Unlock()
+
+	if db.lastBackup.IsZero() {
+		if snaps, err := db.Backups(); err == nil && len(snaps) > 0 {
+			db.lastBackup = snaps[0].Time
+		}
+	}
+
+	if time.Since(db.lastBackup) < 24*time.Hour {
+		return nil, nil
+	}
+
+	return db.backup(BackupDaily)
+}
+
+// Backups returns the snapshots in the backup directory, newest first.
+func (db *StopwatchDB) Backups() ([]Snapshot, error) {
+	return listBackups(db.BackupDir(), db.backupBase())
+}
+
+// ListBackups returns the snapshots of a database file, newest first, without
+// opening the database. Snapshots are looked up in dir, or in the default
+// backup directory if it is empty.
+func ListBackups(path, dir string) ([]Snapshot, error) {
+	return listBackups(backupDir(path, dir), fileBase(path))
+}
+
+// listBackups returns the snapshots with given base name in dir, newest first.
+func listBackups(dir, base string) ([]Snapshot, error) {
+	res := []Snapshot{}
+
+	if dir == "" {
+		return res, nil
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	prefix := base + "-"
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".dat") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".dat"), "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		t, err := time.Parse(backupTimeFmt, parts[0])
+		if err != nil {
+			continue
+		}
+
+		res = append(res, Snapshot{
+			Path:   filepath.Join(dir, name),
+			Time:   t,
+			Reason: parts[1],
+			Size:   f.Size(),
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Time.After(res[j].Time) })
+
+	return res, nil
+}
+
+// Restore replaces the database with a snapshot. The snapshot is checked
+// before use, and the current database is backed up first. With force, a
+// snapshot with problems found by Check is restored anyway, so it can be
+// repaired. The database is reopened from the restored file, running
+// migrations if needed.
+func (db *StopwatchDB) Restore(snapshot string, force bool) error {
+	if db.IsOpen() == false {
+		return errors.New("database not ready")
+	}
+
+	if db.memory {
+		return errors.New("restore is not supported for in-memory databases")
+	}
+
+	tmp, err := prepareSnapshot(db.path, snapshot, force)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if _, err := db.Backup(BackupRestore); err != nil {
+		return fmt.Errorf("backup before restore failed: %s", err)
+	}
+
+	path := db.path
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		db.Open(path)
+		return err
+	}
+
+	return db.Open(path)
+}
+
+// RestoreFile replaces a database file with a snapshot without opening the
+// database, so that a file that can't be opened any more can be restored. The
+// snapshot is given as a path, or as a file name in the backup directory dir,
+// or the default backup directory if dir is empty. It is checked like with
+// Restore. The current file, if any, is copied aside as a snapshot first. The
+// restored file is migrated when it is next opened. Returns the path of the
+// restored snapshot.
+func RestoreFile(path, snapshot, dir string, force bool) (string, error) {
+	dir = backupDir(path, dir)
+	if _, err := os.Stat(snapshot); err != nil {
+		snapshot = filepath.Join(dir, snapshot)
+	}
+
+	tmp, err := prepareSnapshot(path, snapshot, force)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	if _, err = os.Stat(path); err == nil {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+
+		aside := snapshotPath(dir, fileBase(path), time.Now().UTC(), BackupRestore)
+		if err = copyFile(path, aside); err != nil {
+			return "", fmt.Errorf("backup before restore failed: %s", err)
+		}
+		log.Printf("database copied to %s", aside)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+
+	return snapshot, nil
+}
+
+// prepareSnapshot copies a snapshot next to the database file at path, so the
+// snapshot itself stays intact, and checks the copy. Returns the path of the
+// copy.
+func prepareSnapshot(path, snapshot string, force bool) (string, error) {
+	tmp := path + ".restore"
+	if err := copyFile(snapshot, tmp); err != nil {
+		return "", fmt.Errorf("unable to copy snapshot: %s", err)
+	}
+
+	if err := checkSnapshot(tmp, force); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("snapshot is not usable: %s", err)
+	}
+
+	return tmp, nil
+}
+
+// checkSnapshot opens a database file, migrates it and checks it for problems.
+// With force, problems are only logged.
+func checkSnapshot(path string, force bool) error {
+	s := New()
+	s.SetAutoMigrate(false)
+	if err := s.Open(path); err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Older snapshots are checked against the current schema.
+	if _, err := s.migrate(false); err != nil {
+		return err
+	}
+
+	rep, err := s.Check()
+	if err != nil {
+		return err
+	}
+
+	if len(rep.Problems) > 0 && force {
+		log.Printf("restoring snapshot with %d problem(s), first: %s", len(rep.Problems), rep.Problems[0].Detail)
+	} else if len(rep.Problems) > 0 {
+		return fmt.Errorf("%d problem(s) found, first: %s", len(rep.Problems), rep.Problems[0].Detail)
+	}
+
+	return nil
+}
+
+// rotateBackups removes the oldest snapshots of each reason beyond the
+// retention.
+func (db *StopwatchDB) rotateBackups() error {
+	if db.backupKeep <= 0 {
+		return nil
+	}
+
+	snaps, err := db.Backups()
+	if err != nil {
+		return err
+	}
+
+	kept := map[string]int{}
+	for _, s := range snaps {
+		if kept[s.Reason] < db.backupKeep {
+			kept[s.Reason]++
+			continue
+		}
+		if err = os.Remove(s.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backupBase returns the database file name without extension, used as the
+// prefix of snapshot names.
+func (db *StopwatchDB) backupBase() string {
+	if db.path == "" {
+		return "memory"
+	}
+
+	return fileBase(db.path)
+}
+
+// fileBase returns a file name without directory and extension.
+func fileBase(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// snapshotPath returns the path of a snapshot taken at given time.
+func snapshotPath(dir, base string, at time.Time, reason string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s-%s.dat", base, at.Format(backupTimeFmt), reason))
+}
+
+// copyFile copies a file from src to dst, replacing dst.
+func copyFile(src, dst string) error {
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dst, buf, 0600)
+}
@@ -0,0 +1,203 @@
+package stopwatchdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stopwatchdb")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := New()
+	db.SetAutoBackup(true)
+	db.SetBackupRetention(2)
+	if err = db.Open(filepath.Join(dir, "data.dat")); err != nil {
+		t.Fatalf("Unable to open database: %s", err)
+	}
+	defer db.Close()
+
+	g, _ := db.AddGroup("group")
+	snap, err := db.Backup(BackupManual)
+	if err != nil {
+		t.Fatalf("Unable to back up: %s", err)
+	}
+	if snap.Size == 0 || filepath.Dir(snap.Path) != filepath.Join(dir, "backups") {
+		t.Errorf("Unexpected snapshot: %+v", snap)
+	}
+
+	// A recent snapshot exists, so no daily one is due.
+	if s, err := db.AutoBackup(); s != nil || err != nil {
+		t.Errorf("Unexpected daily snapshot: %+v, %v", s, err)
+	}
+
+	db.AddTask(g.ID, "task", "code")
+	db.DeleteGroup(g.ID)
+
+	// Broken snapshots are refused.
+	broken := filepath.Join(dir, "broken.dat")
+	ioutil.WriteFile(broken, []byte("garbage"), 0600)
+	if err = db.Restore(broken, true); err == nil {
+		t.Errorf("Restored a broken snapshot")
+	}
+
+	if err = db.Restore(snap.Path, false); err != nil {
+		t.Fatalf("Unable to restore: %s", err)
+	}
+
+	if groups, _ := db.ReadGroups(true); len(groups) != 1 || groups[0].ID != g.ID {
+		t.Errorf("Group not restored: %+v", groups)
+	}
+
+	// Snapshots were taken on open, manually, before restore and on reopen.
+	snaps, err := db.Backups()
+	if err != nil || len(snaps) != 4 {
+		t.Fatalf("Expected 4 snapshots, got %+v, %v", snaps, err)
+	}
+
+	// Manual snapshots rotate out older manual ones only, so the snapshot taken
+	// before the restore is kept.
+	for i := 0; i < 3; i++ {
+		if _, err = db.Backup(BackupManual); err != nil {
+			t.Fatalf("Unable to back up: %s", err)
+		}
+	}
+
+	reasons := map[string]int{}
+	snaps, _ = db.Backups()
+	for _, s := range snaps {
+		reasons[s.Reason]++
+	}
+	if reasons[BackupOpen] != 2 || reasons[BackupManual] != 2 || reasons[BackupRestore] != 1 {
+		t.Errorf("Wrong snapshots kept: %+v", snaps)
+	}
+}
+
+func TestAutoBackupConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stopwatchdb")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := New()
+	db.SetAutoBackup(true)
+	if err = db.Open(filepath.Join(dir, "data.dat")); err != nil {
+		t.Fatalf("Unable to open database: %s", err)
+	}
+	defer db.Close()
+
+	// Timer ticks run daily backups while the GUI takes manual ones.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			if _, err := db.AutoBackup(); err != nil {
+				t.Errorf("Unable to auto backup: %s", err)
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if _, err := db.Backup(BackupManual); err != nil {
+			t.Errorf("Unable to back up: %s", err)
+		}
+	}
+	<-done
+}
+
+func TestRestoreForce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stopwatchdb")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := New()
+	if err = db.Open(filepath.Join(dir, "data.dat")); err != nil {
+		t.Fatalf("Unable to open database: %s", err)
+	}
+	defer db.Close()
+
+	// A snapshot with a group under a missing parent.
+	snap := filepath.Join(dir, "snapshot.dat")
+	s := New()
+	if err = s.Open(snap); err != nil {
+		t.Fatalf("Unable to open snapshot: %s", err)
+	}
+	g, _ := s.AddGroup("group")
+	g.ParentID = 100
+	s.db.Update(func(tx kvTx) error { return putGroup(tx, g) })
+	s.Close()
+
+	if err = db.Restore(snap, false); err == nil {
+		t.Fatalf("Restored a snapshot with problems")
+	}
+
+	if err = db.Restore(snap, true); err != nil {
+		t.Fatalf("Unable to force restore: %s", err)
+	}
+	if groups, _ := db.ReadGroups(true); len(groups) != 1 || groups[0].ParentID != 100 {
+		t.Errorf("Snapshot not restored: %+v", groups)
+	}
+}
+
+func TestRestoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stopwatchdb")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data.dat")
+	db := New()
+	if err = db.Open(path); err != nil {
+		t.Fatalf("Unable to open database: %s", err)
+	}
+	db.AddGroup("group")
+	snap, err := db.Backup(BackupManual)
+	if err != nil {
+		t.Fatalf("Unable to back up: %s", err)
+	}
+	db.Close()
+
+	// A file the database can't be opened from.
+	if err = ioutil.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("Unable to write file: %s", err)
+	}
+
+	if _, err = RestoreFile(path, "missing.dat", "", false); err == nil {
+		t.Fatalf("Restored a missing snapshot")
+	}
+
+	restored, err := RestoreFile(path, filepath.Base(snap.Path), "", false)
+	if err != nil {
+		t.Fatalf("Unable to restore: %s", err)
+	}
+	if restored != snap.Path {
+		t.Errorf("Restored %s, expected %s", restored, snap.Path)
+	}
+
+	snaps, err := ListBackups(path, "")
+	if err != nil {
+		t.Fatalf("Unable to list backups: %s", err)
+	}
+	if len(snaps) != 2 || snaps[0].Reason != BackupRestore {
+		t.Fatalf("Broken file not copied aside: %+v", snaps)
+	}
+	if buf, _ := ioutil.ReadFile(snaps[0].Path); string(buf) != "garbage" {
+		t.Errorf("Broken file not preserved: %q", buf)
+	}
+
+	if err = db.Open(path); err != nil {
+		t.Fatalf("Unable to open restored database: %s", err)
+	}
+	defer db.Close()
+	if groups, _ := db.ReadGroups(true); len(groups) != 1 {
+		t.Errorf("Snapshot not restored: %+v", groups)
+	}
+}
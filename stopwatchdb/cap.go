@@ -0,0 +1,140 @@
+package stopwatchdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CappedSlice describes a running slice that was ended by CapForgotten
+type CappedSlice struct {
+	// GroupID of the task
+	GroupID int
+	// TaskID of the task
+	TaskID int
+	// Name of the task
+	Name string
+	// Start of the slice
+	Start time.Time
+	// End is where the slice was capped
+	End time.Time
+}
+
+// SetMaxDuration sets how long a slice may run before CapForgotten ends it.
+// Zero disables the limit.
+func (db *StopwatchDB) SetMaxDuration(d time.Duration) {
+	db.maxDuration = d
+}
+
+// SetDayEnd sets the end of the working day as time since midnight. Slices
+// still running on the next day are ended at the end of the day they started
+// on by CapForgotten. Zero disables the limit.
+func (db *StopwatchDB) SetDayEnd(d time.Duration) {
+	db.dayEnd = d
+}
+
+// ParseTimeOfDay parses a "15:04" formatted time of day into time since
+// midnight.
+func ParseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// CapForgotten ends running slices that have exceeded the maximum duration or
+// the end of the working day. Capped slices are flagged for review and their
+// tasks are no longer active. Returns the capped slices.
+func (db *StopwatchDB) CapForgotten() ([]CappedSlice, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	capped := []CappedSlice{}
+	if db.maxDuration == 0 && db.dayEnd == 0 {
+		return capped, nil
+	}
+
+	now := time.Now().UTC()
+	err := db.db.Update(func(tx kvTx) error {
+		active, err := getActiveTasks(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, at := range active {
+			t, err := getTask(tx, at.GroupID, at.TaskID)
+			if err != nil || t.Running == nil {
+				continue
+			}
+
+			end, ok := db.capAt(*t.Running, now)
+			if !ok {
+				continue
+			}
+
+			stopped, err := stopTask(tx, t.GroupID, t.ID, end, db.Location(), sliceFlagReview, "")
+			if err != nil {
+				return fmt.Errorf("unable to cap task %d:%s: %s", t.ID, t.Name, err)
+			}
+
+			if err = db.audit(tx, AuditCapTask, t.GroupID, t.ID, t, stopped); err != nil {
+				return err
+			}
+
+			match := func(g, id int) bool { return g == t.GroupID && id == t.ID }
+			if err = clearActiveTask(tx, match); err != nil {
+				return err
+			}
+
+			capped = append(capped, CappedSlice{
+				GroupID: t.GroupID,
+				TaskID:  t.ID,
+				Name:    t.Name,
+				Start:   *t.Running,
+				End:     end,
+			})
+		}
+
+		return nil
+	})
+
+	return capped, err
+}
+
+// capAt returns the time a slice started at start should be capped at, if the
+// slice is still running at now.
+func (db *StopwatchDB) capAt(start, now time.Time) (time.Time, bool) {
+	end := now
+
+	if db.maxDuration > 0 && now.Sub(start) > db.maxDuration {
+		end = start.Add(db.maxDuration)
+	}
+
+	if db.dayEnd > 0 {
+		loc := db.Location()
+		s := start.In(loc)
+		dayEnd := time.Date(s.Year(), s.Month(), s.Day(), 0, 0, 0, 0, loc).Add(db.dayEnd)
+
+		// Only cap at the end of day once the day is over. Slices started after
+		// the end of day are capped at midnight.
+		if next := nextDay(s, loc); !now.Before(next) {
+			if dayEnd.Before(start) {
+				dayEnd = next
+			}
+
+			if dayEnd.Before(end) {
+				end = dayEnd
+			}
+		}
+	}
+
+	return end.UTC(), end.Before(now)
+}
+
+// sliceFromRecord returns the public representation of a stored slice.
+func sliceFromRecord(start time.Time, r sliceRecord) Slice {
+	return Slice{Start: start, End: r.End, Review: r.Flags&sliceFlagReview != 0, Note: r.Note()}
+}
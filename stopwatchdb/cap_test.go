@@ -0,0 +1,87 @@
+package stopwatchdb
+
+import (
+	"testing"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+func TestCapAt(t *testing.T) {
+	db := New()
+	at := func(d, h int) time.Time {
+		return time.Date(2017, 12, d, h, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		max    time.Duration
+		dayEnd time.Duration
+		start  time.Time
+		now    time.Time
+		want   time.Time
+		capped bool
+	}{
+		{10 * time.Hour, 0, at(5, 8), at(5, 17), at(5, 17), false},
+		{10 * time.Hour, 0, at(5, 8), at(6, 9), at(5, 18), true},
+		// End of day applies only once the day is over.
+		{0, 17 * time.Hour, at(5, 8), at(5, 20), at(5, 20), false},
+		{0, 17 * time.Hour, at(5, 8), at(6, 9), at(5, 17), true},
+		{0, 17 * time.Hour, at(5, 20), at(6, 9), at(6, 0), true},
+		// The earlier limit wins.
+		{4 * time.Hour, 17 * time.Hour, at(5, 8), at(6, 9), at(5, 12), true},
+	}
+
+	for i, tc := range tests {
+		db.SetMaxDuration(tc.max)
+		db.SetDayEnd(tc.dayEnd)
+
+		end, capped := db.capAt(tc.start, tc.now)
+		if !end.Equal(tc.want) || capped != tc.capped {
+			t.Errorf("Case %d: capped at %s, %t (not %s, %t)", i, end, capped, tc.want, tc.capped)
+		}
+	}
+}
+
+func TestCapForgotten(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+	db.SetMaxDuration(10 * time.Hour)
+
+	g, _ := db.AddGroup("group")
+	task, _ := db.AddTask(g.ID, "task", "code")
+
+	// Task started over a day ago.
+	start := time.Now().UTC().Add(-30 * time.Hour)
+	if err := db.db.Update(func(tx kvTx) error {
+		if _, err := startTask(tx, g.ID, task.ID, start); err != nil {
+			return err
+		}
+		return putActiveTasks(tx, []model.ActiveTask{{GroupID: g.ID, TaskID: task.ID}})
+	}); err != nil {
+		t.Fatalf("Unable to start task: %s", err)
+	}
+
+	capped, err := db.CapForgotten()
+	if err != nil || len(capped) != 1 {
+		t.Fatalf("Expected one capped slice, got %+v, %v", capped, err)
+	}
+
+	if task, _ = db.GetTask(g.ID, task.ID); task.Running != nil || task.Used.Duration != 10*time.Hour {
+		t.Errorf("Task not stopped at cap: %+v", task)
+	}
+
+	if at, _ := db.GetActiveTask(); at != nil {
+		t.Errorf("Capped task still active: %+v", at)
+	}
+
+	res, err := db.GetSlices(g.ID, start, time.Now())
+	if err != nil || len(res) != 1 {
+		t.Fatalf("Unable to read slices: %+v, %v", res, err)
+	}
+
+	for _, s := range res[0].Slices {
+		if !s.Review {
+			t.Errorf("Capped slice not flagged for review: %+v", s)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package stopwatchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// Problem kinds reported by Check
+const (
+	// ProblemInvalidRecord is a group, task or slice that can't be parsed
+	ProblemInvalidRecord = "invalid-record"
+	// ProblemUsedMismatch is a task whose used time differs from its slices
+	ProblemUsedMismatch = "used-mismatch"
+	// ProblemOpenSlice is an open slice on a task that isn't active
+	ProblemOpenSlice = "open-slice"
+	// ProblemRunningState is a task whose running state differs from its slices
+	ProblemRunningState = "running-state"
+	// ProblemMissingSlices is a task without a slice bucket
+	ProblemMissingSlices = "missing-slices"
+	// ProblemOrphanSlices is a slice bucket without a task
+	ProblemOrphanSlices = "orphan-slices"
+	// ProblemInvalidParent is a group whose parent doesn't exist or is below it
+	ProblemInvalidParent = "invalid-parent"
+)
+
+// Problem describes a single inconsistency in the database
+type Problem struct {
+	// Kind of the problem
+	Kind string
+	// GroupID of the affected task, if known
+	GroupID int
+	// TaskID of the affected task, if known
+	TaskID int
+	// Detail describes the problem
+	Detail string
+	// Repaired tells if the problem was fixed
+	Repaired bool
+}
+
+// CheckReport lists the problems found in the database
+type CheckReport struct {
+	// Problems found
+	Problems []Problem
+}
+
+// Check verifies the database for inconsistencies between tasks and their
+// slices, without changing anything.
+func (db *StopwatchDB) Check() (*CheckReport, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	var rep *CheckReport
+	err := db.db.View(func(tx kvTx) error {
+		var err error
+		rep, err = check(tx, false)
+		return err
+	})
+
+	return rep, err
+}
+
+// Repair verifies the database like Check does and fixes the problems found
+// where possible. Records that can't be parsed are only reported, except for
+// slices, which are removed.
+func (db *StopwatchDB) Repair() (*CheckReport, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	var rep *CheckReport
+	err := db.db.Update(func(tx kvTx) error {
+		var err error
+		if rep, err = check(tx, true); err != nil || len(rep.Problems) == 0 {
+			return err
+		}
+
+		return db.audit(tx, AuditRepair, 0, 0, nil, rep.Problems)
+	})
+
+	return rep, err
+}
+
+// check goes through all groups, tasks and slices looking for problems. Fixes
+// them if repair is true.
+func check(tx kvTx, repair bool) (*CheckReport, error) {
+	rep := &CheckReport{Problems: []Problem{}}
+	report := func(p Problem) {
+		rep.Problems = append(rep.Problems, p)
+	}
+
+	groups := []*model.Group{}
+	if err := tx.Bucket([]byte(BucketGroups)).ForEach(func(k, v []byte) error {
+		var g model.Group
+		if err := json.Unmarshal(v, &g); err != nil {
+			report(Problem{Kind: ProblemInvalidRecord, GroupID: Btoi(k), Detail: fmt.Sprintf("group: %s", err)})
+			return nil
+		}
+		groups = append(groups, &g)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := checkParents(tx, groups, repair, report); err != nil {
+		return nil, err
+	}
+
+	active := map[string]bool{}
+	if list, err := getActiveTasks(tx); err != nil {
+		report(Problem{Kind: ProblemInvalidRecord, Detail: fmt.Sprintf("active tasks: %s", err)})
+	} else {
+		for _, at := range list {
+			active[string(sliceBucketID(at.GroupID, at.TaskID))] = true
+		}
+	}
+
+	// Go through tasks per group. Tasks are collected first, as they may be
+	// updated while repairing.
+	bs := tx.Bucket([]byte(BucketSlices))
+	known := map[string]bool{}
+	tasks := []*model.Task{}
+	bt := tx.Bucket([]byte(BucketTasks))
+	if err := bt.ForEach(func(gk, gv []byte) error {
+		if gv != nil {
+			return nil
+		}
+
+		return bt.Bucket(gk).ForEach(func(k, v []byte) error {
+			var t model.Task
+			if err := json.Unmarshal(v, &t); err != nil {
+				report(Problem{Kind: ProblemInvalidRecord, GroupID: Btoi(gk), TaskID: Btoi(k), Detail: fmt.Sprintf("task: %s", err)})
+				// Slices of the task aren't orphans, even if the task is unreadable.
+				known[string(sliceBucketID(Btoi(gk), Btoi(k)))] = true
+				return nil
+			}
+
+			known[string(sliceBucketID(t.GroupID, t.ID))] = true
+			tasks = append(tasks, &t)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, t := range tasks {
+		if err := checkTask(tx, t, active[string(sliceBucketID(t.GroupID, t.ID))], repair, report); err != nil {
+			return nil, err
+		}
+	}
+
+	// Slice buckets without tasks.
+	orphans := [][]byte{}
+	if err := bs.ForEach(func(k, v []byte) error {
+		if v == nil && !known[string(k)] {
+			orphans = append(orphans, append([]byte{}, k...))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, k := range orphans {
+		p := Problem{Kind: ProblemOrphanSlices, Detail: fmt.Sprintf("slice bucket %x has no task", k)}
+		if len(k) == 17 {
+			p.GroupID, p.TaskID = Btoi(k[:8]), Btoi(k[9:])
+		}
+
+		if repair {
+			if err := bs.DeleteBucket(k); err != nil {
+				return nil, err
+			}
+			p.Repaired = true
+		}
+
+		report(p)
+	}
+
+	return rep, nil
+}
+
+// checkParents checks that the parent of each group exists and isn't below
+// the group. Repair moves such groups to the top level.
+func checkParents(tx kvTx, groups []*model.Group, repair bool, report func(Problem)) error {
+	parents := map[int]int{}
+	for _, g := range groups {
+		parents[g.ID] = g.ParentID
+	}
+
+	for _, g := range groups {
+		if g.ParentID == 0 {
+			continue
+		}
+
+		detail := ""
+		if _, ok := parents[g.ParentID]; !ok {
+			detail = fmt.Sprintf("parent group %d not found", g.ParentID)
+		} else {
+			// Walk up the tree. Groups fixed earlier end a cycle at the top level.
+			seen := map[int]bool{g.ID: true}
+			for p := parents[g.ID]; p != 0; p = parents[p] {
+				if seen[p] {
+					detail = fmt.Sprintf("parent group %d is below the group", g.ParentID)
+					break
+				}
+				seen[p] = true
+			}
+		}
+
+		if detail == "" {
+			continue
+		}
+
+		p := Problem{Kind: ProblemInvalidParent, GroupID: g.ID, Detail: detail}
+		if repair {
+			g.ParentID = 0
+			if err := putGroup(tx, g); err != nil {
+				return err
+			}
+			p.Repaired = true
+		}
+		parents[g.ID] = 0
+		report(p)
+	}
+
+	return nil
+}
+
+// checkTask verifies the slices and state of a single task.
+func checkTask(tx kvTx, t *model.Task, active, repair bool, report func(Problem)) error {
+	problem := func(kind, detail string, args ...interface{}) Problem {
+		return Problem{Kind: kind, GroupID: t.GroupID, TaskID: t.ID, Detail: fmt.Sprintf(detail, args...), Repaired: repair}
+	}
+
+	bs := tx.Bucket([]byte(BucketSlices))
+	b := bs.Bucket(sliceBucketID(t.GroupID, t.ID))
+	if b == nil {
+		report(problem(ProblemMissingSlices, "task has no slice bucket"))
+		if !repair {
+			return nil
+		}
+
+		var err error
+		if b, err = bs.CreateBucket(sliceBucketID(t.GroupID, t.ID)); err != nil {
+			return err
+		}
+	}
+
+	var used time.Duration
+	var running *time.Time
+	remove := [][]byte{}
+
+	last, _ := b.Cursor().Last()
+	if err := b.ForEach(func(k, v []byte) error {
+		start, r, err := decodeSliceEntry(k, v)
+		if err != nil {
+			report(problem(ProblemInvalidRecord, "slice %x: %s", k, err))
+			remove = append(remove, append([]byte{}, k...))
+			return nil
+		}
+
+		if !r.Open() {
+			used += r.End.Sub(start)
+			return nil
+		}
+
+		// Only the last slice of the active task may be open.
+		if active && bytes.Equal(k, last) {
+			running = &start
+			return nil
+		}
+
+		report(problem(ProblemOpenSlice, "slice started at %s is not closed", start.Format(time.RFC3339)))
+		remove = append(remove, append([]byte{}, k...))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if repair {
+		for _, k := range remove {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	changed := false
+	if used != t.Used.Duration {
+		report(problem(ProblemUsedMismatch, "used time is %s, slices add up to %s", t.Used.Duration, used))
+		t.Used.Duration = used
+		changed = true
+	}
+
+	if (running == nil) != (t.Running == nil) || (running != nil && !running.Equal(*t.Running)) {
+		report(problem(ProblemRunningState, "running state doesn't match slices"))
+		t.Running = running
+		changed = true
+	}
+
+	if !repair || !changed {
+		return nil
+	}
+
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(BucketTasks)).Bucket(Itob(t.GroupID)).Put(Itob(t.ID), buf)
+}
@@ -0,0 +1,71 @@
+package stopwatchdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckRepair(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	task, _ := db.AddTask(g.ID, "task", "code")
+	start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+	if _, err := db.SetSlice(g.ID, task.ID, start, start.Add(time.Hour)); err != nil {
+		t.Fatalf("Unable to set slice: %s", err)
+	}
+
+	// Drift used time, leave an open slice behind, add an unreadable slice and
+	// an orphan slice bucket.
+	task, _ = db.GetTask(g.ID, task.ID)
+	task.Used.Add(time.Minute)
+	db.SaveTask(task)
+	if err := db.db.Update(func(tx kvTx) error {
+		bs := tx.Bucket([]byte(BucketSlices))
+		b := bs.Bucket(sliceBucketID(g.ID, task.ID))
+		b.Put(sliceKey(start.Add(2*time.Hour)), encodeSlice(sliceRecord{}))
+		b.Put([]byte("garbage"), []byte{})
+		_, err := bs.CreateBucket(sliceBucketID(g.ID, 99))
+		return err
+	}); err != nil {
+		t.Fatalf("Unable to break database: %s", err)
+	}
+
+	expected := map[string]bool{
+		ProblemUsedMismatch:  true,
+		ProblemOpenSlice:     true,
+		ProblemInvalidRecord: true,
+		ProblemOrphanSlices:  true,
+	}
+
+	rep, err := db.Check()
+	if err != nil {
+		t.Fatalf("Check failed: %s", err)
+	}
+	for _, p := range rep.Problems {
+		if !expected[p.Kind] || p.Repaired {
+			t.Errorf("Unexpected problem: %+v", p)
+		}
+	}
+	if len(rep.Problems) != len(expected) {
+		t.Errorf("Expected %d problems, got %+v", len(expected), rep.Problems)
+	}
+
+	if rep, err = db.Repair(); err != nil {
+		t.Fatalf("Repair failed: %s", err)
+	}
+	for _, p := range rep.Problems {
+		if !p.Repaired {
+			t.Errorf("Problem not repaired: %+v", p)
+		}
+	}
+
+	if rep, err = db.Check(); err != nil || len(rep.Problems) != 0 {
+		t.Errorf("Problems left after repair: %+v, %v", rep, err)
+	}
+
+	if task, _ = db.GetTask(g.ID, task.ID); task.Used.Duration != time.Hour {
+		t.Errorf("Wrong used time after repair: %s", task.Used)
+	}
+}
@@ -0,0 +1,447 @@
+package stopwatchdb
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// BucketCostCodes holds the cost code registry, keyed by code.
+const BucketCostCodes = "costcodes"
+
+// CostCodeResult tells what was done by a cost code import.
+type CostCodeResult struct {
+	Added   int
+	Updated int
+	// Unchanged counts codes that were already registered as listed.
+	Unchanged int
+}
+
+// SetStrictCostCodes enables or disables strict cost codes. When enabled, tasks
+// can only be given active codes of the registry, or no code. Otherwise
+// unregistered codes are accepted, and only inactive codes are refused.
+func (db *StopwatchDB) SetStrictCostCodes(enabled bool) {
+	db.strictCodes = enabled
+}
+
+// ReadCostCodes returns the registered cost codes in alphabetical order.
+// Unless inactive is set, inactive codes are left out.
+func (db *StopwatchDB) ReadCostCodes(inactive bool) ([]model.CostCode, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	res := []model.CostCode{}
+	err := db.db.View(func(tx kvTx) error {
+		return tx.Bucket([]byte(BucketCostCodes)).ForEach(func(k, v []byte) error {
+			var c model.CostCode
+			if err := json.Unmarshal(v, &c); err != nil {
+				return fmt.Errorf("cost code '%s': %s", k, err)
+			}
+			if c.Active || inactive {
+				res = append(res, c)
+			}
+			return nil
+		})
+	})
+
+	return res, err
+}
+
+// SaveCostCode adds a cost code to the registry or updates an existing one.
+func (db *StopwatchDB) SaveCostCode(code *model.CostCode) error {
+	if db.IsOpen() == false {
+		return errors.New("database not ready")
+	}
+
+	if strings.TrimSpace(code.Code) == "" {
+		return errors.New("cost code must not be empty")
+	}
+
+	return db.undoable(AuditSaveCostCode, func(tx kvTx) error {
+		before, _ := getCostCode(tx, code.Code)
+		if err := putCostCode(tx, code); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditSaveCostCode, 0, 0, before, code)
+	})
+}
+
+// SetTaskCostCode assigns a cost code to a task from given time on. Time used
+// before that keeps the code valid at the time. A zero time replaces the code
+// for all time, dropping earlier assignments. The task's CostCode is set to
+// the code in effect now. Returns the updated task.
+func (db *StopwatchDB) SetTaskCostCode(group, task int, code string, from time.Time) (*model.Task, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	var t *model.Task
+	err := db.undoable(AuditSetCostCode, func(tx kvTx) error {
+		var err error
+		if t, err = getTask(tx, group, task); err != nil {
+			return err
+		}
+		before := *t
+
+		if err = db.checkCostCode(tx, code); err != nil {
+			return err
+		}
+
+		assignCostCode(t, code, from)
+		if err = putTask(tx, t); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditSetCostCode, group, task, before, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// assignCostCode assigns code to a task from given time on, see
+// SetTaskCostCode.
+func assignCostCode(t *model.Task, code string, from time.Time) {
+	if from.IsZero() {
+		t.CostCode = code
+		t.CostCodes = nil
+		return
+	}
+
+	assigned := t.CostCodes
+	if len(assigned) == 0 {
+		assigned = []model.CostCodeAssignment{{Code: t.CostCode}}
+	}
+
+	from = from.UTC()
+	next := []model.CostCodeAssignment{}
+	for _, a := range assigned {
+		if !a.From.Equal(from) {
+			next = append(next, a)
+		}
+	}
+	next = append(next, model.CostCodeAssignment{Code: code, From: from})
+	sort.SliceStable(next, func(i, j int) bool { return next[i].From.Before(next[j].From) })
+
+	// Assignments that don't change the code are dropped.
+	t.CostCodes = []model.CostCodeAssignment{}
+	for _, a := range next {
+		if n := len(t.CostCodes); n == 0 || t.CostCodes[n-1].Code != a.Code {
+			t.CostCodes = append(t.CostCodes, a)
+		}
+	}
+
+	t.CostCode = t.CostCodeAt(time.Now())
+	if len(t.CostCodes) == 1 {
+		t.CostCodes = nil
+	}
+}
+
+// RenameCostCode renames a cost code in the registry and on every task using
+// it, including archived tasks and earlier assignments. Returns the number of
+// tasks updated.
+func (db *StopwatchDB) RenameCostCode(from, to string) (int, error) {
+	if db.IsOpen() == false {
+		return 0, errors.New("database not ready")
+	}
+
+	if strings.TrimSpace(to) == "" {
+		return 0, errors.New("cost code must not be empty")
+	}
+
+	var n int
+	err := db.undoable(AuditRenameCostCode, func(tx kvTx) error {
+		if existing, _ := getCostCode(tx, to); existing != nil {
+			return fmt.Errorf("cost code '%s' already exists", to)
+		}
+
+		c, _ := getCostCode(tx, from)
+		if c != nil {
+			if err := tx.Bucket([]byte(BucketCostCodes)).Delete([]byte(from)); err != nil {
+				return err
+			}
+			c.Code = to
+			if err := putCostCode(tx, c); err != nil {
+				return err
+			}
+		}
+
+		// Tasks are collected first, as they are updated while iterating.
+		tasks := []*model.Task{}
+		bt := tx.Bucket([]byte(BucketTasks))
+		if err := bt.ForEach(func(gk, gv []byte) error {
+			if gv != nil {
+				return nil
+			}
+
+			return bt.Bucket(gk).ForEach(func(k, v []byte) error {
+				var t model.Task
+				if json.Unmarshal(v, &t) == nil && usesCostCode(&t, from) {
+					tasks = append(tasks, &t)
+				}
+				return nil
+			})
+		}); err != nil {
+			return err
+		}
+
+		if c == nil && len(tasks) == 0 {
+			return fmt.Errorf("cost code '%s' not found", from)
+		}
+
+		for _, t := range tasks {
+			if t.CostCode == from {
+				t.CostCode = to
+			}
+			for i := range t.CostCodes {
+				if t.CostCodes[i].Code == from {
+					t.CostCodes[i].Code = to
+				}
+			}
+			if err := putTask(tx, t); err != nil {
+				return err
+			}
+		}
+
+		n = len(tasks)
+		return db.audit(tx, AuditRenameCostCode, 0, 0, from, to)
+	})
+
+	return n, err
+}
+
+// ImportCostCodes adds the listed codes to the registry and updates the
+// description and active flag of registered ones. Codes missing from the list
+// are kept as they are.
+func (db *StopwatchDB) ImportCostCodes(codes []model.CostCode) (*CostCodeResult, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	res := &CostCodeResult{}
+	err := db.undoable(AuditImportCostCodes, func(tx kvTx) error {
+		for i := range codes {
+			c := &codes[i]
+			if strings.TrimSpace(c.Code) == "" {
+				return errors.New("cost code must not be empty")
+			}
+
+			before, _ := getCostCode(tx, c.Code)
+			switch {
+			case before == nil:
+				res.Added++
+			case *before == *c:
+				res.Unchanged++
+				continue
+			default:
+				res.Updated++
+			}
+
+			if err := putCostCode(tx, c); err != nil {
+				return err
+			}
+		}
+
+		return db.audit(tx, AuditImportCostCodes, 0, 0, nil, res)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// ReadCostCodeCSV reads a list of cost codes from CSV with a header row. The
+// columns are found by name: "code" is required, "description" and "active"
+// are optional. Codes are active unless the active column says otherwise.
+func ReadCostCodeCSV(r io.Reader, delimiter rune) ([]model.CostCode, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	if delimiter != 0 {
+		cr.Comma = delimiter
+	}
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read header: %s", err)
+	}
+
+	cols := map[string]int{"code": -1, "description": -1, "active": -1}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, ok := cols[name]; ok && cols[name] < 0 {
+			cols[name] = i
+		}
+	}
+	if cols["code"] < 0 {
+		return nil, errors.New("column 'code' not found")
+	}
+
+	codes := []model.CostCode{}
+	seen := map[string]int{}
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		field := func(name string) string {
+			if cols[name] < 0 || cols[name] >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[cols[name]])
+		}
+
+		c := model.CostCode{Code: field("code"), Description: field("description"), Active: true}
+		if c.Code == "" {
+			continue
+		}
+
+		if active := field("active"); active != "" {
+			if c.Active, err = parseActive(active); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+		}
+
+		// Later rows of the same code win.
+		if i, ok := seen[c.Code]; ok {
+			codes[i] = c
+			continue
+		}
+		seen[c.Code] = len(codes)
+		codes = append(codes, c)
+	}
+
+	return codes, nil
+}
+
+// checkCostCode tells if a code can be set on a task. An empty code is always
+// accepted.
+func (db *StopwatchDB) checkCostCode(tx kvTx, code string) error {
+	if code == "" {
+		return nil
+	}
+
+	c, err := getCostCode(tx, code)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c != nil && !c.Active:
+		return fmt.Errorf("cost code '%s' is inactive", code)
+	case c == nil && db.strictCodes:
+		return fmt.Errorf("unknown cost code '%s'", code)
+	}
+
+	return nil
+}
+
+// getCostCode reads a registered cost code within a transaction. Returns nil
+// if the code is not registered.
+func getCostCode(tx kvTx, code string) (*model.CostCode, error) {
+	buf := tx.Bucket([]byte(BucketCostCodes)).Get([]byte(code))
+	if buf == nil {
+		return nil, nil
+	}
+
+	var c model.CostCode
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, fmt.Errorf("cost code '%s': %s", code, err)
+	}
+
+	return &c, nil
+}
+
+// putCostCode writes a cost code to the registry within a transaction.
+func putCostCode(tx kvTx, c *model.CostCode) error {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(BucketCostCodes)).Put([]byte(c.Code), buf)
+}
+
+// registerTaskCostCodes adds the codes used and assigned earlier by tasks to
+// the registry as active codes without a description.
+func registerTaskCostCodes(tx kvTx) error {
+	codes := map[string]bool{}
+	bt := tx.Bucket([]byte(BucketTasks))
+	if err := bt.ForEach(func(gk, gv []byte) error {
+		if gv != nil {
+			return nil
+		}
+
+		return bt.Bucket(gk).ForEach(func(k, v []byte) error {
+			var t model.Task
+			if json.Unmarshal(v, &t) != nil {
+				return nil
+			}
+			for _, a := range append(t.CostCodes, model.CostCodeAssignment{Code: t.CostCode}) {
+				if a.Code != "" {
+					codes[a.Code] = true
+				}
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	names := []string{}
+	for code := range codes {
+		names = append(names, code)
+	}
+	sort.Strings(names)
+
+	for _, code := range names {
+		if c, err := getCostCode(tx, code); err != nil || c != nil {
+			continue
+		}
+
+		if err := putCostCode(tx, &model.CostCode{Code: code, Active: true}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// usesCostCode tells if a task has or has had given code.
+func usesCostCode(t *model.Task, code string) bool {
+	if t.CostCode == code {
+		return true
+	}
+	for _, a := range t.CostCodes {
+		if a.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// parseActive parses the active column of a cost code list.
+func parseActive(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "true", "yes", "y", "active", "open":
+		return true, nil
+	case "0", "false", "no", "n", "inactive", "closed":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("invalid active value '%s'", s)
+}
@@ -0,0 +1,187 @@
+package stopwatchdb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+func TestCostCodeRegistry(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		db.SaveCostCode(&model.CostCode{Code: "dev", Description: "Development", Active: true})
+		db.SaveCostCode(&model.CostCode{Code: "old", Description: "Closed project"})
+
+		g, _ := db.AddGroup("group")
+		if _, err := db.AddTask(g.ID, "a", "old"); err == nil {
+			t.Error("Expected error adding a task with an inactive code")
+		}
+
+		// Unregistered codes are only refused in strict mode.
+		a, err := db.AddTask(g.ID, "a", "typo")
+		if err != nil {
+			t.Fatalf("Unable to add task: %s", err)
+		}
+		db.SetStrictCostCodes(true)
+		if _, err = db.AddTask(g.ID, "b", "typo2"); err == nil {
+			t.Error("Expected error adding a task with an unknown code in strict mode")
+		}
+		if _, err = db.AddTask(g.ID, "c", ""); err != nil {
+			t.Errorf("Unable to add a task without a code in strict mode: %s", err)
+		}
+
+		// Saving a task keeps its code, even if it's not accepted any more.
+		a.Name = "renamed"
+		if err = db.SaveTask(a); err != nil {
+			t.Errorf("Unable to save task with unchanged code: %s", err)
+		}
+		a.CostCode = "old"
+		if err = db.SaveTask(a); err == nil {
+			t.Error("Expected error saving a task with an inactive code")
+		}
+
+		b, _ := db.AddTask(g.ID, "b", "dev")
+		if n, err := db.RenameCostCode("dev", "development"); err != nil || n != 1 {
+			t.Fatalf("Unable to rename code: %d, %v", n, err)
+		}
+		if b, _ = db.GetTask(g.ID, b.ID); b.CostCode != "development" {
+			t.Errorf("Rename not cascaded to task: %+v", b)
+		}
+		if _, err = db.RenameCostCode("development", "old"); err == nil {
+			t.Error("Expected error renaming to an existing code")
+		}
+
+		codes, _ := db.ReadCostCodes(false)
+		if len(codes) != 1 || codes[0].Code != "development" || codes[0].Description != "Development" {
+			t.Errorf("Wrong active codes: %+v", codes)
+		}
+
+		// Renames can be undone.
+		db.Undo()
+		if b, _ = db.GetTask(g.ID, b.ID); b.CostCode != "dev" {
+			t.Errorf("Wrong code after undoing rename: %+v", b)
+		}
+	})
+}
+
+func TestImportCostCodes(t *testing.T) {
+	in := "\ufeffCode;Description;Active\n" +
+		"1000;Development;yes\n" +
+		"2000;\"Admin; internal\";no\n" +
+		"1000;Product development;Y\n" +
+		";empty;yes\n"
+
+	codes, err := ReadCostCodeCSV(strings.NewReader(in), ';')
+	if err != nil {
+		t.Fatalf("Unable to read codes: %s", err)
+	}
+	if len(codes) != 2 || codes[0].Description != "Product development" || codes[1].Active {
+		t.Fatalf("Wrong codes: %+v", codes)
+	}
+
+	if _, err = ReadCostCodeCSV(strings.NewReader("name\nx\n"), ','); err == nil {
+		t.Error("Expected error without a code column")
+	}
+
+	db, done := openMemoryDB(t)
+	defer done()
+
+	db.SaveCostCode(&model.CostCode{Code: "1000", Description: "Dev", Active: true})
+	db.SaveCostCode(&model.CostCode{Code: "3000", Active: true})
+
+	res, err := db.ImportCostCodes(codes)
+	if err != nil || res.Added != 1 || res.Updated != 1 {
+		t.Fatalf("Wrong import: %+v, %v", res, err)
+	}
+	if res, _ = db.ImportCostCodes(codes); res.Unchanged != 2 {
+		t.Errorf("Wrong second import: %+v", res)
+	}
+
+	if all, _ := db.ReadCostCodes(true); len(all) != 3 || all[0].Description != "Product development" {
+		t.Errorf("Wrong codes after import: %+v", all)
+	}
+}
+
+func TestMigrateCostCodes(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	db.AddTask(g.ID, "a", "dev")
+	db.AddTask(g.ID, "b", "")
+
+	// Tasks added without a registry entry, as before schema version 5.
+	if err := db.db.Update(func(tx kvTx) error {
+		return putVersion(tx, 4)
+	}); err != nil {
+		t.Fatalf("Unable to set version: %s", err)
+	}
+
+	if _, err := db.Migrate(); err != nil {
+		t.Fatalf("Unable to migrate: %s", err)
+	}
+
+	if codes, _ := db.ReadCostCodes(false); len(codes) != 1 || codes[0].Code != "dev" || !codes[0].Active {
+		t.Errorf("Wrong codes after migration: %+v", codes)
+	}
+}
+
+func TestEffectiveCostCodes(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "old")
+
+		nov := time.Date(2017, 11, 20, 8, 0, 0, 0, time.UTC)
+		dec := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		db.SetSlice(g.ID, a.ID, nov, nov.Add(time.Hour))
+		db.SetSlice(g.ID, a.ID, dec, dec.Add(2*time.Hour))
+
+		a, err := db.SetTaskCostCode(g.ID, a.ID, "new", time.Date(2017, 12, 1, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatalf("Unable to set cost code: %s", err)
+		}
+		if a.CostCode != "new" || len(a.CostCodes) != 2 {
+			t.Errorf("Wrong task after setting code: %+v", a)
+		}
+
+		// Earlier reports don't change.
+		if rep, _ := db.GetUsage(g.ID, nov, nov); len(rep.CostCodes) != 1 || rep.CostCodes[0].CostCode != "old" {
+			t.Errorf("Wrong November report: %+v", rep.CostCodes)
+		}
+		rep, _ := db.GetUsage(g.ID, nov, dec)
+		totals := map[string]time.Duration{}
+		for _, c := range rep.CostCodes {
+			totals[c.CostCode] = c.Total.Duration
+		}
+		if totals["old"] != time.Hour || totals["new"] != 2*time.Hour {
+			t.Errorf("Wrong totals over the change: %v", totals)
+		}
+
+		slices, _ := db.GetSlices(g.ID, nov, dec)
+		if s := slices[0].Slices; len(s) != 2 || s[0].CostCode != "old" || s[1].CostCode != "new" {
+			t.Errorf("Wrong slice codes: %+v", s)
+		}
+
+		// Renames reach earlier assignments, and setting the same code again
+		// collapses the history.
+		db.RenameCostCode("old", "older")
+		if a, _ = db.GetTask(g.ID, a.ID); a.CostCodeAt(nov) != "older" {
+			t.Errorf("Rename not applied to earlier assignment: %+v", a)
+		}
+		if a, _ = db.SetTaskCostCode(g.ID, a.ID, "older", time.Date(2017, 12, 1, 0, 0, 0, 0, time.UTC)); a.CostCode != "older" || len(a.CostCodes) != 0 {
+			t.Errorf("Wrong task after reverting code: %+v", a)
+		}
+
+		// A code assigned from a future date isn't current yet.
+		next := time.Now().AddDate(0, 0, 7)
+		if a, _ = db.SetTaskCostCode(g.ID, a.ID, "next", next); a.CostCode != "older" || a.CostCodeAt(next) != "next" {
+			t.Errorf("Wrong task after future code: %+v", a)
+		}
+
+		// A zero time replaces the code for all time.
+		if a, _ = db.SetTaskCostCode(g.ID, a.ID, "all", time.Time{}); a.CostCode != "all" || len(a.CostCodes) != 0 {
+			t.Errorf("Wrong task after replacing code: %+v", a)
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package stopwatchdb
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// Duration formats for CSV output.
+const (
+	// DurationDecimal writes durations as decimal hours, eg. "1.50".
+	DurationDecimal = "decimal"
+	// DurationClock writes durations as hours, minutes and seconds, eg. "1:30:00".
+	DurationClock = "clock"
+	// DurationMinutes writes durations as whole minutes, eg. "90".
+	DurationMinutes = "minutes"
+)
+
+// CSVOptions controls how reports are written as CSV. Zero values use the
+// defaults: comma as delimiter, RFC 3339 times, decimal hours and UTC.
+type CSVOptions struct {
+	// Delimiter separates the fields.
+	Delimiter rune
+	// TimeFormat is the layout of slice start and end times.
+	TimeFormat string
+	// DurationFormat is one of the Duration* constants.
+	DurationFormat string
+	// Location is the time zone of slice start and end times.
+	Location *time.Location
+}
+
+// ParseDurationFormat checks a duration format name, returning the default
+// format for an empty name.
+func ParseDurationFormat(name string) (string, error) {
+	switch name {
+	case "":
+		return DurationDecimal, nil
+	case DurationDecimal, DurationClock, DurationMinutes:
+		return name, nil
+	}
+
+	return "", fmt.Errorf("unknown duration format '%s'", name)
+}
+
+// ParseDelimiter checks a delimiter given as a string, returning the default
+// delimiter for an empty string.
+func ParseDelimiter(s string) (rune, error) {
+	if s == "" {
+		return ',', nil
+	}
+
+	r := []rune(s)
+	if len(r) != 1 {
+		return 0, errors.New("delimiter must be a single character")
+	}
+	if !validDelimiter(r[0]) {
+		return 0, fmt.Errorf("invalid delimiter %q", r[0])
+	}
+
+	return r[0], nil
+}
+
+// validDelimiter tells if the CSV writer can use a delimiter.
+func validDelimiter(r rune) bool {
+	return r != '"' && r != '\r' && r != '\n' && r != utf8.RuneError && utf8.ValidRune(r)
+}
+
+// WriteSlicesCSV writes the slices of a group as CSV, one row per slice with
+// its note, with a header row.
+func WriteSlicesCSV(w io.Writer, group string, slices []TaskSlices, opts CSVOptions) error {
+	cw, err := opts.writer(w)
+	if err != nil {
+		return err
+	}
+
+	if err = cw.Write([]string{"Group", "Task", "Cost code", "Start", "End", "Duration", "Note"}); err != nil {
+		return err
+	}
+	for _, ts := range slices {
+		for _, s := range ts.Slices {
+			err = cw.Write([]string{
+				group,
+				ts.Name,
+				s.CostCode,
+				opts.formatTime(s.Start),
+				opts.formatTime(s.End),
+				opts.formatDuration(s.End.Sub(s.Start)),
+				s.Note,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteUsageCSV writes a usage report as CSV. Rows are cost codes in
+// alphabetical order and columns are dates, followed by a total column and a
+// total row.
+func WriteUsageCSV(w io.Writer, rep *UsageReport, opts CSVOptions) error {
+	cw, err := opts.writer(w)
+	if err != nil {
+		return err
+	}
+
+	header := []string{"Cost code"}
+	totals := []string{"Total"}
+	for _, d := range rep.Dates {
+		header = append(header, d.Date)
+		totals = append(totals, opts.formatDuration(d.Used.Duration))
+	}
+	if err = cw.Write(append(header, "Total")); err != nil {
+		return err
+	}
+
+	codes := append([]CostUsage{}, rep.CostCodes...)
+	sort.Slice(codes, func(i, j int) bool { return codes[i].CostCode < codes[j].CostCode })
+
+	for _, c := range codes {
+		row := []string{c.CostCode}
+		for _, u := range c.Usage {
+			row = append(row, opts.formatDuration(u.Used.Duration))
+		}
+		if err = cw.Write(append(row, opts.formatDuration(c.Total.Duration))); err != nil {
+			return err
+		}
+	}
+
+	if err = cw.Write(append(totals, opts.formatDuration(rep.Combined.Duration))); err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// writer returns a CSV writer using the configured delimiter. Delimiters the
+// CSV writer can't use are rejected, as it would otherwise write nothing.
+func (o CSVOptions) writer(w io.Writer) (*csv.Writer, error) {
+	if _, err := ParseDurationFormat(o.DurationFormat); err != nil {
+		return nil, err
+	}
+
+	if o.Delimiter != 0 && !validDelimiter(o.Delimiter) {
+		return nil, fmt.Errorf("invalid delimiter %q", o.Delimiter)
+	}
+
+	cw := csv.NewWriter(w)
+	if o.Delimiter != 0 {
+		cw.Comma = o.Delimiter
+	}
+
+	return cw, nil
+}
+
+// formatTime formats a slice time in the configured time zone and layout.
+func (o CSVOptions) formatTime(t time.Time) string {
+	loc := o.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	layout := o.TimeFormat
+	if layout == "" {
+		layout = time.RFC3339
+	}
+
+	return t.In(loc).Format(layout)
+}
+
+// formatDuration formats a duration in the configured format.
+func (o CSVOptions) formatDuration(d time.Duration) string {
+	switch o.DurationFormat {
+	case DurationClock:
+		s := int64(d.Round(time.Second) / time.Second)
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s%3600/60, s%60)
+	case DurationMinutes:
+		return fmt.Sprintf("%d", int64(d.Round(time.Minute)/time.Minute))
+	}
+
+	return fmt.Sprintf("%.2f", d.Hours())
+}
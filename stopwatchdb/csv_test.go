@@ -0,0 +1,85 @@
+package stopwatchdb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestWriteCSV(t *testing.T) {
+	db, done := openMemoryDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	a, _ := db.AddTask(g.ID, "a", "dev")
+	b, _ := db.AddTask(g.ID, "b, \"quoted\"", "admin")
+
+	start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+	db.SetSlice(g.ID, a.ID, start, start.Add(90*time.Minute))
+	db.SetSlice(g.ID, b.ID, start.AddDate(0, 0, 1), start.AddDate(0, 0, 1).Add(30*time.Minute))
+	db.SetSliceNote(g.ID, a.ID, start, "planning; review")
+
+	slices, err := db.GetSlices(g.ID, start, start.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("Unable to get slices: %s", err)
+	}
+
+	var buf bytes.Buffer
+	opts := CSVOptions{Delimiter: ';', TimeFormat: "2006-01-02 15:04", DurationFormat: DurationClock}
+	if err = WriteSlicesCSV(&buf, g.Name, slices, opts); err != nil {
+		t.Fatalf("Unable to write slices: %s", err)
+	}
+
+	want := "Group;Task;Cost code;Start;End;Duration;Note\n" +
+		"group;a;dev;2017-12-05 08:00;2017-12-05 09:30;1:30:00;\"planning; review\"\n" +
+		"group;\"b, \"\"quoted\"\"\";admin;2017-12-06 08:00;2017-12-06 08:30;0:30:00;\n"
+	if buf.String() != want {
+		t.Errorf("Wrong slices CSV:\n%s\nexpected:\n%s", buf.String(), want)
+	}
+
+	rep, err := db.GetUsage(g.ID, start, start.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("Unable to get usage: %s", err)
+	}
+
+	buf.Reset()
+	if err = WriteUsageCSV(&buf, rep, CSVOptions{}); err != nil {
+		t.Fatalf("Unable to write usage: %s", err)
+	}
+
+	want = "Cost code,2017-12-05,2017-12-06,Total\n" +
+		"admin,0.00,0.50,0.50\n" +
+		"dev,1.50,0.00,1.50\n" +
+		"Total,1.50,0.50,2.00\n"
+	if buf.String() != want {
+		t.Errorf("Wrong usage CSV:\n%s\nexpected:\n%s", buf.String(), want)
+	}
+
+	if err = WriteUsageCSV(&buf, rep, CSVOptions{DurationFormat: "fortnights"}); err == nil {
+		t.Errorf("Expected error for unknown duration format")
+	}
+
+	for _, d := range []rune{'"', '\n', '\r', utf8.RuneError} {
+		buf.Reset()
+		if err = WriteUsageCSV(&buf, rep, CSVOptions{Delimiter: d}); err == nil {
+			t.Errorf("Expected error for delimiter %q", d)
+		}
+		if err = WriteSlicesCSV(&buf, "group", slices, CSVOptions{Delimiter: d}); err == nil {
+			t.Errorf("Expected error for delimiter %q", d)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Output written with delimiter %q: %q", d, buf.String())
+		}
+		if _, err = ParseDelimiter(string(d)); err == nil {
+			t.Errorf("Delimiter %q accepted", d)
+		}
+	}
+
+	if d, err := ParseDelimiter(""); err != nil || d != ',' {
+		t.Errorf("Wrong default delimiter %q: %v", d, err)
+	}
+	if _, err = ParseDelimiter(";;"); err == nil {
+		t.Errorf("Multiple character delimiter accepted")
+	}
+}
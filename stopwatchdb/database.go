@@ -7,9 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
-	"github.com/boltdb/bolt"
 	model "github.com/msepp/stopwatch/stopwatchmodel"
 )
 
@@ -22,14 +22,34 @@ const (
 	BucketHistory = "history"
 )
 
+// keyActiveTasks is the state bucket key holding the active tasks.
+const keyActiveTasks = "activeTasks"
+
 // StopwatchDB is a handle for accessing a stopwatch database
 type StopwatchDB struct {
-	db *bolt.DB
+	db           kvStore
+	memory       bool
+	path         string
+	noMigrate    bool
+	loc          *time.Location
+	multi        bool
+	strictCodes  bool
+	parallel     ParallelMode
+	maxDuration  time.Duration
+	dayEnd       time.Duration
+	gapThreshold time.Duration
+	source       string
+	undoLimit    int
+	backupDir    string
+	backupKeep   int
+	autoBackup   bool
+	backupMu     sync.Mutex // guards lastBackup and serializes snapshots
+	lastBackup   time.Time
 }
 
 // New return an initialized stopwatch db
 func New() *StopwatchDB {
-	return &StopwatchDB{}
+	return &StopwatchDB{undoLimit: defaultUndoLimit, backupKeep: defaultBackupRetention}
 }
 
 // IsOpen returns if database is open.
@@ -46,27 +66,16 @@ func (db *StopwatchDB) AddTask(group int, task, costcode string) (*model.Task, e
 	var t *model.Task = model.NewTask(group, task, costcode)
 
 	// Generate new task, return task.
-	if err := db.db.Update(func(tx *bolt.Tx) error {
-		bt := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(group))
-
-		// Next task ID
-		id, _ := bt.NextSequence()
-		t.ID = int(id)
-
-		// Create Bucket for task slices
-		sliceID := bytes.Join([][]byte{Itob(group), Itob(t.ID)}, []byte("-"))
-		_, err := tx.Bucket([]byte(BucketSlices)).CreateBucketIfNotExists(sliceID)
-		if err != nil {
+	if err := db.undoable(AuditAddTask, func(tx kvTx) error {
+		if err := db.checkCostCode(tx, costcode); err != nil {
 			return err
 		}
 
-		buf, err := json.Marshal(t)
-		if err != nil {
+		if err := addTask(tx, t); err != nil {
 			return err
 		}
 
-		// Add new task
-		return bt.Put(Itob(t.ID), buf)
+		return db.audit(tx, AuditAddTask, group, t.ID, nil, t)
 	}); err != nil {
 		return nil, err
 	}
@@ -74,6 +83,32 @@ func (db *StopwatchDB) AddTask(group int, task, costcode string) (*model.Task, e
 	return t, nil
 }
 
+// addTask stores a new task of group t.GroupID, setting its ID.
+func addTask(tx kvTx, t *model.Task) error {
+	bt := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(t.GroupID))
+	if bt == nil {
+		return errors.New("group not found")
+	}
+
+	// Next task ID
+	id, _ := bt.NextSequence()
+	t.ID = int(id)
+
+	// Create Bucket for task slices
+	_, err := tx.Bucket([]byte(BucketSlices)).CreateBucketIfNotExists(sliceBucketID(t.GroupID, t.ID))
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	// Add new task
+	return bt.Put(Itob(t.ID), buf)
+}
+
 // AddGroup adds a group, using given name
 func (db *StopwatchDB) AddGroup(group string) (*model.Group, error) {
 	if db.IsOpen() == false {
@@ -83,25 +118,12 @@ func (db *StopwatchDB) AddGroup(group string) (*model.Group, error) {
 	var p *model.Group = &model.Group{Name: group}
 
 	// Generate new group and return it
-	if err := db.db.Update(func(tx *bolt.Tx) error {
-		bp := tx.Bucket([]byte(BucketGroups))
-
-		// get next ID
-		id, _ := bp.NextSequence()
-		p.ID = int(id)
-
-		// Create Bucket for the group tasks
-		_, err := tx.Bucket([]byte(BucketTasks)).CreateBucketIfNotExists(Itob(p.ID))
-		if err != nil {
-			return err
-		}
-
-		buf, err := json.Marshal(p)
-		if err != nil {
+	if err := db.undoable(AuditAddGroup, func(tx kvTx) error {
+		if err := addGroup(tx, p); err != nil {
 			return err
 		}
 
-		return bp.Put(Itob(p.ID), buf)
+		return db.audit(tx, AuditAddGroup, p.ID, 0, nil, p)
 	}); err != nil {
 		return nil, err
 	}
@@ -109,28 +131,42 @@ func (db *StopwatchDB) AddGroup(group string) (*model.Group, error) {
 	return p, nil
 }
 
+// addGroup stores a new group, setting its ID.
+func addGroup(tx kvTx, p *model.Group) error {
+	bp := tx.Bucket([]byte(BucketGroups))
+
+	// get next ID
+	id, _ := bp.NextSequence()
+	p.ID = int(id)
+
+	// Create Bucket for the group tasks
+	_, err := tx.Bucket([]byte(BucketTasks)).CreateBucketIfNotExists(Itob(p.ID))
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return bp.Put(Itob(p.ID), buf)
+}
+
 // GetTask returns one task details
 func (db *StopwatchDB) GetTask(group, task int) (*model.Task, error) {
 	if db.IsOpen() == false {
 		return nil, errors.New("database not ready")
 	}
 
-	var t model.Task
-	err := db.db.View(func(tx *bolt.Tx) error {
-		bt := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(group))
-		if bt == nil {
-			return errors.New("group not found")
-		}
-
-		v := bt.Get(Itob(task))
-		if v == nil {
-			return errors.New("task not found")
-		}
-
-		return json.Unmarshal(v, &t)
+	var t *model.Task
+	err := db.db.View(func(tx kvTx) error {
+		var err error
+		t, err = getTask(tx, group, task)
+		return err
 	})
 
-	return &t, err
+	return t, err
 }
 
 // GetGroup returns one group details
@@ -139,18 +175,14 @@ func (db *StopwatchDB) GetGroup(group int) (*model.Group, error) {
 		return nil, errors.New("database not ready")
 	}
 
-	var g model.Group
-	err := db.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(BucketGroups))
-		v := b.Get(Itob(group))
-		if v == nil {
-			return errors.New("group not found")
-		}
-
-		return json.Unmarshal(v, &g)
+	var g *model.Group
+	err := db.db.View(func(tx kvTx) error {
+		var err error
+		g, err = getGroup(tx, group)
+		return err
 	})
 
-	return &g, err
+	return g, err
 }
 
 // StartTask marks tasks start
@@ -159,118 +191,592 @@ func (db *StopwatchDB) StartTask(group, task int) (*model.Task, error) {
 		return nil, errors.New("database not ready")
 	}
 
-	t, err := db.GetTask(group, task)
-	if err != nil {
+	var t *model.Task
+	if err := db.undoable(AuditStartTask, func(tx kvTx) error {
+		before, err := getTask(tx, group, task)
+		if err != nil {
+			return err
+		}
+
+		if t, err = startTask(tx, group, task, time.Now().UTC()); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditStartTask, group, task, before, t)
+	}); err != nil {
 		return nil, err
 	}
 
-	// Find task from slices and make sure last value is an timestamp (key) without
-	// end date (value)
-	var now time.Time
-	if err = db.db.Update(func(tx *bolt.Tx) error {
-		// Create Bucket for task slices
-		sliceID := bytes.Join([][]byte{Itob(group), Itob(task)}, []byte("-"))
-		b := tx.Bucket([]byte(BucketSlices)).Bucket(sliceID)
+	return t, nil
+}
+
+// StopTask marks task stop event. Clears the active task if it is the stopped
+// task.
+func (db *StopwatchDB) StopTask(group, task int) (*model.Task, error) {
+	return db.StopTaskNote(group, task, "")
+}
+
+// StopTaskNote stops a task like StopTask, setting given note on the stopped
+// slice. An empty note keeps the slice without a note.
+func (db *StopwatchDB) StopTaskNote(group, task int, note string) (*model.Task, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	var t *model.Task
+	if err := db.undoable(AuditStopTask, func(tx kvTx) error {
+		before, err := getTask(tx, group, task)
+		if err != nil {
+			return err
+		}
 
-		if b == nil {
-			return fmt.Errorf("task not found")
+		if t, err = stopTask(tx, group, task, time.Now().UTC(), db.Location(), 0, note); err != nil {
+			return err
 		}
 
-		// get last value, if its value is empty, the task is already running
-		c := b.Cursor()
-		k, v := c.Last()
-		if k != nil && len(v) == 0 {
-			now, _ = time.Parse(time.RFC3339, string(k))
-			return nil
+		if err = db.audit(tx, AuditStopTask, group, task, before, t); err != nil {
+			return err
 		}
 
-		now = time.Now().UTC()
-		return b.Put([]byte(now.Format(time.RFC3339)), []byte{})
+		return clearActiveTask(tx, func(g, t int) bool { return g == group && t == task })
 	}); err != nil {
 		return nil, err
 	}
 
-	t.Running = &now
-	return t, db.SaveTask(t)
+	return t, nil
 }
 
-// StopTask marks task stop event
-func (db *StopwatchDB) StopTask(group, task int) (*model.Task, error) {
+// SwitchTask makes given task an active task and starts it. Unless multiple
+// timers are enabled, previously active tasks are stopped. Everything happens
+// in a single transaction, using the same timestamp for stopping the previous
+// tasks and starting the new one. Returns the started task.
+func (db *StopwatchDB) SwitchTask(group, task int) (*model.Task, error) {
 	if db.IsOpen() == false {
 		return nil, errors.New("database not ready")
 	}
 
-	var d time.Duration
+	var t *model.Task
+	if err := db.undoable(AuditSwitchTask, func(tx kvTx) error {
+		var err error
+		now := time.Now().UTC()
 
-	t, err := db.GetTask(group, task)
+		active, err := getActiveTasks(tx)
+		if err != nil {
+			return err
+		}
+
+		// The task may already be running as an active task.
+		running := false
+		next := []model.ActiveTask{}
+		for _, at := range active {
+			if at.GroupID != group || at.TaskID != task {
+				next = append(next, at)
+				continue
+			}
+
+			if t, err = getTask(tx, group, task); err != nil {
+				return err
+			}
+			running = t.Running != nil
+		}
+
+		// Nothing to do for a running task, unless other tasks have to be
+		// stopped.
+		if running && (db.multi || len(next) == 0) {
+			return nil
+		}
+
+		// Stop previous tasks, unless they have been stopped already or no longer
+		// exist.
+		if !db.multi {
+			for _, at := range next {
+				prev, err := getTask(tx, at.GroupID, at.TaskID)
+				if err == nil && prev.Running != nil {
+					stopped, err := stopTask(tx, prev.GroupID, prev.ID, now, db.Location(), 0, "")
+					if err != nil {
+						return fmt.Errorf("unable to stop current task: %s", err)
+					}
+
+					if err = db.audit(tx, AuditStopTask, prev.GroupID, prev.ID, prev, stopped); err != nil {
+						return err
+					}
+				}
+			}
+			next = []model.ActiveTask{}
+		}
+
+		if running {
+			return putActiveTasks(tx, []model.ActiveTask{{GroupID: group, TaskID: task}})
+		}
+
+		before, err := getTask(tx, group, task)
+		if err != nil {
+			return err
+		}
+
+		if t, err = startTask(tx, group, task, now); err != nil {
+			return err
+		}
+
+		if err = db.audit(tx, AuditStartTask, group, task, before, t); err != nil {
+			return err
+		}
+
+		return putActiveTasks(tx, append(next, model.ActiveTask{GroupID: group, TaskID: task}))
+	}); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// getTask reads a task within a transaction.
+func getTask(tx kvTx, group, task int) (*model.Task, error) {
+	bt := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(group))
+	if bt == nil {
+		return nil, errors.New("group not found")
+	}
+
+	v := bt.Get(Itob(task))
+	if v == nil {
+		return nil, errors.New("task not found")
+	}
+
+	var t model.Task
+	if err := json.Unmarshal(v, &t); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// putTask writes a task within a transaction.
+func putTask(tx kvTx, t *model.Task) error {
+	b := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(t.GroupID))
+	if b == nil {
+		return errors.New("group not found")
+	}
+
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(Itob(t.ID), buf)
+}
+
+// putGroup writes a group within a transaction.
+func putGroup(tx kvTx, g *model.Group) error {
+	buf, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(BucketGroups)).Put(Itob(g.ID), buf)
+}
+
+// getGroup reads a group within a transaction.
+func getGroup(tx kvTx, group int) (*model.Group, error) {
+	v := tx.Bucket([]byte(BucketGroups)).Get(Itob(group))
+	if v == nil {
+		return nil, errors.New("group not found")
+	}
+
+	var g model.Group
+	if err := json.Unmarshal(v, &g); err != nil {
+		return nil, err
+	}
+
+	return &g, nil
+}
+
+// startTask opens a slice for a task at given time, unless the task already
+// has an open slice. Returns the updated task.
+func startTask(tx kvTx, group, task int, now time.Time) (*model.Task, error) {
+	t, err := getTask(tx, group, task)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Archived {
+		return nil, errors.New("task is archived")
+	}
+
+	g, err := getGroup(tx, group)
 	if err != nil {
 		return nil, err
 	}
 
-	// Find task from slices and add end date (value) for last entry if not value
-	// is yet set.
-	if err = db.db.Update(func(tx *bolt.Tx) error {
-		// Create Bucket for task slices
-		sliceID := bytes.Join([][]byte{Itob(group), Itob(task)}, []byte("-"))
-		b := tx.Bucket([]byte(BucketSlices)).Bucket(sliceID)
+	if g.Archived {
+		return nil, errors.New("group is archived")
+	}
+
+	b := tx.Bucket([]byte(BucketSlices)).Bucket(sliceBucketID(group, task))
+	if b == nil {
+		return nil, fmt.Errorf("task not found")
+	}
 
-		if b == nil {
-			return fmt.Errorf("task not found")
+	// get last value, if the slice is still open, the task is already running
+	if k, v := b.Cursor().Last(); k != nil {
+		start, r, err := decodeSliceEntry(k, v)
+		if err != nil {
+			return nil, err
 		}
 
-		// get last value, if its value is empty, the task is already running
-		c := b.Cursor()
-		k, v := c.Last()
-		if k != nil && len(v) != 0 {
-			return fmt.Errorf("task already stopped")
+		if r.Open() {
+			t.Running = &start
+			return t, putTask(tx, t)
 		}
+	}
 
-		start, _ := time.Parse(time.RFC3339, string(k))
-		now := time.Now().UTC()
-		d = now.Sub(start)
+	if err = b.Put(sliceKey(now), encodeSlice(sliceRecord{})); err != nil {
+		return nil, err
+	}
+
+	t.Running = &now
+	return t, putTask(tx, t)
+}
+
+// stopTask closes the open slice of a task at given time. Slices are split at
+// midnight in given location and given flags are set on them. A non-empty note
+// is set on all of them. Returns the updated task.
+func stopTask(tx kvTx, group, task int, now time.Time, loc *time.Location, flags byte, note string) (*model.Task, error) {
+	t, err := getTask(tx, group, task)
+	if err != nil {
+		return nil, err
+	}
+
+	b := tx.Bucket([]byte(BucketSlices)).Bucket(sliceBucketID(group, task))
+	if b == nil {
+		return nil, fmt.Errorf("task not found")
+	}
+
+	// get last value, if the slice is closed, the task is already stopped
+	k, v := b.Cursor().Last()
+	if k == nil {
+		return nil, fmt.Errorf("task already stopped")
+	}
+
+	start, r, err := decodeSliceEntry(k, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.Open() {
+		return nil, fmt.Errorf("task already stopped")
+	}
+
+	// If current slice and end point are on separate dates, we split into extra
+	// slices to avoid having slices that span multiple days.
+	r.Flags |= flags
+	if note != "" {
+		if err = r.SetNote(note); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range splitDays(start, now, loc) {
+		r.End = s.End
+		if err := b.Put(sliceKey(s.Start), encodeSlice(r)); err != nil {
+			return nil, err
+		}
+	}
+
+	t.Running = nil
+	t.Used.Add(now.Sub(start))
+
+	return t, putTask(tx, t)
+}
+
+// SetTaskArchived archives or restores a task. Archived tasks keep their
+// slices, but are hidden from task listings and can't be started.
+func (db *StopwatchDB) SetTaskArchived(group, task int, archived bool) (*model.Task, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	var t *model.Task
+	if err := db.undoable(AuditArchiveTask, func(tx kvTx) error {
+		before, err := getTask(tx, group, task)
+		if err != nil {
+			return err
+		}
+
+		if archived && before.Running != nil {
+			return errors.New("task is running")
+		}
+
+		after := *before
+		after.Archived = archived
+		t = &after
+		if err = putTask(tx, t); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditArchiveTask, group, task, before, t)
+	}); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
 
-		// If current slice and end point are on separate dates, we split into extra
-		// slices to avoid having slices that span multiple days.
-		for start.Year() != now.Year() || start.Month() != now.Month() || start.Day() != now.Day() {
-			// End at next day...
-			end := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, time.UTC)
-			// Minus 1 second, so last second of starting date.
-			end = end.Add(time.Second * -1)
+// SetGroupArchived archives or restores a group. Archived groups keep their
+// tasks and slices, but are hidden from group listings and their tasks can't be
+// started.
+func (db *StopwatchDB) SetGroupArchived(group int, archived bool) (*model.Group, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
 
-			if err := b.Put(k, []byte(end.Format(time.RFC3339))); err != nil {
+	var g *model.Group
+	if err := db.undoable(AuditArchiveGroup, func(tx kvTx) error {
+		before, err := getGroup(tx, group)
+		if err != nil {
+			return err
+		}
+
+		bt := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(group))
+		if archived && bt != nil {
+			if err = bt.ForEach(func(k, v []byte) error {
+				var t model.Task
+				if err := json.Unmarshal(v, &t); err == nil && t.Running != nil {
+					return fmt.Errorf("task '%s' is running", t.Name)
+				}
+				return nil
+			}); err != nil {
 				return err
 			}
+		}
 
-			// Next start is at the start of next day
-			start = end.Add(time.Second)
-			k = []byte(start.Format(time.RFC3339))
+		after := *before
+		after.Archived = archived
+		g = &after
+		if err = putGroup(tx, g); err != nil {
+			return err
 		}
 
-		return b.Put(k, []byte(now.Format(time.RFC3339)))
+		return db.audit(tx, AuditArchiveGroup, group, 0, before, g)
 	}); err != nil {
 		return nil, err
 	}
 
-	t.Running = nil
-	t.Used.Add(d)
+	return g, nil
+}
+
+// DeleteTask removes a task from a group. Removes the task slices, history
+// entries and the active task state pointing to the task as well.
+func (db *StopwatchDB) DeleteTask(group, task int) error {
+	if db.IsOpen() == false {
+		return errors.New("database not ready")
+	}
+
+	return db.db.Update(func(tx kvTx) error {
+		bt := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(group))
+		if bt == nil {
+			return errors.New("group not found")
+		}
+
+		if bt.Get(Itob(task)) == nil {
+			return errors.New("task not found")
+		}
+
+		before, err := readDeletedTask(tx, group, task)
+		if err != nil {
+			return err
+		}
+
+		if err = db.audit(tx, AuditDeleteTask, group, task, before, nil); err != nil {
+			return err
+		}
+
+		if err := bt.Delete(Itob(task)); err != nil {
+			return err
+		}
+
+		// Remove task slices
+		sliceID := sliceBucketID(group, task)
+		bs := tx.Bucket([]byte(BucketSlices))
+		if bs.Bucket(sliceID) != nil {
+			if err := bs.DeleteBucket(sliceID); err != nil {
+				return err
+			}
+		}
 
-	return t, db.SaveTask(t)
+		match := func(g, t int) bool { return g == group && t == task }
+		if err := removeHistory(tx, match); err != nil {
+			return err
+		}
+
+		return clearActiveTask(tx, match)
+	})
+}
+
+// DeleteGroup removes a group and all tasks in it. Removes the task slices,
+// history entries and the active task state pointing to the group tasks as
+// well.
+func (db *StopwatchDB) DeleteGroup(group int) error {
+	if db.IsOpen() == false {
+		return errors.New("database not ready")
+	}
+
+	return db.db.Update(func(tx kvTx) error {
+		bg := tx.Bucket([]byte(BucketGroups))
+		before := bg.Get(Itob(group))
+		if before == nil {
+			return errors.New("group not found")
+		}
+
+		// Record the removed tasks and their slices, then the group.
+		bt := tx.Bucket([]byte(BucketTasks))
+		if b := bt.Bucket(Itob(group)); b != nil {
+			if err := b.ForEach(func(k, v []byte) error {
+				d, err := readDeletedTask(tx, group, Btoi(k))
+				if err != nil {
+					return err
+				}
+				return db.audit(tx, AuditDeleteTask, group, Btoi(k), d, nil)
+			}); err != nil {
+				return err
+			}
+		}
+
+		if err := db.audit(tx, AuditDeleteGroup, group, 0, json.RawMessage(before), nil); err != nil {
+			return err
+		}
+
+		// Groups below take the place of the removed group.
+		var deleted model.Group
+		json.Unmarshal(before, &deleted)
+		if err := reparentChildren(tx, group, deleted.ParentID); err != nil {
+			return err
+		}
+
+		if err := bg.Delete(Itob(group)); err != nil {
+			return err
+		}
+
+		// Remove group tasks
+		if bt.Bucket(Itob(group)) != nil {
+			if err := bt.DeleteBucket(Itob(group)); err != nil {
+				return err
+			}
+		}
+
+		// Remove slices of every task in the group. Slice buckets are named
+		// "group-task", so they can be found by prefix. Keys are collected first
+		// as modifying a bucket while iterating it isn't allowed.
+		bs := tx.Bucket([]byte(BucketSlices))
+		prefix := append(Itob(group), '-')
+		sliceIDs := [][]byte{}
+		c := bs.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			sliceIDs = append(sliceIDs, append([]byte{}, k...))
+		}
+
+		for _, sliceID := range sliceIDs {
+			if err := bs.DeleteBucket(sliceID); err != nil {
+				return err
+			}
+		}
+
+		match := func(g, t int) bool { return g == group }
+		if err := removeHistory(tx, match); err != nil {
+			return err
+		}
+
+		return clearActiveTask(tx, match)
+	})
+}
+
+// removeHistory drops history entries for which match returns true.
+func removeHistory(tx kvTx, match func(group, task int) bool) error {
+	b := tx.Bucket([]byte(BucketHistory))
+	buf := b.Get([]byte("usage"))
+	if buf == nil {
+		return nil
+	}
+
+	var history []model.HistoryTask
+	if err := json.Unmarshal(buf, &history); err != nil {
+		return err
+	}
+
+	kept := []model.HistoryTask{}
+	for _, ht := range history {
+		if !match(ht.GroupID, ht.ID) {
+			kept = append(kept, ht)
+		}
+	}
+
+	if len(kept) == len(history) {
+		return nil
+	}
+
+	buf, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte("usage"), buf)
+}
+
+// clearActiveTask removes active tasks for which match returns true.
+func clearActiveTask(tx kvTx, match func(group, task int) bool) error {
+	active, err := getActiveTasks(tx)
+	if err != nil {
+		return err
+	}
+
+	kept := []model.ActiveTask{}
+	for _, at := range active {
+		if !match(at.GroupID, at.TaskID) {
+			kept = append(kept, at)
+		}
+	}
+
+	if len(kept) == len(active) {
+		return nil
+	}
+
+	return putActiveTasks(tx, kept)
 }
 
 // SaveTask updates task value in database to the given value
 func (db *StopwatchDB) SaveTask(task *model.Task) error {
+	return db.SaveTaskFrom(task, time.Time{})
+}
+
+// SaveTaskFrom updates task value in database to the given value. A changed
+// cost code is assigned from given time on, like with SetTaskCostCode, and a
+// zero time replaces earlier assignments.
+func (db *StopwatchDB) SaveTaskFrom(task *model.Task, from time.Time) error {
 	if db.IsOpen() == false {
 		return errors.New("database not ready")
 	}
 
-	return db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(task.GroupID))
-		if b == nil {
-			return errors.New("group not found")
+	return db.undoable(AuditSaveTask, func(tx kvTx) error {
+		before, _ := getTask(tx, task.GroupID, task.ID)
+
+		// Tasks keep codes that were accepted when they were set.
+		if before == nil || before.CostCode != task.CostCode {
+			if err := db.checkCostCode(tx, task.CostCode); err != nil {
+				return err
+			}
+
+			if before == nil {
+				task.CostCodes = nil
+			} else {
+				code := task.CostCode
+				task.CostCode, task.CostCodes = before.CostCode, before.CostCodes
+				assignCostCode(task, code, from)
+			}
 		}
 
-		buf, _ := json.Marshal(task)
-		return b.Put(Itob(task.ID), buf)
+		if err := putTask(tx, task); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditSaveTask, task.GroupID, task.ID, before, task)
 	})
 }
 
@@ -280,31 +786,47 @@ func (db *StopwatchDB) SaveGroup(group *model.Group) error {
 		return errors.New("database not ready")
 	}
 
-	return db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(BucketGroups))
-		buf, _ := json.Marshal(group)
-		return b.Put(Itob(group.ID), buf)
+	return db.undoable(AuditSaveGroup, func(tx kvTx) error {
+		before, _ := getGroup(tx, group.ID)
+		if err := putGroup(tx, group); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditSaveGroup, group.ID, 0, before, group)
 	})
 }
 
-// GetActiveTask returns currently active task, if one is set
+// GetActiveTask returns currently active task, if one is set. If several tasks
+// are active, the most recently started one is returned.
 func (db *StopwatchDB) GetActiveTask() (*model.Task, error) {
-	if db.IsOpen() == false {
-		return nil, errors.New("database not ready")
+	tasks, err := db.GetActiveTasks()
+	if err != nil || len(tasks) == 0 {
+		return nil, err
 	}
 
-	var at model.ActiveTask
+	return tasks[len(tasks)-1], nil
+}
 
-	if err := db.db.View(func(tx *bolt.Tx) error {
-		bs := tx.Bucket([]byte(BucketState))
-		buf := bs.Get([]byte("activeTask"))
+// GetActiveTasks returns all active tasks in the order they were started.
+func (db *StopwatchDB) GetActiveTasks() ([]*model.Task, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
 
-		if buf == nil {
-			return nil
+	res := []*model.Task{}
+	if err := db.db.View(func(tx kvTx) error {
+		active, err := getActiveTasks(tx)
+		if err != nil {
+			return err
 		}
 
-		if err := json.Unmarshal(buf, &at); err != nil {
-			return err
+		log.Printf("getactive: %+v", active)
+		for _, at := range active {
+			t, err := getTask(tx, at.GroupID, at.TaskID)
+			if err != nil {
+				return err
+			}
+			res = append(res, t)
 		}
 
 		return nil
@@ -312,46 +834,78 @@ func (db *StopwatchDB) GetActiveTask() (*model.Task, error) {
 		return nil, err
 	}
 
-	log.Printf("getactive: %+v", at)
-	if at.GroupID == 0 && at.TaskID == 0 {
-		return nil, nil
-	}
-
-	return db.GetTask(at.GroupID, at.TaskID)
+	return res, nil
 }
 
-// SetActiveTask sets currently active task, if one is set
+// SetActiveTask sets currently active task, replacing all active tasks. Zero
+// IDs clear the active tasks.
 func (db *StopwatchDB) SetActiveTask(group, task int) error {
 	if db.IsOpen() == false {
 		return errors.New("database not ready")
 	}
 
-	return db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(BucketState))
+	return db.db.Update(func(tx kvTx) error {
+		active := []model.ActiveTask{}
+		if group != 0 || task != 0 {
+			active = append(active, model.ActiveTask{GroupID: group, TaskID: task})
+		}
 
-		at := model.ActiveTask{GroupID: group, TaskID: task}
-		buf, err := json.Marshal(at)
+		before, err := getActiveTasks(tx)
 		if err != nil {
 			return err
 		}
 
-		log.Printf("setactive: %+v", at)
-		return b.Put([]byte("activeTask"), buf)
+		log.Printf("setactive: %+v", active)
+		if err = putActiveTasks(tx, active); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditSetActive, group, task, before, active)
 	})
 }
 
-// ReadGroups returns all groups
-func (db *StopwatchDB) ReadGroups() ([]model.Group, error) {
+// getActiveTasks reads the active tasks within a transaction.
+func getActiveTasks(tx kvTx) ([]model.ActiveTask, error) {
+	active := []model.ActiveTask{}
+
+	buf := tx.Bucket([]byte(BucketState)).Get([]byte(keyActiveTasks))
+	if buf == nil {
+		return active, nil
+	}
+
+	err := json.Unmarshal(buf, &active)
+	return active, err
+}
+
+// putActiveTasks writes the active tasks within a transaction.
+func putActiveTasks(tx kvTx, active []model.ActiveTask) error {
+	buf, err := json.Marshal(active)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(BucketState)).Put([]byte(keyActiveTasks), buf)
+}
+
+// ReadGroups returns all groups. Archived groups are included only if archived
+// is true.
+func (db *StopwatchDB) ReadGroups(archived bool) ([]model.Group, error) {
 	if db.IsOpen() == false {
 		return nil, errors.New("database not ready")
 	}
 
 	res := []model.Group{}
 
-	db.db.View(func(tx *bolt.Tx) error {
+	db.db.View(func(tx kvTx) error {
 		return tx.Bucket([]byte(BucketGroups)).ForEach(func(k []byte, v []byte) error {
 			var p model.Group
-			json.Unmarshal(v, &p)
+			if err := json.Unmarshal(v, &p); err != nil {
+				log.Printf("skipping unreadable group %d: %s", Btoi(k), err)
+				return nil
+			}
+			if p.Archived && !archived {
+				return nil
+			}
 			res = append(res, p)
 			return nil
 		})
@@ -368,7 +922,7 @@ func (db *StopwatchDB) ReadTask(group, task int) (*model.Task, error) {
 
 	var res model.Task
 
-	if err := db.db.View(func(tx *bolt.Tx) error {
+	if err := db.db.View(func(tx kvTx) error {
 		b := tx.Bucket([]byte(BucketTasks))
 		bg := b.Bucket(Itob(group))
 		if bg == nil {
@@ -388,15 +942,16 @@ func (db *StopwatchDB) ReadTask(group, task int) (*model.Task, error) {
 	return &res, nil
 }
 
-// ReadTasks return all tasks for a group
-func (db *StopwatchDB) ReadTasks(group int) ([]*model.Task, error) {
+// ReadTasks return all tasks for a group. Archived tasks are included only if
+// archived is true.
+func (db *StopwatchDB) ReadTasks(group int, archived bool) ([]*model.Task, error) {
 	if db.IsOpen() == false {
 		return nil, errors.New("database not ready")
 	}
 
 	res := []*model.Task{}
 
-	if err := db.db.View(func(tx *bolt.Tx) error {
+	if err := db.db.View(func(tx kvTx) error {
 		b := tx.Bucket([]byte(BucketTasks))
 		bg := b.Bucket(Itob(group))
 		if bg == nil {
@@ -405,7 +960,13 @@ func (db *StopwatchDB) ReadTasks(group int) ([]*model.Task, error) {
 
 		return bg.ForEach(func(k []byte, v []byte) error {
 			var t model.Task
-			json.Unmarshal(v, &t)
+			if err := json.Unmarshal(v, &t); err != nil {
+				log.Printf("skipping unreadable task %d:%d: %s", group, Btoi(k), err)
+				return nil
+			}
+			if t.Archived && !archived {
+				return nil
+			}
 			res = append(res, &t)
 			return nil
 		})
@@ -422,26 +983,33 @@ func (db *StopwatchDB) SaveHistory(history []model.HistoryTask) error {
 		return errors.New("database not ready")
 	}
 
-	return db.db.Update(func(tx *bolt.Tx) error {
+	return db.db.Update(func(tx kvTx) error {
 		b := tx.Bucket([]byte(BucketHistory))
 		buf, err := json.Marshal(history)
 		if err != nil {
 			return err
 		}
 
+		before := append(json.RawMessage{}, b.Get([]byte("usage"))...)
+
 		log.Printf("writing usage: %s", string(buf))
-		return b.Put([]byte("usage"), buf)
+		if err = b.Put([]byte("usage"), buf); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditSaveHistory, 0, 0, before, history)
 	})
 }
 
-// ReadHistory returns last known task usage history
-func (db *StopwatchDB) ReadHistory() ([]model.Task, error) {
+// ReadHistory returns last known task usage history. Archived tasks and tasks
+// of archived groups are included only if archived is true.
+func (db *StopwatchDB) ReadHistory(archived bool) ([]model.Task, error) {
 	if db.IsOpen() == false {
 		return nil, errors.New("database not ready")
 	}
 
 	var history []model.HistoryTask
-	if err := db.db.View(func(tx *bolt.Tx) error {
+	if err := db.db.View(func(tx kvTx) error {
 		b := tx.Bucket([]byte(BucketHistory))
 		buf := b.Get([]byte("usage"))
 		if buf != nil {
@@ -459,15 +1027,62 @@ func (db *StopwatchDB) ReadHistory() ([]model.Task, error) {
 	res := []model.Task{}
 	for _, ht := range history {
 		t, err := db.GetTask(ht.GroupID, ht.ID)
-		if err == nil {
-			res = append(res, *t)
+		if err != nil {
+			continue
 		}
+
+		if !archived {
+			if t.Archived {
+				continue
+			}
+
+			if g, err := db.GetGroup(t.GroupID); err != nil || g.Archived {
+				continue
+			}
+		}
+
+		res = append(res, *t)
 	}
 
 	return res, nil
 }
 
-// Open opens a database and initializes it
+// SetAutoMigrate enables or disables running pending schema migrations when
+// the database is opened. Enabled by default.
+func (db *StopwatchDB) SetAutoMigrate(enabled bool) {
+	db.noMigrate = !enabled
+}
+
+// SetLocation sets the time zone used for splitting slices at midnight and for
+// dividing reports into dates. Defaults to UTC.
+func (db *StopwatchDB) SetLocation(loc *time.Location) {
+	db.loc = loc
+}
+
+// Location returns the time zone used for splitting slices and reports.
+func (db *StopwatchDB) Location() *time.Location {
+	if db.loc == nil {
+		return time.UTC
+	}
+
+	return db.loc
+}
+
+// SetMultiTimer enables or disables running several tasks at the same time.
+// When disabled, starting a task with SwitchTask stops all other active tasks.
+func (db *StopwatchDB) SetMultiTimer(enabled bool) {
+	db.multi = enabled
+}
+
+// SetParallelMode sets how time of tasks running at the same time is counted
+// in usage reports. Defaults to ParallelFull.
+func (db *StopwatchDB) SetParallelMode(mode ParallelMode) {
+	db.parallel = mode
+}
+
+// Open opens a database and initializes it. Pending schema migrations are run
+// unless disabled with SetAutoMigrate, and a snapshot is taken if automatic
+// backups are enabled.
 func (db *StopwatchDB) Open(path string) error {
 	var err error
 
@@ -477,31 +1092,58 @@ func (db *StopwatchDB) Open(path string) error {
 	}
 
 	// Open and create if missing.
-	if db.db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second}); err != nil {
+	if db.memory {
+		db.db = newMemStore()
+	} else if db.db, err = openBolt(path); err != nil {
 		return err
 	}
+	db.path = path
 
-	// Then create missing buckets.
+	// Then create missing buckets. A database without state is a new one, and
+	// gets stamped with the latest schema version directly.
 	Buckets := []string{
 		BucketState,
 		BucketTasks,
 		BucketSlices,
 		BucketGroups,
 		BucketHistory,
+		BucketAudit,
+		BucketUndo,
+		BucketCostCodes,
 	}
-	for _, Bucket := range Buckets {
-		if err = db.db.Update(func(tx *bolt.Tx) error {
-			_, err = tx.CreateBucketIfNotExists([]byte(Bucket))
-			if err != nil {
+	if err = db.db.Update(func(tx kvTx) error {
+		isNew := tx.Bucket([]byte(BucketState)) == nil
+
+		for _, Bucket := range Buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(Bucket)); err != nil {
 				return fmt.Errorf("create Bucket '%s' failed: %s", Bucket, err)
 			}
-			return nil
+		}
 
-		}); err != nil {
+		if isNew {
+			return putVersion(tx, LatestSchemaVersion())
+		}
+
+		return nil
+	}); err != nil {
+		db.Close()
+		return err
+	}
+
+	if !db.noMigrate {
+		if _, err = db.Migrate(); err != nil {
+			db.Close()
 			return err
 		}
 	}
 
+	// A failed snapshot doesn't prevent using the database.
+	if db.autoBackup {
+		if _, err = db.Backup(BackupOpen); err != nil {
+			log.Printf("unable to back up database: %s", err)
+		}
+	}
+
 	return nil
 }
 
@@ -512,6 +1154,7 @@ func (db *StopwatchDB) Close() error {
 	if db.db != nil {
 		err = db.db.Close()
 		db.db = nil
+		db.path = ""
 	}
 
 	return err
@@ -523,3 +1166,8 @@ func Itob(v int) []byte {
 	binary.BigEndian.PutUint64(b, uint64(v))
 	return b
 }
+
+// Btoi returns the integer value of an 8-byte big endian representation.
+func Btoi(b []byte) int {
+	return int(binary.BigEndian.Uint64(b))
+}
@@ -0,0 +1,220 @@
+package stopwatchdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// openTestDB opens a new database in a temporary directory. The returned
+// function closes the database and removes the directory.
+func openTestDB(t *testing.T) (*StopwatchDB, func()) {
+	dir, err := ioutil.TempDir("", "stopwatchdb")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+
+	db := New()
+	if err = db.Open(filepath.Join(dir, "data.dat")); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Unable to open database: %s", err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSwitchTask(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	a, _ := db.AddTask(g.ID, "a", "code")
+	b, _ := db.AddTask(g.ID, "b", "code")
+
+	if _, err := db.SwitchTask(g.ID, a.ID); err != nil {
+		t.Fatalf("Unable to start a: %s", err)
+	}
+
+	started, err := db.SwitchTask(g.ID, b.ID)
+	if err != nil {
+		t.Fatalf("Unable to switch to b: %s", err)
+	}
+
+	if at, _ := db.GetActiveTask(); at == nil || at.ID != b.ID || at.Running == nil {
+		t.Fatalf("Wrong active task after switch: %+v", at)
+	}
+
+	// Switching to the running task keeps it running.
+	if again, err := db.SwitchTask(g.ID, b.ID); err != nil || !again.Running.Equal(*started.Running) {
+		t.Errorf("Switching to running task restarted it: %+v, %v", again, err)
+	}
+
+	if a, _ = db.GetTask(g.ID, a.ID); a.Running != nil {
+		t.Errorf("Previous task still running: %+v", a)
+	}
+
+	now := time.Now()
+	res, err := db.GetSlices(g.ID, now.AddDate(0, 0, -1), now.AddDate(0, 0, 1))
+	if err != nil || len(res) != 1 || res[0].ID != a.ID || len(res[0].Slices) != 1 {
+		t.Fatalf("Expected one closed slice for a, got %+v, %v", res, err)
+	}
+
+	if end := res[0].Slices[0].End; !end.Equal(*started.Running) {
+		t.Errorf("Previous task stopped at %s, next started at %s", end, started.Running)
+	}
+
+	if _, err = db.StopTask(g.ID, b.ID); err != nil {
+		t.Fatalf("Unable to stop b: %s", err)
+	}
+
+	if at, _ := db.GetActiveTask(); at != nil {
+		t.Errorf("Active task not cleared on stop: %+v", at)
+	}
+}
+
+func TestDeleteCascade(t *testing.T) {
+	testBackends(t, func(t *testing.T, s Store) {
+		db := s.(*StopwatchDB)
+		db.SetMultiTimer(true)
+
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		b, _ := db.AddTask(g.ID, "b", "code")
+		other, _ := db.AddGroup("other")
+		c, _ := db.AddTask(other.ID, "c", "code")
+
+		start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		for _, task := range []*model.Task{a, b, c} {
+			db.SetSlice(task.GroupID, task.ID, start, start.Add(time.Hour))
+			db.SwitchTask(task.GroupID, task.ID)
+		}
+		db.SaveHistory([]model.HistoryTask{{GroupID: g.ID, ID: a.ID}, {GroupID: g.ID, ID: b.ID}, {GroupID: other.ID, ID: c.ID}})
+
+		// stored tells if the task record and its slice bucket exist, and if the
+		// task is in the history and active.
+		stored := func(task *model.Task) (record, slices, history, active bool) {
+			db.db.View(func(tx kvTx) error {
+				if bt := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(task.GroupID)); bt != nil {
+					record = bt.Get(Itob(task.ID)) != nil
+				}
+				slices = tx.Bucket([]byte(BucketSlices)).Bucket(sliceBucketID(task.GroupID, task.ID)) != nil
+				return nil
+			})
+
+			hist, _ := db.ReadHistory(true)
+			for _, h := range hist {
+				history = history || h.GroupID == task.GroupID && h.ID == task.ID
+			}
+			at, _ := db.GetActiveTasks()
+			for _, r := range at {
+				active = active || r.GroupID == task.GroupID && r.ID == task.ID
+			}
+			return
+		}
+
+		if err := db.DeleteTask(g.ID, a.ID); err != nil {
+			t.Fatalf("Unable to delete task: %s", err)
+		}
+		if record, slices, history, active := stored(a); record || slices || history || active {
+			t.Errorf("Deleted task left behind: record %v, slices %v, history %v, active %v", record, slices, history, active)
+		}
+		if record, slices, history, active := stored(b); !record || !slices || !history || !active {
+			t.Errorf("Other task of group changed: record %v, slices %v, history %v, active %v", record, slices, history, active)
+		}
+
+		if err := db.DeleteGroup(g.ID); err != nil {
+			t.Fatalf("Unable to delete group: %s", err)
+		}
+		if record, slices, history, active := stored(b); record || slices || history || active {
+			t.Errorf("Task of deleted group left behind: record %v, slices %v, history %v, active %v", record, slices, history, active)
+		}
+		db.db.View(func(tx kvTx) error {
+			if tx.Bucket([]byte(BucketTasks)).Bucket(Itob(g.ID)) != nil {
+				t.Errorf("Tasks bucket of deleted group left behind")
+			}
+			return nil
+		})
+
+		// Other groups are untouched.
+		if record, slices, history, active := stored(c); !record || !slices || !history || !active {
+			t.Errorf("Task of other group changed: record %v, slices %v, history %v, active %v", record, slices, history, active)
+		}
+		if c, _ = db.GetTask(other.ID, c.ID); c.Used.Duration != time.Hour {
+			t.Errorf("Time of other group changed: %s", c.Used)
+		}
+		if rep, _ := db.Check(); len(rep.Problems) != 0 {
+			t.Errorf("Problems after delete: %+v", rep.Problems)
+		}
+	})
+}
+
+func TestArchive(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		b, _ := db.AddTask(g.ID, "b", "code")
+
+		start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+		db.SaveHistory([]model.HistoryTask{{GroupID: g.ID, ID: a.ID}, {GroupID: g.ID, ID: b.ID}})
+
+		// Running tasks can't be archived.
+		db.StartTask(g.ID, a.ID)
+		if _, err := db.SetTaskArchived(g.ID, a.ID, true); err == nil {
+			t.Errorf("Archived a running task")
+		}
+		if _, err := db.SetGroupArchived(g.ID, true); err == nil {
+			t.Errorf("Archived a group with a running task")
+		}
+		db.StopTask(g.ID, a.ID)
+
+		if _, err := db.SetTaskArchived(g.ID, a.ID, true); err != nil {
+			t.Fatalf("Unable to archive task: %s", err)
+		}
+		if tasks, _ := db.ReadTasks(g.ID, true); len(tasks) != 2 {
+			t.Errorf("Archived task not listed with archived: %+v", tasks)
+		}
+		if hist, _ := db.ReadHistory(false); len(hist) != 1 || hist[0].ID != b.ID {
+			t.Errorf("Archived task in history: %+v", hist)
+		}
+		if hist, _ := db.ReadHistory(true); len(hist) != 2 {
+			t.Errorf("Archived task not in history with archived: %+v", hist)
+		}
+
+		// Archived groups hide their tasks from the history, and their tasks
+		// can't be started.
+		if _, err := db.SetGroupArchived(g.ID, true); err != nil {
+			t.Fatalf("Unable to archive group: %s", err)
+		}
+		if groups, _ := db.ReadGroups(false); len(groups) != 0 {
+			t.Errorf("Archived group listed: %+v", groups)
+		}
+		if groups, _ := db.ReadGroups(true); len(groups) != 1 {
+			t.Errorf("Archived group not listed with archived: %+v", groups)
+		}
+		if hist, _ := db.ReadHistory(false); len(hist) != 0 {
+			t.Errorf("Task of archived group in history: %+v", hist)
+		}
+		if _, err := db.StartTask(g.ID, b.ID); err == nil {
+			t.Errorf("Started a task of an archived group")
+		}
+
+		// Slices still count in reports.
+		if rep, _ := db.GetUsage(g.ID, start, start); rep == nil || rep.Combined.Duration != time.Hour {
+			t.Errorf("Archived slices not in usage: %+v", rep)
+		}
+
+		db.SetGroupArchived(g.ID, false)
+		db.SetTaskArchived(g.ID, a.ID, false)
+		if _, err := db.StartTask(g.ID, a.ID); err != nil {
+			t.Errorf("Unable to start restored task: %s", err)
+		}
+	})
+}
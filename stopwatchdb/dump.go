@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
-	"github.com/boltdb/bolt"
 	model "github.com/msepp/stopwatch/stopwatchmodel"
 )
 
@@ -34,6 +35,10 @@ type UsageReport struct {
 	CostCodes []CostUsage
 	// Combined is the combined total time used
 	Combined model.TaskDuration
+	// Billable is the time used on billable tasks
+	Billable model.TaskDuration
+	// NonBillable is the time used on non-billable tasks
+	NonBillable model.TaskDuration
 }
 
 // TaskSlices reports a single tasks slices
@@ -42,6 +47,8 @@ type TaskSlices struct {
 	Name string
 	// ID is task ID
 	ID int
+	// CostCode of the task. Slices have the code valid at their start.
+	CostCode string
 	// Slices are tasks slices
 	Slices []Slice
 }
@@ -50,97 +57,303 @@ type TaskSlices struct {
 type Slice struct {
 	Start time.Time
 	End   time.Time
+	// Review is set when the slice was ended automatically and should be
+	// checked. Cleared when the slice is set.
+	Review bool
+	// Note describes the work done during the slice
+	Note string `json:",omitempty"`
+	// CostCode of the task at the slice start. Only set by GetSlices.
+	CostCode string `json:",omitempty"`
 }
 
 // SetSlice sets a slice for a task in a group and updates time used for the
-// task. Overwrites if a slice exists with the given start time.
+// task. Overwrites if a slice exists with the given start time, clearing its
+// review flag.
 // Returns updated task on success
 func (db *StopwatchDB) SetSlice(groupID, taskID int, start, end time.Time) (*model.Task, error) {
-	var err error
-	var oldDuration time.Duration
 	var t *model.Task
 
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
 	if start.After(end) {
 		return nil, errors.New("start must be before end")
 	}
 
-	// get task
-	if t, err = db.GetTask(groupID, taskID); err != nil {
+	if err := db.undoable(AuditSetSlice, func(tx kvTx) error {
+		var err error
+		var before *Slice
+		var after Slice
+		if t, before, after, err = setSlice(tx, groupID, taskID, start, end); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditSetSlice, groupID, taskID, before, after)
+	}); err != nil {
 		return nil, err
 	}
 
+	return t, nil
+}
+
+// setSlice writes a slice and updates time used for the task. Returns the
+// updated task, and the slice before and after the write.
+func setSlice(tx kvTx, groupID, taskID int, start, end time.Time) (*model.Task, *Slice, Slice, error) {
 	start = start.UTC()
 	end = end.UTC()
 
-	if err = db.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(BucketSlices))
-		bs := b.Bucket(bytes.Join([][]byte{
-			Itob(groupID),
-			Itob(taskID)},
-			[]byte("-"),
-		))
+	// get task
+	t, err := getTask(tx, groupID, taskID)
+	if err != nil {
+		return nil, nil, Slice{}, err
+	}
 
-		// Get existing value first.
-		buf := bs.Get([]byte(start.Format(time.RFC3339)))
-		if buf != nil {
-			oldEnd, _ := time.Parse(time.RFC3339, string(buf))
-			oldDuration = oldEnd.Sub(start)
+	b := tx.Bucket([]byte(BucketSlices))
+	bs := b.Bucket(sliceBucketID(groupID, taskID))
+	if bs == nil {
+		return nil, nil, Slice{}, errors.New("task not found")
+	}
+
+	// Get existing value first. Metadata of an existing slice is kept.
+	var r sliceRecord
+	var before *Slice
+	var oldDuration time.Duration
+	if buf := bs.Get(sliceKey(start)); buf != nil {
+		if r, err = decodeSlice(buf); err != nil {
+			return nil, nil, Slice{}, err
 		}
 
-		return bs.Put([]byte(start.Format(time.RFC3339)), []byte(end.Format(time.RFC3339)))
-	}); err != nil {
-		return nil, err
+		if !r.Open() {
+			oldDuration = r.End.Sub(start)
+		}
+
+		old := sliceFromRecord(start, r)
+		before = &old
+	}
+
+	r.End = end
+	r.Flags &^= sliceFlagReview
+	if err = bs.Put(sliceKey(start), encodeSlice(r)); err != nil {
+		return nil, nil, Slice{}, err
 	}
 
 	// Update task time used.
 	t.Used.Duration = t.Used.Duration - oldDuration
 	t.Used.Add(end.Sub(start))
+	if err = putTask(tx, t); err != nil {
+		return nil, nil, Slice{}, err
+	}
+
+	return t, before, sliceFromRecord(start, r), nil
+}
+
+// SetSliceNote sets the note of a recorded slice. An empty note removes it.
+// Returns the updated slice.
+func (db *StopwatchDB) SetSliceNote(groupID, taskID int, start time.Time, note string) (*Slice, error) {
+	var s Slice
+
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	if err := db.undoable(AuditSetSliceNote, func(tx kvTx) error {
+		var err error
+		var before Slice
+		if before, s, err = setSliceNote(tx, groupID, taskID, start, note); err != nil {
+			return err
+		}
 
-	if err = db.SaveTask(t); err != nil {
+		return db.audit(tx, AuditSetSliceNote, groupID, taskID, before, s)
+	}); err != nil {
 		return nil, err
 	}
 
-	return t, nil
+	return &s, nil
+}
+
+// setSliceNote writes the note of a recorded slice. Returns the slice before
+// and after the write.
+func setSliceNote(tx kvTx, groupID, taskID int, start time.Time, note string) (Slice, Slice, error) {
+	start = start.UTC()
+
+	if _, err := getTask(tx, groupID, taskID); err != nil {
+		return Slice{}, Slice{}, err
+	}
+
+	bs := tx.Bucket([]byte(BucketSlices)).Bucket(sliceBucketID(groupID, taskID))
+	if bs == nil {
+		return Slice{}, Slice{}, errors.New("task not found")
+	}
+
+	buf := bs.Get(sliceKey(start))
+	if buf == nil {
+		return Slice{}, Slice{}, errSliceNotFound
+	}
+
+	r, err := decodeSlice(buf)
+	if err != nil {
+		return Slice{}, Slice{}, err
+	}
+
+	before := sliceFromRecord(start, r)
+	if err = r.SetNote(note); err != nil {
+		return Slice{}, Slice{}, err
+	}
+
+	if err = bs.Put(sliceKey(start), encodeSlice(r)); err != nil {
+		return Slice{}, Slice{}, err
+	}
+
+	return before, sliceFromRecord(start, r), nil
+}
+
+// ImportSlice is a slice added by ImportSlices. Groups and tasks with a zero ID
+// are added by name, once for each name.
+type ImportSlice struct {
+	GroupID  int
+	Group    string
+	TaskID   int
+	Task     string
+	CostCode string
+	Start    time.Time
+	End      time.Time
+	Note     string
+}
+
+// ImportSlices adds slices, and the groups and tasks they belong to, as a
+// single undoable change. Nothing is written if any of them fails. Returns the
+// slices with group and task IDs set.
+func (db *StopwatchDB) ImportSlices(slices []ImportSlice) ([]ImportSlice, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	type taskKey struct {
+		group int
+		name  string
+	}
+
+	res := make([]ImportSlice, len(slices))
+	copy(res, slices)
+
+	if err := db.undoable(AuditImportSlices, func(tx kvTx) error {
+		groups := map[string]int{}
+		tasks := map[taskKey]int{}
+
+		for i := range res {
+			s := &res[i]
+			if !s.End.After(s.Start) {
+				return fmt.Errorf("slice of '%s' at %s ends before it starts", s.Task, s.Start)
+			}
+
+			if s.GroupID == 0 {
+				if s.GroupID = groups[s.Group]; s.GroupID == 0 {
+					g := &model.Group{Name: s.Group}
+					if err := addGroup(tx, g); err != nil {
+						return fmt.Errorf("unable to add group '%s': %s", s.Group, err)
+					}
+					if err := db.audit(tx, AuditAddGroup, g.ID, 0, nil, g); err != nil {
+						return err
+					}
+					s.GroupID, groups[s.Group] = g.ID, g.ID
+				}
+			}
+
+			if s.TaskID == 0 {
+				key := taskKey{s.GroupID, s.Task}
+				if s.TaskID = tasks[key]; s.TaskID == 0 {
+					if err := db.checkCostCode(tx, s.CostCode); err != nil {
+						return fmt.Errorf("unable to add task '%s': %s", s.Task, err)
+					}
+					t := model.NewTask(s.GroupID, s.Task, s.CostCode)
+					if err := addTask(tx, t); err != nil {
+						return fmt.Errorf("unable to add task '%s': %s", s.Task, err)
+					}
+					if err := db.audit(tx, AuditAddTask, t.GroupID, t.ID, nil, t); err != nil {
+						return err
+					}
+					s.TaskID, tasks[key] = t.ID, t.ID
+				}
+			}
+
+			_, before, after, err := setSlice(tx, s.GroupID, s.TaskID, s.Start, s.End)
+			if err != nil {
+				return fmt.Errorf("unable to add slice of '%s' at %s: %s", s.Task, s.Start, err)
+			}
+			if err = db.audit(tx, AuditSetSlice, s.GroupID, s.TaskID, before, after); err != nil {
+				return err
+			}
+
+			if s.Note == "" {
+				continue
+			}
+			noteBefore, noteAfter, err := setSliceNote(tx, s.GroupID, s.TaskID, s.Start, s.Note)
+			if err != nil {
+				return fmt.Errorf("unable to set note of '%s' at %s: %s", s.Task, s.Start, err)
+			}
+			if err = db.audit(tx, AuditSetSliceNote, s.GroupID, s.TaskID, noteBefore, noteAfter); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return res, nil
 }
 
 // RemoveSlice deletes a slice from task. Task time used is updated to reflect
 // the change. Returns changed Task on success.
 func (db *StopwatchDB) RemoveSlice(groupID, taskID int, start time.Time) (*model.Task, error) {
-	var err error
-	var oldDuration time.Duration
 	var t *model.Task
 
-	// get task
-	if t, err = db.GetTask(groupID, taskID); err != nil {
-		return nil, err
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
 	}
 
 	start = start.UTC()
-	if err = db.db.Update(func(tx *bolt.Tx) error {
+	if err := db.undoable(AuditRemoveSlice, func(tx kvTx) error {
+		var err error
+
+		// get task
+		if t, err = getTask(tx, groupID, taskID); err != nil {
+			return err
+		}
+
 		b := tx.Bucket([]byte(BucketSlices))
-		bs := b.Bucket(bytes.Join([][]byte{
-			Itob(groupID),
-			Itob(taskID)},
-			[]byte("-"),
-		))
+		bs := b.Bucket(sliceBucketID(groupID, taskID))
+		if bs == nil {
+			return errors.New("task not found")
+		}
 
 		// Get existing value first.
-		buf := bs.Get([]byte(start.Format(time.RFC3339)))
-		if buf != nil {
-			oldEnd, _ := time.Parse(time.RFC3339, string(buf))
-			oldDuration = oldEnd.Sub(start)
-		} else {
-			return errors.New("slice not found")
+		buf := bs.Get(sliceKey(start))
+		if buf == nil {
+			return errSliceNotFound
 		}
 
-		return bs.Delete([]byte(start.Format(time.RFC3339)))
-	}); err != nil {
-		return nil, err
-	}
+		r, err := decodeSlice(buf)
+		if err != nil {
+			return err
+		}
 
-	// Update task time used.
-	t.Used.Duration = t.Used.Duration - oldDuration
-	if err = db.SaveTask(t); err != nil {
+		if err = bs.Delete(sliceKey(start)); err != nil {
+			return err
+		}
+
+		// Update task time used.
+		if !r.Open() {
+			t.Used.Duration = t.Used.Duration - r.End.Sub(start)
+			if err = putTask(tx, t); err != nil {
+				return err
+			}
+		}
+
+		return db.audit(tx, AuditRemoveSlice, groupID, taskID, sliceFromRecord(start, r), nil)
+	}); err != nil {
 		return nil, err
 	}
 
@@ -153,14 +366,11 @@ func (db *StopwatchDB) GetSlices(group int, start, end time.Time) ([]TaskSlices,
 	slices := []TaskSlices{}
 	tasks := []*model.Task{}
 
-	// Normalize dates to begin of start date and end of end date.
-	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
-	end = time.Date(end.Year(), end.Month(), end.Day()+1, 0, 0, 0, 0, end.Location())
-	end = end.Add(-1 * time.Second)
-
-	// Handle in UTC
-	start = start.UTC()
-	end = end.UTC()
+	// Normalize dates to begin of start date and begin of the date after end
+	// date in the reporting time zone.
+	loc := db.Location()
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	end = time.Date(end.Year(), end.Month(), end.Day()+1, 0, 0, 0, 0, loc)
 
 	// Check order
 	if start.Equal(end) || start.After(end) {
@@ -168,7 +378,7 @@ func (db *StopwatchDB) GetSlices(group int, start, end time.Time) ([]TaskSlices,
 	}
 
 	// open group tasks
-	if err := db.db.View(func(tx *bolt.Tx) error {
+	if err := db.db.View(func(tx kvTx) error {
 		b := tx.Bucket([]byte(BucketTasks))
 		bg := b.Bucket(Itob(group))
 		if bg == nil {
@@ -185,25 +395,21 @@ func (db *StopwatchDB) GetSlices(group int, start, end time.Time) ([]TaskSlices,
 		return nil, err
 	}
 
-	// Minimum and maximum timestamps.
-	min := []byte(start.Format(time.RFC3339))
-	max := []byte(end.Format(time.RFC3339))
+	// Minimum and maximum slice keys.
+	min := sliceKey(start)
+	max := sliceKey(end)
 
 	// Go through each task, day by day.
 	for _, task := range tasks {
-		if err := db.db.View(func(tx *bolt.Tx) error {
+		if err := db.db.View(func(tx kvTx) error {
 			b := tx.Bucket([]byte(BucketSlices))
-			bs := b.Bucket(bytes.Join([][]byte{
-				Itob(task.GroupID),
-				Itob(task.ID)},
-				[]byte("-"),
-			))
+			bs := b.Bucket(sliceBucketID(task.GroupID, task.ID))
 			if bs == nil {
 				log.Printf("Unable to find slices for task %d:%s", task.ID, task.Name)
 				return nil
 			}
 
-			ts := TaskSlices{Name: task.Name, ID: task.ID, Slices: []Slice{}}
+			ts := TaskSlices{Name: task.Name, ID: task.ID, CostCode: task.CostCode, Slices: []Slice{}}
 
 			// Seek to start date
 			c := bs.Cursor()
@@ -212,13 +418,18 @@ func (db *StopwatchDB) GetSlices(group int, start, end time.Time) ([]TaskSlices,
 					continue
 				}
 
-				s, _ := time.Parse(time.RFC3339, string(k))
-				e, _ := time.Parse(time.RFC3339, string(v))
-				if e.IsZero() {
+				s, r, err := decodeSliceEntry(k, v)
+				if err != nil {
+					return fmt.Errorf("task %d:%s has an invalid slice: %s", task.ID, task.Name, err)
+				}
+
+				if r.Open() {
 					continue
 				}
 
-				ts.Slices = append(ts.Slices, Slice{Start: s, End: e})
+				slice := sliceFromRecord(s, r)
+				slice.CostCode = task.CostCodeAt(s)
+				ts.Slices = append(ts.Slices, slice)
 			}
 
 			if len(ts.Slices) > 0 {
@@ -236,69 +447,96 @@ func (db *StopwatchDB) GetSlices(group int, start, end time.Time) ([]TaskSlices,
 }
 
 // GetUsage returns a report of time used for a group during given period of time.
+// Time of tasks in groups below the group is rolled up into the report, and
+// each slice is counted for the cost code of its task at the slice start. Time
+// of tasks running in parallel is counted as set with SetParallelMode.
 func (db *StopwatchDB) GetUsage(group int, start, end time.Time) (*UsageReport, error) {
+	return db.usage(group, start, end, func(t *model.Task, at time.Time) []string {
+		return []string{t.CostCodeAt(at)}
+	})
+}
+
+// usage returns a report of time used for a group and the groups below it,
+// with time of each slice counted for the keys returned by keys for its task
+// and start time. Slices without keys are left out. Keys are reported in the
+// CostCodes of the report.
+func (db *StopwatchDB) usage(group int, start, end time.Time, keys func(t *model.Task, at time.Time) []string) (*UsageReport, error) {
 	daily := map[string]map[string]model.TaskDuration{}
 	total := map[string]model.TaskDuration{}
 	dates := []Usage{}
 	combined := model.TaskDuration{}
+	billable := model.TaskDuration{}
+	nonBillable := model.TaskDuration{}
 
 	tasks := []*model.Task{}
 
-	// Normalize dates to begin of start date and end of end date.
-	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
-	end = time.Date(end.Year(), end.Month(), end.Day()+1, 0, 0, 0, 0, end.Location())
-	end = end.Add(-1 * time.Second)
-
-	// Handle in UTC
-	start = start.UTC()
-	end = end.UTC()
+	// Normalize dates to begin of start date and begin of the date after end
+	// date in the reporting time zone.
+	loc := db.Location()
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	end = time.Date(end.Year(), end.Month(), end.Day()+1, 0, 0, 0, 0, loc)
 
 	// Check order
 	if start.Equal(end) || start.After(end) {
 		return nil, errors.New("start must be a time before end.")
 	}
 
-	// open group tasks
-	if err := db.db.View(func(tx *bolt.Tx) error {
+	// open tasks of the group and its descendants
+	if err := db.db.View(func(tx kvTx) error {
 		b := tx.Bucket([]byte(BucketTasks))
-		bg := b.Bucket(Itob(group))
-		if bg == nil {
+		if b.Bucket(Itob(group)) == nil {
 			return errors.New("group not found")
 		}
 
-		return bg.ForEach(func(k []byte, v []byte) error {
-			var t model.Task
-			json.Unmarshal(v, &t)
-			tasks = append(tasks, &t)
-			return nil
-		})
+		groups, err := groupSubtree(tx, group)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range groups {
+			bg := b.Bucket(Itob(id))
+			if bg == nil {
+				continue
+			}
+
+			if err := bg.ForEach(func(k []byte, v []byte) error {
+				var t model.Task
+				json.Unmarshal(v, &t)
+				tasks = append(tasks, &t)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
 	}); err != nil {
 		return nil, err
 	}
 
-	// Minimum and maximum timestamps.
-	min := []byte(start.Format(time.RFC3339))
-	max := []byte(end.Format(time.RFC3339))
+	// Minimum and maximum slice keys.
+	min := sliceKey(start)
+	max := sliceKey(end)
 
 	// Generate dates to result.
 	for start.Before(end) {
 		dates = append(dates, Usage{Date: start.Format(dateFmt)})
-		start = start.AddDate(0, 0, 1)
+		start = nextDay(start, loc)
 	}
 
-	// Go through each task, day by day.
+	// Collect slices of each task.
+	slices := []Slice{}
+	owners := []*model.Task{}
+	buckets := map[string]bool{}
 	for _, task := range tasks {
-		if err := db.db.View(func(tx *bolt.Tx) error {
+		if err := db.db.View(func(tx kvTx) error {
 			b := tx.Bucket([]byte(BucketSlices))
-			bs := b.Bucket(bytes.Join([][]byte{
-				Itob(task.GroupID),
-				Itob(task.ID)},
-				[]byte("-"),
-			))
+			bs := b.Bucket(sliceBucketID(task.GroupID, task.ID))
 			if bs == nil {
 				log.Printf("Unable to find slices for task %d:%s", task.ID, task.Name)
 				return nil
 			}
+			buckets[string(sliceBucketID(task.GroupID, task.ID))] = true
 
 			// Seek to start date
 			c := bs.Cursor()
@@ -307,50 +545,90 @@ func (db *StopwatchDB) GetUsage(group int, start, end time.Time) (*UsageReport,
 					continue
 				}
 
-				starttime, _ := time.Parse(time.RFC3339, string(k))
-				endtime, _ := time.Parse(time.RFC3339, string(v))
-				if endtime.IsZero() {
+				starttime, r, err := decodeSliceEntry(k, v)
+				if err != nil {
+					return fmt.Errorf("task %d:%s has an invalid slice: %s", task.ID, task.Name, err)
+				}
+
+				if r.Open() {
 					continue
 				}
 
-				date := starttime.Format(dateFmt)
-				dur := endtime.Sub(starttime)
+				slices = append(slices, Slice{Start: starttime, End: r.End})
+				owners = append(owners, task)
+			}
 
-				log.Printf("%s/%s: %s", task.CostCode, task.Name, endtime)
+			// Iterate slices until we hit end.
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
 
-				if _, ok := daily[task.CostCode]; !ok {
-					daily[task.CostCode] = map[string]model.TaskDuration{}
-					for _, d := range dates {
-						daily[task.CostCode][d.Date] = model.TaskDuration{}
-					}
-				}
+	// Time of tasks running at the same time may be divided between them.
+	durations, err := db.sliceDurations(slices, buckets, min, max)
+	if err != nil {
+		return nil, err
+	}
 
-				if _, ok := total[task.CostCode]; !ok {
-					total[task.CostCode] = model.TaskDuration{}
-				}
+	// Sum up time used per key, day by day.
+	dateTotals := map[string]model.TaskDuration{}
+	for i, slice := range slices {
+		task := owners[i]
+		date := slice.Start.In(loc).Format(dateFmt)
+		dur := durations[i]
 
-				od := daily[task.CostCode][date]
-				od.Add(dur)
-				daily[task.CostCode][date] = od
+		taskKeys := keys(task, slice.Start)
+		if len(taskKeys) == 0 {
+			continue
+		}
 
-				od = total[task.CostCode]
-				od.Add(dur)
-				total[task.CostCode] = od
+		log.Printf("%s/%s: %s", strings.Join(taskKeys, ","), task.Name, slice.End)
 
-				combined.Add(dur)
+		for _, key := range taskKeys {
+			if _, ok := daily[key]; !ok {
+				daily[key] = map[string]model.TaskDuration{}
+				for _, d := range dates {
+					daily[key][d.Date] = model.TaskDuration{}
+				}
 			}
 
-			// Iterate slices until we hit end.
-			return nil
-		}); err != nil {
-			return nil, err
+			if _, ok := total[key]; !ok {
+				total[key] = model.TaskDuration{}
+			}
+
+			od := daily[key][date]
+			od.Add(dur)
+			daily[key][date] = od
+
+			od = total[key]
+			od.Add(dur)
+			total[key] = od
+		}
+
+		// Time counted for several keys is counted once in the totals.
+		od := dateTotals[date]
+		od.Add(dur)
+		dateTotals[date] = od
+
+		combined.Add(dur)
+		if task.Billable {
+			billable.Add(dur)
+		} else {
+			nonBillable.Add(dur)
 		}
 	}
 
 	rep := UsageReport{
-		Dates:     dates,
-		CostCodes: []CostUsage{},
-		Combined:  combined,
+		Dates:       dates,
+		CostCodes:   []CostUsage{},
+		Combined:    combined,
+		Billable:    billable,
+		NonBillable: nonBillable,
+	}
+
+	for di, date := range rep.Dates {
+		rep.Dates[di].Used = dateTotals[date.Date]
 	}
 
 	// Transform result for easier use in UI
@@ -362,9 +640,8 @@ func (db *StopwatchDB) GetUsage(group int, start, end time.Time) (*UsageReport,
 
 		c := CostUsage{CostCode: cost, Total: total[cost], Usage: []Usage{}}
 
-		for di, date := range rep.Dates {
+		for _, date := range rep.Dates {
 			c.Usage = append(c.Usage, Usage{Date: date.Date, Used: usage[date.Date]})
-			rep.Dates[di].Used.Add(usage[date.Date].Duration)
 		}
 
 		rep.CostCodes = append(rep.CostCodes, c)
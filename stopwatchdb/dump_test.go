@@ -0,0 +1,147 @@
+package stopwatchdb
+
+import (
+	"testing"
+	"time"
+)
+
+// helsinki returns the Europe/Helsinki location, which is UTC+2 in winter and
+// UTC+3 in summer. Skips the test if time zone data isn't available.
+func helsinki(t *testing.T) *time.Location {
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skipf("Time zone data not available: %s", err)
+	}
+
+	return loc
+}
+
+func TestSplitDaysDST(t *testing.T) {
+	loc := helsinki(t)
+
+	tests := []struct {
+		name  string
+		start time.Time
+		end   time.Time
+		want  []time.Duration
+	}{
+		{
+			name:  "same day",
+			start: time.Date(2017, 12, 5, 21, 0, 0, 0, loc),
+			end:   time.Date(2017, 12, 5, 23, 30, 0, 0, loc),
+			want:  []time.Duration{150 * time.Minute},
+		},
+		{
+			name:  "past local midnight, same UTC day",
+			start: time.Date(2017, 12, 5, 23, 0, 0, 0, loc),
+			end:   time.Date(2017, 12, 6, 1, 0, 0, 0, loc),
+			want:  []time.Duration{time.Hour, time.Hour},
+		},
+		{
+			name:  "spring forward",
+			start: time.Date(2017, 3, 25, 22, 0, 0, 0, loc),
+			end:   time.Date(2017, 3, 27, 1, 0, 0, 0, loc),
+			want:  []time.Duration{2 * time.Hour, 23 * time.Hour, time.Hour},
+		},
+		{
+			name:  "fall back",
+			start: time.Date(2017, 10, 28, 22, 0, 0, 0, loc),
+			end:   time.Date(2017, 10, 30, 1, 0, 0, 0, loc),
+			want:  []time.Duration{2 * time.Hour, 25 * time.Hour, time.Hour},
+		},
+	}
+
+	for _, tc := range tests {
+		res := splitDays(tc.start.UTC(), tc.end.UTC(), loc)
+		if len(res) != len(tc.want) {
+			t.Errorf("%s: expected %d slices, got %d: %+v", tc.name, len(tc.want), len(res), res)
+			continue
+		}
+
+		for i, s := range res {
+			if d := s.End.Sub(s.Start); d != tc.want[i] {
+				t.Errorf("%s: slice %d has duration %s (not %s)", tc.name, i, d, tc.want[i])
+			}
+
+			if i > 0 {
+				if st := s.Start.In(loc); st.Hour() != 0 || st.Minute() != 0 {
+					t.Errorf("%s: slice %d doesn't start at midnight: %s", tc.name, i, st)
+				}
+			}
+		}
+	}
+}
+
+func TestGetUsageDST(t *testing.T) {
+	loc := helsinki(t)
+
+	db, done := openTestDB(t)
+	defer done()
+	db.SetLocation(loc)
+
+	g, _ := db.AddGroup("group")
+	task, _ := db.AddTask(g.ID, "task", "code")
+
+	slices := []struct {
+		start time.Time
+		end   time.Time
+	}{
+		// 21:30-22:30 UTC on 25th, belongs to 26th locally.
+		{time.Date(2017, 3, 26, 0, 30, 0, 0, loc), time.Date(2017, 3, 26, 1, 30, 0, 0, loc)},
+		// Over the skipped hour, 03:00 is 04:00.
+		{time.Date(2017, 3, 26, 2, 30, 0, 0, loc), time.Date(2017, 3, 26, 4, 30, 0, 0, loc)},
+		// Late evening, 20:30-21:00 UTC.
+		{time.Date(2017, 3, 26, 23, 30, 0, 0, loc), time.Date(2017, 3, 27, 0, 0, 0, 0, loc)},
+		// Over the repeated hour, 03:00-04:00 happens twice.
+		{time.Date(2017, 10, 29, 2, 30, 0, 0, loc), time.Date(2017, 10, 29, 4, 30, 0, 0, loc)},
+		// 22:30-23:00 UTC on 29th, belongs to 30th locally.
+		{time.Date(2017, 10, 30, 0, 30, 0, 0, loc), time.Date(2017, 10, 30, 1, 0, 0, 0, loc)},
+	}
+	for _, s := range slices {
+		if _, err := db.SetSlice(g.ID, task.ID, s.start, s.end); err != nil {
+			t.Fatalf("Unable to set slice: %s", err)
+		}
+	}
+
+	tests := []struct {
+		start time.Time
+		end   time.Time
+		want  map[string]time.Duration
+	}{
+		{
+			start: time.Date(2017, 3, 25, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2017, 3, 27, 0, 0, 0, 0, time.UTC),
+			want: map[string]time.Duration{
+				"2017-03-25": 0,
+				"2017-03-26": 150 * time.Minute,
+				"2017-03-27": 0,
+			},
+		},
+		{
+			start: time.Date(2017, 10, 29, 0, 0, 0, 0, time.UTC),
+			end:   time.Date(2017, 10, 30, 0, 0, 0, 0, time.UTC),
+			want: map[string]time.Duration{
+				"2017-10-29": 3 * time.Hour,
+				"2017-10-30": 30 * time.Minute,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		rep, err := db.GetUsage(g.ID, tc.start, tc.end)
+		if err != nil {
+			t.Fatalf("Unable to get usage: %s", err)
+		}
+
+		if len(rep.Dates) != len(tc.want) {
+			t.Errorf("Expected %d dates, got %+v", len(tc.want), rep.Dates)
+			continue
+		}
+
+		for _, u := range rep.Dates {
+			if want, ok := tc.want[u.Date]; !ok || u.Used.Duration != want {
+				t.Errorf("Date %s has %s used (not %s)", u.Date, u.Used, want)
+			}
+		}
+	}
+}
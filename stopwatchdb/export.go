@@ -0,0 +1,468 @@
+package stopwatchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// ExportVersion is the version of the export document format. Version 2
+// replaced the raw slice metadata with the note.
+const ExportVersion = 2
+
+// Export is a document holding the full contents of a database. The audit log,
+// undo history and heartbeats are not included.
+type Export struct {
+	Version  int                 `json:"version"`
+	Schema   int                 `json:"schema"`
+	Exported time.Time           `json:"exported"`
+	Groups   []ExportGroup       `json:"groups"`
+	History  []model.HistoryTask `json:"history"`
+	Active   []model.ActiveTask  `json:"active"`
+	// CostCodes is the cost code registry, missing before schema version 5.
+	CostCodes []model.CostCode `json:"costcodes,omitempty"`
+}
+
+// ExportGroup is a group with its tasks.
+type ExportGroup struct {
+	model.Group
+	Tasks []ExportTask `json:"tasks"`
+}
+
+// ExportTask is a task with its slices.
+type ExportTask struct {
+	model.Task
+	Slices []ExportSlice `json:"slices"`
+}
+
+// ExportSlice is a recorded slice. End is nil while the slice is running.
+type ExportSlice struct {
+	Start  time.Time  `json:"start"`
+	End    *time.Time `json:"end,omitempty"`
+	Review bool       `json:"review,omitempty"`
+	Note   string     `json:"note,omitempty"`
+	// Meta is the raw slice metadata of version 1 documents, only read on
+	// import.
+	Meta []byte `json:"meta,omitempty"`
+}
+
+// ImportResult tells what was added by an import.
+type ImportResult struct {
+	Groups int
+	Tasks  int
+	Slices int
+	// Skipped counts slices that already existed, and running slices that
+	// were not merged.
+	Skipped int
+}
+
+// Export returns the full contents of the database as a document. Fails on
+// unreadable records, which can be fixed with Repair first.
+func (db *StopwatchDB) Export() (*Export, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	doc := &Export{
+		Version:  ExportVersion,
+		Exported: time.Now().UTC(),
+		Groups:   []ExportGroup{},
+		History:  []model.HistoryTask{},
+	}
+
+	err := db.db.View(func(tx kvTx) error {
+		var err error
+		doc.Schema = getVersion(tx)
+
+		if err = tx.Bucket([]byte(BucketGroups)).ForEach(func(k, v []byte) error {
+			g := ExportGroup{Tasks: []ExportTask{}}
+			if err := json.Unmarshal(v, &g.Group); err != nil {
+				return fmt.Errorf("group %d: %s", Btoi(k), err)
+			}
+
+			if g.Tasks, err = exportTasks(tx, g.ID); err != nil {
+				return err
+			}
+
+			doc.Groups = append(doc.Groups, g)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if buf := tx.Bucket([]byte(BucketHistory)).Get([]byte("usage")); buf != nil {
+			if err = json.Unmarshal(buf, &doc.History); err != nil {
+				return fmt.Errorf("history: %s", err)
+			}
+		}
+
+		if err = tx.Bucket([]byte(BucketCostCodes)).ForEach(func(k, v []byte) error {
+			var c model.CostCode
+			if err := json.Unmarshal(v, &c); err != nil {
+				return fmt.Errorf("cost code '%s': %s", k, err)
+			}
+			doc.CostCodes = append(doc.CostCodes, c)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		doc.Active, err = getActiveTasks(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// exportTasks reads the tasks of a group with their slices.
+func exportTasks(tx kvTx, group int) ([]ExportTask, error) {
+	tasks := []ExportTask{}
+
+	bt := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(group))
+	if bt == nil {
+		return tasks, nil
+	}
+
+	err := bt.ForEach(func(k, v []byte) error {
+		t := ExportTask{Slices: []ExportSlice{}}
+		if err := json.Unmarshal(v, &t.Task); err != nil {
+			return fmt.Errorf("task %d:%d: %s", group, Btoi(k), err)
+		}
+
+		bs := tx.Bucket([]byte(BucketSlices)).Bucket(sliceBucketID(group, t.ID))
+		if bs != nil {
+			if err := bs.ForEach(func(k, v []byte) error {
+				start, r, err := decodeSliceEntry(k, v)
+				if err != nil {
+					return fmt.Errorf("slice of task %d:%d: %s", group, t.ID, err)
+				}
+
+				s := ExportSlice{Start: start, Review: r.Flags&sliceFlagReview != 0, Note: r.Note()}
+				if !r.Open() {
+					end := r.End
+					s.End = &end
+				}
+
+				t.Slices = append(t.Slices, s)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		tasks = append(tasks, t)
+		return nil
+	})
+
+	return tasks, err
+}
+
+// Import adds the contents of an export document to the database. Without
+// merge the database must be empty, and everything is restored with the
+// original IDs. With merge, groups and tasks are matched by name and new ones
+// get new IDs. Existing slices are kept, and running slices and the active
+// tasks of the document are not merged.
+func (db *StopwatchDB) Import(doc *Export, merge bool) (*ImportResult, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	if doc.Version < 1 || doc.Version > ExportVersion {
+		return nil, fmt.Errorf("unsupported export version %d", doc.Version)
+	}
+
+	res := &ImportResult{}
+	err := db.db.Update(func(tx kvTx) error {
+		bg := tx.Bucket([]byte(BucketGroups))
+		if k, _ := bg.Cursor().First(); k != nil && !merge {
+			return errors.New("database is not empty")
+		}
+
+		// Old group and task IDs mapped to the imported ones.
+		ids := map[model.ActiveTask]model.ActiveTask{}
+		groups := map[int]int{}
+
+		// Parents are imported before their children, so that merged groups are
+		// matched by name under their imported parent.
+		for _, g := range parentsFirst(doc.Groups) {
+			if merge && g.ParentID != 0 {
+				g.ParentID = groups[g.ParentID]
+			}
+
+			group, isNew, err := importGroup(tx, g.Group, merge)
+			if err != nil {
+				return err
+			}
+			if isNew {
+				res.Groups++
+			}
+			groups[g.ID] = group
+
+			for _, t := range g.Tasks {
+				task, err := importTask(tx, group, t, doc.Schema, merge, res)
+				if err != nil {
+					return err
+				}
+				ids[model.ActiveTask{GroupID: g.ID, TaskID: t.ID}] = model.ActiveTask{GroupID: group, TaskID: task}
+			}
+		}
+
+		// Registered codes are kept when merging. Documents exported before the
+		// registry get the codes used by tasks, as after migration.
+		for i := range doc.CostCodes {
+			c := &doc.CostCodes[i]
+			if existing, _ := getCostCode(tx, c.Code); existing != nil && merge {
+				continue
+			}
+			if err := putCostCode(tx, c); err != nil {
+				return err
+			}
+		}
+		if doc.Schema < 5 {
+			if err := registerTaskCostCodes(tx); err != nil {
+				return err
+			}
+		}
+
+		if err := importHistory(tx, doc.History, ids, merge); err != nil {
+			return err
+		}
+
+		if !merge {
+			active := []model.ActiveTask{}
+			for _, at := range doc.Active {
+				if id, ok := ids[at]; ok {
+					active = append(active, id)
+				}
+			}
+
+			if err := putActiveTasks(tx, active); err != nil {
+				return err
+			}
+		}
+
+		return db.auditAs(tx, SourceImport, AuditImport, 0, 0, nil, res)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// importGroup adds a group, or with merge finds an existing group with the same
+// name and parent. Returns the group ID and if the group was added.
+func importGroup(tx kvTx, g model.Group, merge bool) (int, bool, error) {
+	bg := tx.Bucket([]byte(BucketGroups))
+
+	if merge {
+		found := 0
+		bg.ForEach(func(k, v []byte) error {
+			var existing model.Group
+			if json.Unmarshal(v, &existing) == nil && existing.Name == g.Name && existing.ParentID == g.ParentID && found == 0 {
+				found = existing.ID
+			}
+			return nil
+		})
+		if found != 0 {
+			return found, false, nil
+		}
+
+		id, err := bg.NextSequence()
+		if err != nil {
+			return 0, false, err
+		}
+		g.ID = int(id)
+	} else if err := reserveID(bg, g.ID); err != nil {
+		return 0, false, fmt.Errorf("group '%s': %s", g.Name, err)
+	}
+
+	if _, err := tx.Bucket([]byte(BucketTasks)).CreateBucketIfNotExists(Itob(g.ID)); err != nil {
+		return 0, false, err
+	}
+
+	return g.ID, true, putGroup(tx, &g)
+}
+
+// parentsFirst orders groups so that each group comes after its parent. Groups
+// whose parent can't be placed before them, because of a cycle, are left last.
+func parentsFirst(groups []ExportGroup) []ExportGroup {
+	listed := map[int]bool{}
+	for _, g := range groups {
+		listed[g.ID] = true
+	}
+
+	res := make([]ExportGroup, 0, len(groups))
+	placed := map[int]bool{}
+	for rest := groups; len(rest) > 0; {
+		next := []ExportGroup{}
+		for _, g := range rest {
+			if g.ParentID == 0 || !listed[g.ParentID] || placed[g.ParentID] {
+				res = append(res, g)
+				placed[g.ID] = true
+			} else {
+				next = append(next, g)
+			}
+		}
+
+		if len(next) == len(rest) {
+			return append(res, next...)
+		}
+		rest = next
+	}
+
+	return res
+}
+
+// importTask adds a task and its slices to a group, or with merge adds the
+// slices to an existing task with the same name. Returns the task ID.
+func importTask(tx kvTx, group int, et ExportTask, schema int, merge bool, res *ImportResult) (int, error) {
+	bt, err := tx.Bucket([]byte(BucketTasks)).CreateBucketIfNotExists(Itob(group))
+	if err != nil {
+		return 0, err
+	}
+
+	t := et.Task
+	t.GroupID = group
+
+	// Tasks exported before the billable flag are billable, as after migration.
+	if schema < 4 {
+		t.Billable = true
+	}
+
+	if merge {
+		var existing *model.Task
+		bt.ForEach(func(k, v []byte) error {
+			var other model.Task
+			if existing == nil && json.Unmarshal(v, &other) == nil && other.Name == t.Name {
+				existing = &other
+			}
+			return nil
+		})
+
+		if existing != nil {
+			t = *existing
+		} else {
+			id, err := bt.NextSequence()
+			if err != nil {
+				return 0, err
+			}
+			// Time used is counted from the merged slices, and running state
+			// isn't merged.
+			t.ID = int(id)
+			t.Used = model.TaskDuration{}
+			t.Running = nil
+			res.Tasks++
+		}
+	} else {
+		if err := reserveID(bt, t.ID); err != nil {
+			return 0, fmt.Errorf("task '%s': %s", t.Name, err)
+		}
+		res.Tasks++
+	}
+
+	bs, err := tx.Bucket([]byte(BucketSlices)).CreateBucketIfNotExists(sliceBucketID(group, t.ID))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, s := range et.Slices {
+		if s.End != nil && s.End.Before(s.Start) {
+			return 0, fmt.Errorf("task '%s': slice at %s ends before it starts", t.Name, s.Start)
+		}
+
+		if (merge && s.End == nil) || bs.Get(sliceKey(s.Start)) != nil {
+			res.Skipped++
+			continue
+		}
+
+		note := s.Note
+		if len(s.Meta) > 0 && note == "" {
+			var m sliceMeta
+			if err = json.Unmarshal(s.Meta, &m); err != nil {
+				return 0, fmt.Errorf("task '%s': slice at %s: invalid metadata: %s", t.Name, s.Start, err)
+			}
+			note = m.Note
+		}
+
+		var r sliceRecord
+		if err = r.SetNote(note); err != nil {
+			return 0, fmt.Errorf("task '%s': slice at %s: %s", t.Name, s.Start, err)
+		}
+		if s.End != nil {
+			r.End = s.End.UTC()
+			if merge {
+				t.Used.Add(r.End.Sub(s.Start))
+			}
+		}
+		if s.Review {
+			r.Flags |= sliceFlagReview
+		}
+
+		if err = bs.Put(sliceKey(s.Start), encodeSlice(r)); err != nil {
+			return 0, err
+		}
+		res.Slices++
+	}
+
+	return t.ID, putTask(tx, &t)
+}
+
+// importHistory writes the history entries of imported tasks. With merge, the
+// entries are added after the existing history.
+func importHistory(tx kvTx, history []model.HistoryTask, ids map[model.ActiveTask]model.ActiveTask, merge bool) error {
+	b := tx.Bucket([]byte(BucketHistory))
+
+	res := []model.HistoryTask{}
+	seen := map[model.ActiveTask]bool{}
+	if buf := b.Get([]byte("usage")); buf != nil && merge {
+		if err := json.Unmarshal(buf, &res); err != nil {
+			return err
+		}
+		for _, ht := range res {
+			seen[model.ActiveTask{GroupID: ht.GroupID, TaskID: ht.ID}] = true
+		}
+	}
+
+	for _, ht := range history {
+		id, ok := ids[model.ActiveTask{GroupID: ht.GroupID, TaskID: ht.ID}]
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		res = append(res, model.HistoryTask{GroupID: id.GroupID, ID: id.TaskID})
+	}
+
+	buf, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte("usage"), buf)
+}
+
+// reserveID checks that id is free in a bucket, and moves the bucket sequence
+// past it so that new records don't reuse it.
+func reserveID(b kvBucket, id int) error {
+	if id <= 0 {
+		return fmt.Errorf("invalid ID %d", id)
+	}
+
+	if b.Get(Itob(id)) != nil {
+		return fmt.Errorf("duplicate ID %d", id)
+	}
+
+	if seq, err := b.NextSequence(); err != nil {
+		return err
+	} else if seq <= uint64(id) {
+		return b.SetSequence(uint64(id))
+	} else {
+		return b.SetSequence(seq - 1)
+	}
+}
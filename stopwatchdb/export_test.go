@@ -0,0 +1,207 @@
+package stopwatchdb
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+func TestExportImport(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		b, _ := db.AddTask(g.ID, "b", "code")
+		empty, _ := db.AddGroup("empty")
+		db.MoveGroup(empty.ID, g.ID)
+		db.SaveCostCode(&model.CostCode{Code: "code", Description: "Development", Active: true})
+
+		start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+		db.SetSlice(g.ID, b.ID, start.Add(time.Hour), start.Add(3*time.Hour))
+		db.SwitchTask(g.ID, b.ID)
+		db.SaveHistory([]model.HistoryTask{{GroupID: g.ID, ID: b.ID}, {GroupID: g.ID, ID: a.ID}})
+
+		doc, err := db.Export()
+		if err != nil {
+			t.Fatalf("Unable to export: %s", err)
+		}
+		if doc.Version != ExportVersion || len(doc.Groups) != 2 || len(doc.Groups[0].Tasks) != 2 {
+			t.Fatalf("Wrong export: %+v", doc)
+		}
+
+		// Full restore keeps IDs and running state.
+		restored, done := openMemoryDB(t)
+		defer done()
+
+		res, err := restored.Import(doc, false)
+		if err != nil {
+			t.Fatalf("Unable to import: %s", err)
+		}
+		if res.Groups != 2 || res.Tasks != 2 || res.Slices != 3 || res.Skipped != 0 {
+			t.Errorf("Wrong import result: %+v", res)
+		}
+
+		if g2, _ := restored.GetGroup(empty.ID); g2 == nil || g2.Name != "empty" {
+			t.Errorf("Group not restored: %+v", g2)
+		}
+		if at, _ := restored.GetActiveTask(); at == nil || at.ID != b.ID || at.Running == nil {
+			t.Errorf("Active task not restored: %+v", at)
+		}
+		if hist, _ := restored.ReadHistory(true); len(hist) != 2 || hist[0].ID != b.ID {
+			t.Errorf("History not restored: %+v", hist)
+		}
+		if rep, _ := restored.Check(); len(rep.Problems) != 0 {
+			t.Errorf("Problems after import: %+v", rep.Problems)
+		}
+		if codes, _ := restored.ReadCostCodes(true); len(codes) != 1 || codes[0].Description != "Development" {
+			t.Errorf("Cost codes not restored: %+v", codes)
+		}
+
+		// New records don't reuse imported IDs.
+		if g3, _ := restored.AddGroup("new"); g3.ID != empty.ID+1 {
+			t.Errorf("Group ID reused: %+v", g3)
+		}
+
+		// Restoring requires an empty database.
+		if _, err = restored.Import(doc, false); err == nil {
+			t.Errorf("Import into non-empty database succeeded")
+		}
+
+		// Merge into a database with other IDs.
+		merged, done2 := openMemoryDB(t)
+		defer done2()
+
+		other, _ := merged.AddGroup("other")
+		mg, _ := merged.AddGroup("group")
+		// Same name as the imported subgroup, but at the top level.
+		top, _ := merged.AddGroup("empty")
+		ma, _ := merged.AddTask(mg.ID, "a", "code")
+		merged.SetSlice(mg.ID, ma.ID, start, start.Add(time.Hour))
+
+		if res, err = merged.Import(doc, true); err != nil {
+			t.Fatalf("Unable to merge: %s", err)
+		}
+		if res.Groups != 1 || res.Tasks != 1 || res.Slices != 1 || res.Skipped != 2 {
+			t.Errorf("Wrong merge result: %+v", res)
+		}
+
+		tasks, _ := merged.ReadTasks(mg.ID, true)
+		if len(tasks) != 2 {
+			t.Fatalf("Expected 2 tasks after merge, got %+v", tasks)
+		}
+		for _, task := range tasks {
+			if task.Name == "b" && (task.Running != nil || task.Used.Duration != 2*time.Hour) {
+				t.Errorf("Wrong merged task: %+v", task)
+			}
+		}
+		if groups, _ := merged.ReadGroups(true); len(groups) != 4 || groups[0].ID != other.ID || groups[2].ID != top.ID || groups[3].ParentID != mg.ID {
+			t.Errorf("Wrong groups after merge: %+v", groups)
+		}
+		if rep, _ := merged.Check(); len(rep.Problems) != 0 {
+			t.Errorf("Problems after merge: %+v", rep.Problems)
+		}
+
+		entries, _ := merged.ReadAudit(AuditFilter{})
+		if e := entries[len(entries)-1]; e.Op != AuditImport || e.Source != SourceImport {
+			t.Errorf("Import not audited: %+v", e)
+		}
+	})
+}
+
+func TestImportMergeNested(t *testing.T) {
+	db, done := openMemoryDB(t)
+	defer done()
+
+	// The subgroup is exported before its parent.
+	sub, _ := db.AddGroup("sub")
+	client, _ := db.AddGroup("client")
+	db.MoveGroup(sub.ID, client.ID)
+	db.AddTask(sub.ID, "task", "code")
+
+	doc, err := db.Export()
+	if err != nil {
+		t.Fatalf("Unable to export: %s", err)
+	}
+
+	// Merging into a copy matches the groups under their parent.
+	merged, done2 := openMemoryDB(t)
+	defer done2()
+
+	mc, _ := merged.AddGroup("client")
+	ms, _ := merged.AddGroup("sub")
+	merged.MoveGroup(ms.ID, mc.ID)
+
+	res, err := merged.Import(doc, true)
+	if err != nil {
+		t.Fatalf("Unable to merge: %s", err)
+	}
+	if res.Groups != 0 || res.Tasks != 1 {
+		t.Errorf("Wrong merge result: %+v", res)
+	}
+	if tasks, _ := merged.ReadTasks(ms.ID, true); len(tasks) != 1 {
+		t.Errorf("Task not merged into subgroup: %+v", tasks)
+	}
+}
+
+func TestExportSliceNotes(t *testing.T) {
+	db, done := openMemoryDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	a, _ := db.AddTask(g.ID, "a", "code")
+	start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+	db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+	db.SetSliceNote(g.ID, a.ID, start, "planning")
+
+	doc, err := db.Export()
+	if err != nil {
+		t.Fatalf("Unable to export: %s", err)
+	}
+
+	buf, _ := json.Marshal(doc)
+	if !strings.Contains(string(buf), `"note":"planning"`) || strings.Contains(string(buf), `"meta"`) {
+		t.Errorf("Note not exported: %s", buf)
+	}
+
+	noteOf := func(db Store) string {
+		slices, _ := db.GetSlices(g.ID, start, start)
+		if len(slices) != 1 || len(slices[0].Slices) != 1 {
+			return ""
+		}
+		return slices[0].Slices[0].Note
+	}
+
+	restored, done2 := openMemoryDB(t)
+	defer done2()
+	if _, err = restored.Import(doc, false); err != nil {
+		t.Fatalf("Unable to import: %s", err)
+	}
+	if note := noteOf(restored); note != "planning" {
+		t.Errorf("Wrong note after import: %q", note)
+	}
+
+	// Version 1 documents have the note in the raw metadata.
+	s := &doc.Groups[0].Tasks[0].Slices[0]
+	doc.Version = 1
+	s.Note = ""
+	s.Meta = []byte(`{"note":"old"}`)
+
+	old, done3 := openMemoryDB(t)
+	defer done3()
+	if _, err = old.Import(doc, false); err != nil {
+		t.Fatalf("Unable to import version 1: %s", err)
+	}
+	if note := noteOf(old); note != "old" {
+		t.Errorf("Wrong note after version 1 import: %q", note)
+	}
+
+	s.Meta = []byte("garbage")
+	invalid, done4 := openMemoryDB(t)
+	defer done4()
+	if _, err = invalid.Import(doc, false); err == nil {
+		t.Errorf("Imported invalid slice metadata")
+	}
+}
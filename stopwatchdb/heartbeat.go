@@ -0,0 +1,269 @@
+package stopwatchdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// keyHeartbeat is the state bucket key holding the last heartbeat time.
+const keyHeartbeat = "heartbeat"
+
+// keyShutdown is the state bucket key holding the time of the last clean exit,
+// until the next heartbeat.
+const keyShutdown = "shutdown"
+
+// Ways to resolve a gap in heartbeats
+const (
+	// GapEnd ends running slices at the last heartbeat
+	GapEnd = "end"
+	// GapKeep keeps the slices running as if there was no gap
+	GapKeep = "keep"
+	// GapSplit ends running slices at the last heartbeat and starts new ones
+	GapSplit = "split"
+)
+
+// defaultGapThreshold is used when no gap threshold has been set.
+const defaultGapThreshold = 5 * time.Minute
+
+// GapTask is a task that was running during a gap in heartbeats
+type GapTask struct {
+	// GroupID of the task
+	GroupID int
+	// TaskID of the task
+	TaskID int
+	// Name of the task
+	Name string
+	// Start of the running slice
+	Start time.Time
+}
+
+// Gap describes a period when tasks were running without heartbeats, which
+// happens when the app crashes or the computer is suspended.
+type Gap struct {
+	// LastSeen is the time of the last heartbeat
+	LastSeen time.Time
+	// Now is the time the gap was detected
+	Now time.Time
+	// Tasks that were running during the gap
+	Tasks []GapTask
+}
+
+// SetGapThreshold sets how long tasks may run without heartbeats before it is
+// considered a gap. Defaults to 5 minutes.
+func (db *StopwatchDB) SetGapThreshold(d time.Duration) {
+	db.gapThreshold = d
+}
+
+// gapThresholdOrDefault returns the gap threshold in use.
+func (db *StopwatchDB) gapThresholdOrDefault() time.Duration {
+	if db.gapThreshold <= 0 {
+		return defaultGapThreshold
+	}
+
+	return db.gapThreshold
+}
+
+// Heartbeat records that the app is alive while tasks run. No heartbeat is
+// recorded while no task is running. If a gap is found since the last heartbeat, it is
+// returned and no heartbeat is recorded until the gap is resolved with
+// ResolveGap.
+func (db *StopwatchDB) Heartbeat() (*Gap, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	var gap *Gap
+	err := db.db.Update(func(tx kvTx) error {
+		var err error
+		now := time.Now().UTC()
+
+		if gap, err = findGap(tx, now, db.gapThresholdOrDefault()); err != nil || gap != nil {
+			return err
+		}
+
+		running, err := hasRunningTask(tx)
+		if err != nil {
+			return err
+		} else if !running {
+			return tx.Bucket([]byte(BucketState)).Delete([]byte(keyShutdown))
+		}
+
+		return putHeartbeat(tx, now)
+	})
+
+	return gap, err
+}
+
+// Shutdown records that the app is exiting cleanly, so that tasks left running
+// aren't reported as a gap when the app is started again. Call before Close.
+func (db *StopwatchDB) Shutdown() error {
+	if db.IsOpen() == false {
+		return errors.New("database not ready")
+	}
+
+	return db.db.Update(func(tx kvTx) error {
+		now := time.Now().UTC()
+		return tx.Bucket([]byte(BucketState)).Put([]byte(keyShutdown), Itob(int(now.UnixNano())))
+	})
+}
+
+// CheckGap returns the gap since the last heartbeat, or nil if there is no gap
+// with tasks running during it.
+func (db *StopwatchDB) CheckGap() (*Gap, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	var gap *Gap
+	err := db.db.View(func(tx kvTx) error {
+		var err error
+		gap, err = findGap(tx, time.Now().UTC(), db.gapThresholdOrDefault())
+		return err
+	})
+
+	return gap, err
+}
+
+// ResolveGap handles running slices after a gap in heartbeats using given
+// action, GapEnd, GapKeep or GapSplit, and records a heartbeat. Returns the
+// affected tasks.
+func (db *StopwatchDB) ResolveGap(action string) ([]*model.Task, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	switch action {
+	case GapEnd, GapKeep, GapSplit:
+	default:
+		return nil, fmt.Errorf("unknown gap action '%s'", action)
+	}
+
+	res := []*model.Task{}
+	err := db.db.Update(func(tx kvTx) error {
+		now := time.Now().UTC()
+
+		gap, err := findGap(tx, now, db.gapThresholdOrDefault())
+		if err != nil {
+			return err
+		}
+
+		if gap != nil && action != GapKeep {
+			for _, gt := range gap.Tasks {
+				// Slices started after the last heartbeat end where they started.
+				end := gap.LastSeen
+				if end.Before(gt.Start) {
+					end = gt.Start
+				}
+
+				before, err := getTask(tx, gt.GroupID, gt.TaskID)
+				if err != nil {
+					return err
+				}
+
+				t, err := stopTask(tx, gt.GroupID, gt.TaskID, end, db.Location(), 0, "")
+				if err != nil {
+					return err
+				}
+
+				if action == GapSplit {
+					if t, err = startTask(tx, gt.GroupID, gt.TaskID, now); err != nil {
+						return err
+					}
+				} else {
+					match := func(g, id int) bool { return g == gt.GroupID && id == gt.TaskID }
+					if err = clearActiveTask(tx, match); err != nil {
+						return err
+					}
+				}
+
+				if err = db.audit(tx, AuditResolveGap, gt.GroupID, gt.TaskID, before, t); err != nil {
+					return err
+				}
+
+				res = append(res, t)
+			}
+		}
+
+		return putHeartbeat(tx, now)
+	})
+
+	return res, err
+}
+
+// findGap looks for running active tasks whose last sign of life, the later of
+// the last heartbeat and the slice start, is more than threshold before now.
+// There is no gap after a clean exit.
+func findGap(tx kvTx, now time.Time, threshold time.Duration) (*Gap, error) {
+	bs := tx.Bucket([]byte(BucketState))
+	if buf := bs.Get([]byte(keyShutdown)); len(buf) == 8 {
+		return nil, nil
+	}
+
+	var lastSeen time.Time
+	if buf := bs.Get([]byte(keyHeartbeat)); len(buf) == 8 {
+		lastSeen = time.Unix(0, int64(Btoi(buf))).UTC()
+	}
+
+	active, err := getActiveTasks(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	gap := &Gap{LastSeen: lastSeen, Now: now, Tasks: []GapTask{}}
+	for _, at := range active {
+		t, err := getTask(tx, at.GroupID, at.TaskID)
+		if err != nil || t.Running == nil {
+			continue
+		}
+
+		seen := lastSeen
+		if seen.Before(*t.Running) {
+			seen = *t.Running
+		}
+
+		if now.Sub(seen) > threshold {
+			gap.Tasks = append(gap.Tasks, GapTask{
+				GroupID: t.GroupID,
+				TaskID:  t.ID,
+				Name:    t.Name,
+				Start:   *t.Running,
+			})
+		}
+	}
+
+	if len(gap.Tasks) == 0 {
+		return nil, nil
+	}
+
+	return gap, nil
+}
+
+// hasRunningTask tells if any of the active tasks is running.
+func hasRunningTask(tx kvTx) (bool, error) {
+	active, err := getActiveTasks(tx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, at := range active {
+		if t, err := getTask(tx, at.GroupID, at.TaskID); err == nil && t.Running != nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// putHeartbeat records a heartbeat at given time, clearing the record of a
+// clean exit.
+func putHeartbeat(tx kvTx, now time.Time) error {
+	bs := tx.Bucket([]byte(BucketState))
+	if err := bs.Delete([]byte(keyShutdown)); err != nil {
+		return err
+	}
+
+	return bs.Put([]byte(keyHeartbeat), Itob(int(now.UnixNano())))
+}
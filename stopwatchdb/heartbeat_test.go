@@ -0,0 +1,129 @@
+package stopwatchdb
+
+import (
+	"testing"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+func TestResolveGap(t *testing.T) {
+	for _, action := range []string{GapEnd, GapKeep, GapSplit} {
+		db, done := openTestDB(t)
+
+		g, _ := db.AddGroup("group")
+		task, _ := db.AddTask(g.ID, "task", "code")
+
+		// Task started two hours ago, last heartbeat 90 minutes ago.
+		now := time.Now().UTC()
+		if err := db.db.Update(func(tx kvTx) error {
+			if _, err := startTask(tx, g.ID, task.ID, now.Add(-2*time.Hour)); err != nil {
+				return err
+			}
+			if err := putActiveTasks(tx, []model.ActiveTask{{GroupID: g.ID, TaskID: task.ID}}); err != nil {
+				return err
+			}
+			return putHeartbeat(tx, now.Add(-90*time.Minute))
+		}); err != nil {
+			t.Fatalf("Unable to start task: %s", err)
+		}
+
+		gap, err := db.Heartbeat()
+		if err != nil || gap == nil || len(gap.Tasks) != 1 {
+			t.Fatalf("%s: expected gap with one task, got %+v, %v", action, gap, err)
+		}
+
+		// Heartbeat isn't recorded over an unresolved gap.
+		if gap, _ = db.CheckGap(); gap == nil {
+			t.Fatalf("%s: gap lost after heartbeat", action)
+		}
+
+		if _, err = db.ResolveGap(action); err != nil {
+			t.Fatalf("%s: unable to resolve gap: %s", action, err)
+		}
+
+		if gap, _ = db.CheckGap(); gap != nil {
+			t.Errorf("%s: gap left after resolving: %+v", action, gap)
+		}
+
+		task, _ = db.GetTask(g.ID, task.ID)
+		active, _ := db.GetActiveTasks()
+		switch action {
+		case GapEnd:
+			if task.Running != nil || len(active) != 0 || task.Used.Duration != 30*time.Minute {
+				t.Errorf("%s: task not ended at last heartbeat: %+v", action, task)
+			}
+		case GapKeep:
+			if task.Running == nil || len(active) != 1 || task.Used.Duration != 0 {
+				t.Errorf("%s: task not kept running: %+v", action, task)
+			}
+		case GapSplit:
+			if task.Running == nil || len(active) != 1 || task.Used.Duration != 30*time.Minute {
+				t.Errorf("%s: task not split at last heartbeat: %+v", action, task)
+			}
+		}
+
+		done()
+	}
+}
+
+func TestHeartbeatShutdown(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	task, _ := db.AddTask(g.ID, "task", "code")
+
+	stored := func(key string) bool {
+		var found bool
+		db.db.View(func(tx kvTx) error {
+			found = tx.Bucket([]byte(BucketState)).Get([]byte(key)) != nil
+			return nil
+		})
+		return found
+	}
+
+	// Nothing is recorded while no task runs.
+	if _, err := db.Heartbeat(); err != nil {
+		t.Fatalf("Unable to record heartbeat: %s", err)
+	}
+	if stored(keyHeartbeat) {
+		t.Errorf("Heartbeat recorded without running tasks")
+	}
+
+	// Task started two hours ago, last heartbeat 90 minutes ago, then a clean
+	// exit.
+	now := time.Now().UTC()
+	if err := db.db.Update(func(tx kvTx) error {
+		if _, err := startTask(tx, g.ID, task.ID, now.Add(-2*time.Hour)); err != nil {
+			return err
+		}
+		if err := putActiveTasks(tx, []model.ActiveTask{{GroupID: g.ID, TaskID: task.ID}}); err != nil {
+			return err
+		}
+		return putHeartbeat(tx, now.Add(-90*time.Minute))
+	}); err != nil {
+		t.Fatalf("Unable to start task: %s", err)
+	}
+	if err := db.Shutdown(); err != nil {
+		t.Fatalf("Unable to record shutdown: %s", err)
+	}
+
+	if gap, _ := db.CheckGap(); gap != nil {
+		t.Errorf("Clean exit reported as gap: %+v", gap)
+	}
+
+	gap, err := db.Heartbeat()
+	if err != nil || gap != nil {
+		t.Fatalf("Expected heartbeat without gap, got %+v, %v", gap, err)
+	}
+	if stored(keyShutdown) || !stored(keyHeartbeat) {
+		t.Errorf("Clean exit not cleared by heartbeat")
+	}
+
+	// A later crash is reported again.
+	db.db.Update(func(tx kvTx) error { return putHeartbeat(tx, now.Add(-time.Hour)) })
+	if gap, _ = db.CheckGap(); gap == nil {
+		t.Errorf("Gap not reported after clean exit was cleared")
+	}
+}
@@ -0,0 +1,358 @@
+package stopwatchdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icalTimeFmt is the layout of UTC date-times in iCalendar files.
+const icalTimeFmt = "20060102T150405Z"
+
+// icalMaxLine is the maximum length of a line in octets before it's folded.
+const icalMaxLine = 75
+
+// ICalEvent is a timed event read from an iCalendar file.
+type ICalEvent struct {
+	UID     string
+	Summary string
+	Start   time.Time
+	End     time.Time
+}
+
+// ICalResult tells what was done by an iCalendar import.
+type ICalResult struct {
+	Added int
+	// Skipped counts events that already had a slice, and events without a
+	// start and end time.
+	Skipped int
+}
+
+// WriteICal writes slices of a group as an iCalendar file, with one event per
+// slice. Events have the task name as summary, the cost code as category and
+// the slice note in the description.
+// UIDs are derived from the group, task and slice start, so exporting the same
+// slice again gives the same UID.
+func WriteICal(w io.Writer, group int, slices []TaskSlices) error {
+	bw := bufio.NewWriter(w)
+	line := func(s string) {
+		writeICalLine(bw, s)
+	}
+
+	stamp := time.Now().UTC().Format(icalTimeFmt)
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//msepp//stopwatch//EN")
+	line("CALSCALE:GREGORIAN")
+	for _, ts := range slices {
+		for _, s := range ts.Slices {
+			line("BEGIN:VEVENT")
+			line("UID:" + icalUID(group, ts.ID, s.Start))
+			line("DTSTAMP:" + stamp)
+			line("DTSTART:" + s.Start.UTC().Format(icalTimeFmt))
+			line("DTEND:" + s.End.UTC().Format(icalTimeFmt))
+			line("SUMMARY:" + icalEscape(ts.Name))
+			if desc := icalDescription(s.Note, s.CostCode); desc != "" {
+				line("DESCRIPTION:" + icalEscape(desc))
+			}
+			if s.CostCode != "" {
+				line("CATEGORIES:" + icalEscape(s.CostCode))
+			}
+			line("END:VEVENT")
+		}
+	}
+	line("END:VCALENDAR")
+
+	return bw.Flush()
+}
+
+// ReadICal reads the timed events of an iCalendar file. Times without a zone
+// are read in loc. All-day events and events without an end are returned with
+// zero times.
+func ReadICal(r io.Reader, loc *time.Location) ([]ICalEvent, error) {
+	lines, err := unfoldICal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []ICalEvent{}
+	var ev *ICalEvent
+	var duration time.Duration
+
+	for i, l := range lines {
+		name, params, value, err := parseICalLine(l)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			ev = &ICalEvent{}
+			duration = 0
+
+		case name == "END" && value == "VEVENT" && ev != nil:
+			if ev.End.IsZero() && duration > 0 && !ev.Start.IsZero() {
+				ev.End = ev.Start.Add(duration)
+			}
+			if ev.End.IsZero() {
+				ev.Start = time.Time{}
+			}
+			events = append(events, *ev)
+			ev = nil
+
+		case ev == nil:
+			continue
+
+		case name == "UID":
+			ev.UID = value
+
+		case name == "SUMMARY":
+			ev.Summary = icalUnescape(value)
+
+		case name == "DTSTART" || name == "DTEND":
+			t, err := parseICalTime(value, params, loc)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+			if name == "DTSTART" {
+				ev.Start = t
+			} else {
+				ev.End = t
+			}
+
+		case name == "DURATION":
+			if duration, err = parseICalDuration(value); err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+		}
+	}
+
+	return events, nil
+}
+
+// ImportICal adds events as slices of a task. Events that start at the same
+// time as an existing slice of the task are skipped. All events are checked
+// before any is written, and they are written as a single change with
+// ImportSlices.
+func ImportICal(db Store, group, task int, events []ICalEvent) (*ICalResult, error) {
+	res := &ICalResult{}
+
+	t, err := db.GetTask(group, task)
+	if err != nil {
+		return nil, err
+	}
+
+	var first, last time.Time
+	for _, ev := range events {
+		if ev.Start.IsZero() {
+			continue
+		}
+		if !ev.End.After(ev.Start) {
+			return nil, fmt.Errorf("event '%s' ends before it starts", ev.UID)
+		}
+		if first.IsZero() || ev.Start.Before(first) {
+			first = ev.Start
+		}
+		if last.IsZero() || ev.Start.After(last) {
+			last = ev.Start
+		}
+	}
+
+	existing := map[int64]bool{}
+	if !first.IsZero() {
+		loc := db.Location()
+		slices, err := db.GetSlices(group, first.In(loc), last.In(loc))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ts := range slices {
+			if ts.ID != task {
+				continue
+			}
+			for _, s := range ts.Slices {
+				existing[s.Start.UnixNano()] = true
+			}
+		}
+	}
+
+	slices := []ImportSlice{}
+	for _, ev := range events {
+		if ev.Start.IsZero() || existing[ev.Start.UnixNano()] {
+			res.Skipped++
+			continue
+		}
+
+		slices = append(slices, ImportSlice{GroupID: group, TaskID: task, Task: t.Name, Start: ev.Start, End: ev.End})
+		existing[ev.Start.UnixNano()] = true
+	}
+
+	if len(slices) == 0 {
+		return res, nil
+	}
+
+	if _, err = db.ImportSlices(slices); err != nil {
+		return nil, err
+	}
+	res.Added = len(slices)
+
+	return res, nil
+}
+
+// icalUID returns the UID of the event for a slice.
+func icalUID(group, task int, start time.Time) string {
+	return fmt.Sprintf("%d-%d-%d@stopwatch", group, task, start.UnixNano())
+}
+
+// icalDescription returns the description of the event for a slice.
+func icalDescription(note, code string) string {
+	lines := []string{}
+	if note != "" {
+		lines = append(lines, note)
+	}
+	if code != "" {
+		lines = append(lines, "Cost code: "+code)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeICalLine writes a content line, folding it to lines of at most 75
+// octets without splitting UTF-8 characters.
+func writeICalLine(w *bufio.Writer, s string) {
+	limit := icalMaxLine
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && s[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		w.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+		// Continuation lines start with a space.
+		limit = icalMaxLine - 1
+	}
+	w.WriteString(s + "\r\n")
+}
+
+// unfoldICal reads the content lines of an iCalendar file, joining folded
+// lines.
+func unfoldICal(r io.Reader) ([]string, error) {
+	lines := []string{}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		l := strings.TrimRight(sc.Text(), "\r")
+		if l == "" {
+			continue
+		}
+
+		if (l[0] == ' ' || l[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+
+		lines = append(lines, l)
+	}
+
+	return lines, sc.Err()
+}
+
+// parseICalLine splits a content line into its name, parameters and value.
+// Names and parameter names are upper cased.
+func parseICalLine(l string) (string, map[string]string, string, error) {
+	params := map[string]string{}
+
+	// The value starts after the first colon outside a quoted parameter.
+	quoted := false
+	sep := -1
+	for i, c := range l {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 {
+		return "", nil, "", errors.New("missing value")
+	}
+
+	parts := strings.Split(l[:sep], ";")
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], "\"")
+		}
+	}
+
+	return strings.ToUpper(parts[0]), params, l[sep+1:], nil
+}
+
+// parseICalTime parses a DATE-TIME value. Dates without time are returned as
+// zero time.
+func parseICalTime(value string, params map[string]string, loc *time.Location) (time.Time, error) {
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		return time.Time{}, nil
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse(icalTimeFmt, value)
+	}
+
+	if tzid, ok := params["TZID"]; ok {
+		var err error
+		if loc, err = time.LoadLocation(tzid); err != nil {
+			return time.Time{}, fmt.Errorf("unknown time zone '%s'", tzid)
+		}
+	}
+
+	return time.ParseInLocation("20060102T150405", value, loc)
+}
+
+// icalDurationRe matches the week, day and time parts of a DURATION value.
+var icalDurationRe = regexp.MustCompile(`^\+?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseICalDuration parses a positive DURATION value.
+func parseICalDuration(value string) (time.Duration, error) {
+	m := icalDurationRe.FindStringSubmatch(value)
+	if m == nil || value == "P" || value == "PT" {
+		return 0, fmt.Errorf("invalid duration '%s'", value)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n) * unit
+	}
+
+	return d, nil
+}
+
+// icalEscaper escapes TEXT values.
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// icalUnescaper reverses icalEscaper.
+var icalUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// icalEscape escapes a TEXT value.
+func icalEscape(s string) string {
+	return icalEscaper.Replace(s)
+}
+
+// icalUnescape reverses icalEscape.
+func icalUnescape(s string) string {
+	return icalUnescaper.Replace(s)
+}
@@ -0,0 +1,116 @@
+package stopwatchdb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestICalRoundTrip(t *testing.T) {
+	db, done := openMemoryDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	long := strings.Repeat("ä", 60) + ", with; specials"
+	a, _ := db.AddTask(g.ID, long, "dev")
+	b, _ := db.AddTask(g.ID, "b", "dev")
+
+	start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+	db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+	db.SetSlice(g.ID, a.ID, start.Add(2*time.Hour), start.Add(3*time.Hour))
+
+	slices, _ := db.GetSlices(g.ID, start, start)
+
+	var buf bytes.Buffer
+	if err := WriteICal(&buf, g.ID, slices); err != nil {
+		t.Fatalf("Unable to write calendar: %s", err)
+	}
+
+	for _, l := range strings.Split(buf.String(), "\r\n") {
+		if len(l) > icalMaxLine {
+			t.Errorf("Line not folded: %q", l)
+		}
+	}
+
+	events, err := ReadICal(bytes.NewReader(buf.Bytes()), time.UTC)
+	if err != nil {
+		t.Fatalf("Unable to read calendar: %s", err)
+	}
+	if len(events) != 2 || events[0].Summary != long || !events[0].End.Equal(start.Add(time.Hour)) {
+		t.Fatalf("Wrong events: %+v", events)
+	}
+	if events[0].UID != icalUID(g.ID, a.ID, start) {
+		t.Errorf("Unstable UID: %s", events[0].UID)
+	}
+
+	// A broken event fails the import before anything is written.
+	broken := append(append([]ICalEvent{}, events...), ICalEvent{UID: "broken", Start: start, End: start.Add(-time.Hour)})
+	if _, err = ImportICal(db, g.ID, b.ID, broken); err == nil {
+		t.Fatalf("Expected error for event ending before it starts")
+	}
+	if b, _ = db.GetTask(g.ID, b.ID); b.Used.Duration != 0 {
+		t.Fatalf("Failed import added time: %s", b.Used)
+	}
+
+	// Import onto another task, twice.
+	res, err := ImportICal(db, g.ID, b.ID, events)
+	if err != nil || res.Added != 2 || res.Skipped != 0 {
+		t.Fatalf("Wrong import: %+v, %v", res, err)
+	}
+	if res, err = ImportICal(db, g.ID, b.ID, events); err != nil || res.Added != 0 || res.Skipped != 2 {
+		t.Errorf("Events imported twice: %+v, %v", res, err)
+	}
+	if b, _ = db.GetTask(g.ID, b.ID); b.Used.Duration != 2*time.Hour {
+		t.Errorf("Wrong time used after import: %s", b.Used)
+	}
+
+	// The import is undone as one change.
+	if c, err := db.Undo(); err != nil || c.Op != AuditImportSlices {
+		t.Fatalf("Unable to undo import: %+v, %v", c, err)
+	}
+	if b, _ = db.GetTask(g.ID, b.ID); b.Used.Duration != 0 {
+		t.Errorf("Wrong time used after undo: %s", b.Used)
+	}
+}
+
+func TestReadICal(t *testing.T) {
+	loc := helsinki(t)
+
+	in := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:zoned\r\n" +
+		"SUMMARY:Meeting\\, weekly\r\n" +
+		"DTSTART;TZID=Europe/Helsinki:20171205T100000\r\n" +
+		"DURATION:PT1H30M\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:floating\r\n" +
+		"DTSTART:20171205T120000\r\n" +
+		"DTEND:20171205T13\r\n" +
+		" 0000\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:allday\r\n" +
+		"DTSTART;VALUE=DATE:20171205\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	events, err := ReadICal(strings.NewReader(in), loc)
+	if err != nil {
+		t.Fatalf("Unable to read calendar: %s", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %+v", events)
+	}
+
+	if e := events[0]; e.Summary != "Meeting, weekly" || !e.Start.Equal(time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)) || e.End.Sub(e.Start) != 90*time.Minute {
+		t.Errorf("Wrong zoned event: %+v", e)
+	}
+	if e := events[1]; !e.Start.Equal(time.Date(2017, 12, 5, 12, 0, 0, 0, loc)) || e.End.Sub(e.Start) != time.Hour {
+		t.Errorf("Wrong floating event: %+v", e)
+	}
+	if e := events[2]; !e.Start.IsZero() {
+		t.Errorf("All-day event has a time: %+v", e)
+	}
+}
@@ -0,0 +1,164 @@
+package stopwatchdb
+
+import (
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// kvStore is the key-value storage backing a StopwatchDB. It follows bolt's
+// model of nested, ordered buckets accessed through transactions.
+type kvStore interface {
+	View(fn func(tx kvTx) error) error
+	Update(fn func(tx kvTx) error) error
+	Close() error
+}
+
+// kvTx is a transaction on a kvStore. Writable transactions are rolled back
+// when the function given to Update returns an error.
+type kvTx interface {
+	Bucket(name []byte) kvBucket
+	CreateBucketIfNotExists(name []byte) (kvBucket, error)
+	CopyFile(path string, mode os.FileMode) error
+}
+
+// kvBucket is a collection of ordered key-value pairs and nested buckets.
+// Bucket returns nil if the nested bucket does not exist.
+type kvBucket interface {
+	Bucket(name []byte) kvBucket
+	CreateBucket(name []byte) (kvBucket, error)
+	CreateBucketIfNotExists(name []byte) (kvBucket, error)
+	DeleteBucket(name []byte) error
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	ForEach(fn func(k, v []byte) error) error
+	Cursor() kvCursor
+	NextSequence() (uint64, error)
+	SetSequence(v uint64) error
+}
+
+// kvCursor iterates over the keys of a bucket in byte order. Nested buckets
+// are returned with a nil value.
+type kvCursor interface {
+	First() (key, value []byte)
+	Last() (key, value []byte)
+	Seek(seek []byte) (key, value []byte)
+	Next() (key, value []byte)
+	Prev() (key, value []byte)
+}
+
+// boltStore implements kvStore on a bolt database file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBolt opens the bolt database at path, creating it if missing.
+func openBolt(path string) (kvStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) View(fn func(tx kvTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStore) Update(fn func(tx kvTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) kvBucket {
+	return wrapBolt(t.tx.Bucket(name))
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) CopyFile(path string, mode os.FileMode) error {
+	return t.tx.CopyFile(path, mode)
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+// wrapBolt wraps b, keeping a missing bucket a nil interface.
+func wrapBolt(b *bolt.Bucket) kvBucket {
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+func (b boltBucket) Bucket(name []byte) kvBucket {
+	return wrapBolt(b.b.Bucket(name))
+}
+
+func (b boltBucket) CreateBucket(name []byte) (kvBucket, error) {
+	nb, err := b.b.CreateBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{nb}, nil
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	nb, err := b.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{nb}, nil
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return b.b.DeleteBucket(name)
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) Put(key, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) Cursor() kvCursor {
+	return b.b.Cursor()
+}
+
+func (b boltBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
+
+func (b boltBucket) SetSequence(v uint64) error {
+	return b.b.SetSequence(v)
+}
@@ -0,0 +1,368 @@
+package stopwatchdb
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// NewMemory returns a stopwatch db that keeps its data in memory instead of a
+// bolt file. Open ignores the path, and the data is discarded on Close.
+func NewMemory() *StopwatchDB {
+	return &StopwatchDB{memory: true, undoLimit: defaultUndoLimit, backupKeep: defaultBackupRetention}
+}
+
+// memStore implements kvStore in memory. Writable transactions run on a copy
+// of the data, which replaces the original only if the transaction succeeds.
+type memStore struct {
+	mu     sync.RWMutex
+	root   *memBucket
+	closed bool
+}
+
+// memBucket holds the keys of a bucket in byte order, with values and nested
+// buckets kept in separate maps.
+type memBucket struct {
+	keys    [][]byte
+	values  map[string][]byte
+	buckets map[string]*memBucket
+	seq     uint64
+}
+
+func newMemStore() *memStore {
+	return &memStore{root: newMemBucket()}
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{
+		values:  map[string][]byte{},
+		buckets: map[string]*memBucket{},
+	}
+}
+
+func (s *memStore) View(fn func(tx kvTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return bolt.ErrDatabaseNotOpen
+	}
+
+	return fn(&memTx{root: s.root})
+}
+
+func (s *memStore) Update(fn func(tx kvTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return bolt.ErrDatabaseNotOpen
+	}
+
+	tx := &memTx{root: s.root.clone(), writable: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.root = tx.root
+
+	return nil
+}
+
+func (s *memStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.root = nil
+
+	return nil
+}
+
+// clone returns a deep copy of b.
+func (b *memBucket) clone() *memBucket {
+	c := &memBucket{
+		keys:    make([][]byte, len(b.keys)),
+		values:  make(map[string][]byte, len(b.values)),
+		buckets: make(map[string]*memBucket, len(b.buckets)),
+		seq:     b.seq,
+	}
+	copy(c.keys, b.keys)
+	for k, v := range b.values {
+		c.values[k] = v
+	}
+	for k, nb := range b.buckets {
+		c.buckets[k] = nb.clone()
+	}
+	return c
+}
+
+// index returns the position of key in b.keys, or where it would be inserted.
+func (b *memBucket) index(key []byte) int {
+	return sort.Search(len(b.keys), func(i int) bool {
+		return bytes.Compare(b.keys[i], key) >= 0
+	})
+}
+
+func (b *memBucket) has(key []byte) bool {
+	_, isValue := b.values[string(key)]
+	_, isBucket := b.buckets[string(key)]
+	return isValue || isBucket
+}
+
+func (b *memBucket) insertKey(key []byte) {
+	i := b.index(key)
+	b.keys = append(b.keys, nil)
+	copy(b.keys[i+1:], b.keys[i:])
+	b.keys[i] = append([]byte{}, key...)
+}
+
+func (b *memBucket) removeKey(key []byte) {
+	i := b.index(key)
+	if i < len(b.keys) && bytes.Equal(b.keys[i], key) {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	}
+}
+
+type memTx struct {
+	root     *memBucket
+	writable bool
+}
+
+func (t *memTx) Bucket(name []byte) kvBucket {
+	return memRef{tx: t, b: t.root}.Bucket(name)
+}
+
+func (t *memTx) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	return memRef{tx: t, b: t.root}.CreateBucketIfNotExists(name)
+}
+
+// CopyFile writes the data visible in the transaction to a bolt file, so
+// backups of an in-memory database can be opened like any other.
+func (t *memTx) CopyFile(path string, mode os.FileMode) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	out, err := bolt.Open(path, mode, nil)
+	if err != nil {
+		return err
+	}
+
+	err = out.Update(func(tx *bolt.Tx) error {
+		for name, b := range t.root.buckets {
+			nb, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			if err = copyToBolt(b, nb); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// copyToBolt copies the contents of src, including nested buckets, to dst.
+func copyToBolt(src *memBucket, dst *bolt.Bucket) error {
+	if err := dst.SetSequence(src.seq); err != nil {
+		return err
+	}
+
+	for _, k := range src.keys {
+		if nb, ok := src.buckets[string(k)]; ok {
+			b, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			if err = copyToBolt(nb, b); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := dst.Put(k, src.values[string(k)]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// memRef is a bucket as seen from a transaction.
+type memRef struct {
+	tx *memTx
+	b  *memBucket
+}
+
+func (r memRef) Bucket(name []byte) kvBucket {
+	nb, ok := r.b.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+	return memRef{tx: r.tx, b: nb}
+}
+
+func (r memRef) CreateBucket(name []byte) (kvBucket, error) {
+	if !r.tx.writable {
+		return nil, bolt.ErrTxNotWritable
+	}
+	if len(name) == 0 {
+		return nil, bolt.ErrBucketNameRequired
+	}
+	if _, ok := r.b.buckets[string(name)]; ok {
+		return nil, bolt.ErrBucketExists
+	}
+	if _, ok := r.b.values[string(name)]; ok {
+		return nil, bolt.ErrIncompatibleValue
+	}
+
+	nb := newMemBucket()
+	r.b.buckets[string(name)] = nb
+	r.b.insertKey(name)
+
+	return memRef{tx: r.tx, b: nb}, nil
+}
+
+func (r memRef) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	if b := r.Bucket(name); b != nil {
+		return b, nil
+	}
+	return r.CreateBucket(name)
+}
+
+func (r memRef) DeleteBucket(name []byte) error {
+	if !r.tx.writable {
+		return bolt.ErrTxNotWritable
+	}
+	if _, ok := r.b.buckets[string(name)]; !ok {
+		if _, ok := r.b.values[string(name)]; ok {
+			return bolt.ErrIncompatibleValue
+		}
+		return bolt.ErrBucketNotFound
+	}
+
+	delete(r.b.buckets, string(name))
+	r.b.removeKey(name)
+
+	return nil
+}
+
+func (r memRef) Get(key []byte) []byte {
+	return r.b.values[string(key)]
+}
+
+func (r memRef) Put(key, value []byte) error {
+	if !r.tx.writable {
+		return bolt.ErrTxNotWritable
+	}
+	if len(key) == 0 {
+		return bolt.ErrKeyRequired
+	}
+	if _, ok := r.b.buckets[string(key)]; ok {
+		return bolt.ErrIncompatibleValue
+	}
+
+	if !r.b.has(key) {
+		r.b.insertKey(key)
+	}
+	r.b.values[string(key)] = append([]byte{}, value...)
+
+	return nil
+}
+
+func (r memRef) Delete(key []byte) error {
+	if !r.tx.writable {
+		return bolt.ErrTxNotWritable
+	}
+	if _, ok := r.b.buckets[string(key)]; ok {
+		return bolt.ErrIncompatibleValue
+	}
+	if _, ok := r.b.values[string(key)]; !ok {
+		return nil
+	}
+
+	delete(r.b.values, string(key))
+	r.b.removeKey(key)
+
+	return nil
+}
+
+func (r memRef) ForEach(fn func(k, v []byte) error) error {
+	keys := make([][]byte, len(r.b.keys))
+	copy(keys, r.b.keys)
+
+	for _, k := range keys {
+		if !r.b.has(k) {
+			continue
+		}
+		if err := fn(k, r.b.values[string(k)]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r memRef) Cursor() kvCursor {
+	return &memCursor{b: r.b, i: -1}
+}
+
+func (r memRef) NextSequence() (uint64, error) {
+	if !r.tx.writable {
+		return 0, bolt.ErrTxNotWritable
+	}
+	r.b.seq++
+	return r.b.seq, nil
+}
+
+func (r memRef) SetSequence(v uint64) error {
+	if !r.tx.writable {
+		return bolt.ErrTxNotWritable
+	}
+	r.b.seq = v
+	return nil
+}
+
+// memCursor iterates over a memBucket. The position is an index into the
+// bucket's sorted keys.
+type memCursor struct {
+	b *memBucket
+	i int
+}
+
+func (c *memCursor) at(i int) ([]byte, []byte) {
+	if i < 0 || i >= len(c.b.keys) {
+		c.i = len(c.b.keys)
+		return nil, nil
+	}
+	c.i = i
+	k := c.b.keys[i]
+	return k, c.b.values[string(k)]
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *memCursor) Last() ([]byte, []byte) {
+	return c.at(len(c.b.keys) - 1)
+}
+
+func (c *memCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(c.b.index(seek))
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	return c.at(c.i + 1)
+}
+
+func (c *memCursor) Prev() ([]byte, []byte) {
+	return c.at(c.i - 1)
+}
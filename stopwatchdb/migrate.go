@@ -0,0 +1,244 @@
+package stopwatchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// keySchemaVersion is the state bucket key holding the schema version.
+const keySchemaVersion = "schemaVersion"
+
+// baseSchemaVersion is the version of databases created before schema
+// versioning was introduced. These have no version stored.
+const baseSchemaVersion = 1
+
+// Migration is a single step upgrading the database layout from the previous
+// schema version to Version.
+type Migration struct {
+	// Version is the schema version after the migration has been applied
+	Version int
+	// Description tells what the migration does
+	Description string
+
+	apply func(tx kvTx) error
+}
+
+// migrations lists all schema migrations in the order they must be applied.
+// Each entry must have a Version one greater than the previous one.
+var migrations = []Migration{
+	{
+		Version:     2,
+		Description: "binary slice records with nanosecond start keys",
+		apply:       migrateBinarySlices,
+	},
+	{
+		Version:     3,
+		Description: "set of active tasks in place of a single active task",
+		apply:       migrateActiveTasks,
+	},
+	{
+		Version:     4,
+		Description: "task description, reference and billable flag",
+		apply:       migrateTaskMetadata,
+	},
+	{
+		Version:     5,
+		Description: "cost code registry with the codes used by tasks",
+		apply:       migrateCostCodes,
+	},
+}
+
+// LatestSchemaVersion returns the schema version this package reads and writes.
+func LatestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return baseSchemaVersion
+	}
+
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the schema version of the open database.
+func (db *StopwatchDB) SchemaVersion() (int, error) {
+	if db.IsOpen() == false {
+		return 0, errors.New("database not ready")
+	}
+
+	var v int
+	err := db.db.View(func(tx kvTx) error {
+		v = getVersion(tx)
+		return nil
+	})
+
+	return v, err
+}
+
+// PendingMigrations returns the migrations not yet applied to the database.
+func (db *StopwatchDB) PendingMigrations() ([]Migration, error) {
+	v, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if v > LatestSchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than supported version %d", v, LatestSchemaVersion())
+	}
+
+	res := []Migration{}
+	for _, m := range migrations {
+		if m.Version > v {
+			res = append(res, m)
+		}
+	}
+
+	return res, nil
+}
+
+// Migrate applies pending migrations. A snapshot of the database is written to
+// the backup directory before anything is changed, and all migrations are run
+// in a single transaction. Returns the applied migrations.
+func (db *StopwatchDB) Migrate() ([]Migration, error) {
+	return db.migrate(true)
+}
+
+// migrate applies pending migrations, taking a snapshot first if backup is
+// set.
+func (db *StopwatchDB) migrate(backup bool) ([]Migration, error) {
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pending) == 0 {
+		return pending, nil
+	}
+
+	v, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if backup {
+		if _, err = db.Backup(BackupMigrate); err != nil {
+			return nil, fmt.Errorf("backup before migration failed: %s", err)
+		}
+	}
+
+	if err = db.db.Update(func(tx kvTx) error {
+		for _, m := range pending {
+			log.Printf("migrating to schema version %d: %s", m.Version, m.Description)
+			if err := m.apply(tx); err != nil {
+				return fmt.Errorf("migration to version %d failed: %s", m.Version, err)
+			}
+
+			if err := putVersion(tx, m.Version); err != nil {
+				return err
+			}
+		}
+
+		return db.audit(tx, AuditMigrate, 0, 0, v, pending[len(pending)-1].Version)
+	}); err != nil {
+		return nil, err
+	}
+
+	return pending, nil
+}
+
+// getVersion reads the schema version within a transaction.
+func getVersion(tx kvTx) int {
+	buf := tx.Bucket([]byte(BucketState)).Get([]byte(keySchemaVersion))
+	if len(buf) != 8 {
+		return baseSchemaVersion
+	}
+
+	return Btoi(buf)
+}
+
+// putVersion writes the schema version within a transaction.
+func putVersion(tx kvTx, v int) error {
+	return tx.Bucket([]byte(BucketState)).Put([]byte(keySchemaVersion), Itob(v))
+}
+
+// migrateActiveTasks replaces the single active task state with a list of
+// active tasks.
+func migrateActiveTasks(tx kvTx) error {
+	b := tx.Bucket([]byte(BucketState))
+	active := []model.ActiveTask{}
+
+	if buf := b.Get([]byte("activeTask")); buf != nil {
+		var at model.ActiveTask
+		if err := json.Unmarshal(buf, &at); err != nil {
+			return err
+		}
+
+		if at.GroupID != 0 || at.TaskID != 0 {
+			active = append(active, at)
+		}
+
+		if err := b.Delete([]byte("activeTask")); err != nil {
+			return err
+		}
+	}
+
+	return putActiveTasks(tx, active)
+}
+
+// migrateTaskMetadata marks existing tasks billable, which is the default for
+// new tasks. Description and reference are left empty.
+func migrateTaskMetadata(tx kvTx) error {
+	bt := tx.Bucket([]byte(BucketTasks))
+
+	groups := [][]byte{}
+	if err := bt.ForEach(func(k, v []byte) error {
+		if v == nil {
+			groups = append(groups, append([]byte{}, k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		b := bt.Bucket(g)
+		updates := map[string][]byte{}
+		if err := b.ForEach(func(k, v []byte) error {
+			var t model.Task
+			if err := json.Unmarshal(v, &t); err != nil {
+				log.Printf("skipping unreadable task %d:%d: %s", Btoi(g), Btoi(k), err)
+				return nil
+			}
+
+			t.Billable = true
+			buf, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+
+			updates[string(k)] = buf
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for k, buf := range updates {
+			if err := b.Put([]byte(k), buf); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateCostCodes registers the cost codes used by existing tasks, so that
+// they can still be set on tasks with strict cost codes.
+func migrateCostCodes(tx kvTx) error {
+	if _, err := tx.CreateBucketIfNotExists([]byte(BucketCostCodes)); err != nil {
+		return err
+	}
+
+	return registerTaskCostCodes(tx)
+}
@@ -0,0 +1,158 @@
+package stopwatchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+func TestMigrateTaskMetadata(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	task, _ := db.AddTask(g.ID, "task", "code")
+
+	// Tasks written before schema version 4 have no billable flag.
+	if err := db.db.Update(func(tx kvTx) error {
+		buf, _ := json.Marshal(map[string]interface{}{"id": task.ID, "groupid": g.ID, "name": "task", "costcode": "code", "duration": "0s"})
+		if err := tx.Bucket([]byte(BucketTasks)).Bucket(Itob(g.ID)).Put(Itob(task.ID), buf); err != nil {
+			return err
+		}
+		return putVersion(tx, 3)
+	}); err != nil {
+		t.Fatalf("Unable to write legacy task: %s", err)
+	}
+
+	if migrated, err := db.Migrate(); err != nil || len(migrated) != LatestSchemaVersion()-3 || migrated[0].Version != 4 {
+		t.Fatalf("Wrong migrations: %+v, %v", migrated, err)
+	}
+
+	if task, _ = db.GetTask(g.ID, task.ID); !task.Billable || task.Name != "task" {
+		t.Errorf("Task not billable after migration: %+v", task)
+	}
+}
+
+func TestUsageBillable(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		b, _ := db.AddTask(g.ID, "b", "code")
+
+		b.Billable = false
+		b.Description = "internal work"
+		b.Reference = "https://example.com/issue/1"
+		db.SaveTask(b)
+
+		start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+		db.SetSlice(g.ID, b.ID, start.Add(time.Hour), start.Add(90*time.Minute))
+
+		rep, err := db.GetUsage(g.ID, start, start)
+		if err != nil {
+			t.Fatalf("Unable to get usage: %s", err)
+		}
+		if rep.Billable.Duration != time.Hour || rep.NonBillable.Duration != 30*time.Minute {
+			t.Errorf("Wrong billable totals: %s, %s", rep.Billable, rep.NonBillable)
+		}
+
+		var tasks []*model.Task
+		if tasks, _ = db.ReadTasks(g.ID, false); len(tasks) != 2 || tasks[1].Reference != b.Reference || tasks[1].Description != b.Description {
+			t.Errorf("Metadata not read: %+v", tasks)
+		}
+	})
+}
+
+func TestOpenNewSchemaVersion(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	// New databases need no migrations.
+	if v, err := db.SchemaVersion(); err != nil || v != LatestSchemaVersion() {
+		t.Errorf("New database has version %d, expected %d: %v", v, LatestSchemaVersion(), err)
+	}
+	if pending, err := db.PendingMigrations(); err != nil || len(pending) != 0 {
+		t.Errorf("Migrations pending for new database: %+v, %v", pending, err)
+	}
+}
+
+func TestOpenNewerSchema(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	path := db.path
+	if err := db.db.Update(func(tx kvTx) error {
+		return putVersion(tx, LatestSchemaVersion()+1)
+	}); err != nil {
+		t.Fatalf("Unable to set version: %s", err)
+	}
+
+	if _, err := db.PendingMigrations(); err == nil {
+		t.Errorf("Newer schema version accepted")
+	}
+	if _, err := db.Migrate(); err == nil {
+		t.Errorf("Migrated newer schema version")
+	}
+
+	db.Close()
+	if err := db.Open(path); err == nil || db.IsOpen() {
+		t.Fatalf("Opened database with newer schema version")
+	}
+
+	// The database is left as is.
+	db.SetAutoMigrate(false)
+	if err := db.Open(path); err != nil {
+		t.Fatalf("Unable to open without migrations: %s", err)
+	}
+	if v, _ := db.SchemaVersion(); v != LatestSchemaVersion()+1 {
+		t.Errorf("Schema version changed to %d", v)
+	}
+}
+
+func TestMigrateRollback(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	latest := LatestSchemaVersion()
+	saved := migrations
+	defer func() { migrations = saved }()
+
+	// The first step succeeds and the second fails, so neither is kept.
+	migrations = append(append([]Migration{}, saved...),
+		Migration{
+			Version: latest + 1,
+			apply: func(tx kvTx) error {
+				return tx.Bucket([]byte(BucketState)).Put([]byte("migrated"), []byte{1})
+			},
+		},
+		Migration{
+			Version: latest + 2,
+			apply:   func(tx kvTx) error { return errors.New("failed") },
+		},
+	)
+
+	if _, err := db.Migrate(); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("version %d failed", latest+2)) {
+		t.Fatalf("Expected failed migration, got %v", err)
+	}
+
+	if v, _ := db.SchemaVersion(); v != latest {
+		t.Errorf("Schema version changed to %d after failed migration", v)
+	}
+	db.db.View(func(tx kvTx) error {
+		if tx.Bucket([]byte(BucketState)).Get([]byte("migrated")) != nil {
+			t.Errorf("Changes of a failed migration kept")
+		}
+		return nil
+	})
+	if pending, _ := db.PendingMigrations(); len(pending) != 2 {
+		t.Errorf("Wrong pending migrations after failure: %+v", pending)
+	}
+	if entries, _ := db.ReadAudit(AuditFilter{}); len(entries) != 0 {
+		t.Errorf("Failed migration audited: %+v", entries)
+	}
+}
@@ -0,0 +1,134 @@
+package stopwatchdb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ParallelMode tells how time is reported when several tasks run at once
+type ParallelMode int
+
+// Parallel time reporting modes
+const (
+	// ParallelFull counts the time in full for each running task
+	ParallelFull ParallelMode = iota
+	// ParallelSplit divides the time evenly between the running tasks
+	ParallelSplit
+)
+
+// ParseParallelMode returns the mode matching given name, "full" or "split".
+func ParseParallelMode(name string) (ParallelMode, error) {
+	switch name {
+	case "full":
+		return ParallelFull, nil
+	case "split":
+		return ParallelSplit, nil
+	default:
+		return ParallelFull, fmt.Errorf("unknown parallel mode '%s'", name)
+	}
+}
+
+// splitParallel returns the share of each period when time where periods
+// overlap is divided evenly between the overlapping periods.
+func splitParallel(periods []Slice) []time.Duration {
+	type event struct {
+		at    time.Time
+		index int
+		start bool
+	}
+
+	events := make([]event, 0, len(periods)*2)
+	for i, p := range periods {
+		if !p.End.After(p.Start) {
+			continue
+		}
+		events = append(events, event{p.Start, i, true}, event{p.End, i, false})
+	}
+
+	// Ends sort before starts at the same instant, so that adjacent periods
+	// don't count as overlapping.
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].at.Equal(events[j].at) {
+			return events[i].at.Before(events[j].at)
+		}
+		return !events[i].start && events[j].start
+	})
+
+	shares := make([]time.Duration, len(periods))
+	running := map[int]bool{}
+	var prev time.Time
+
+	for _, e := range events {
+		if len(running) > 0 {
+			share := e.at.Sub(prev) / time.Duration(len(running))
+			for i := range running {
+				shares[i] += share
+			}
+		}
+
+		if e.start {
+			running[e.index] = true
+		} else {
+			delete(running, e.index)
+		}
+		prev = e.at
+	}
+
+	return shares
+}
+
+// sliceDurations returns the reported duration of each given slice. In
+// ParallelSplit mode slices of all tasks between min and max keys, and the
+// slice of each task just before min, are taken into account, and time
+// overlapping with them is divided. Given slices are those of the tasks in
+// buckets between min and max.
+func (db *StopwatchDB) sliceDurations(slices []Slice, buckets map[string]bool, min, max []byte) ([]time.Duration, error) {
+	if db.parallel != ParallelSplit {
+		res := make([]time.Duration, len(slices))
+		for i, s := range slices {
+			res[i] = s.End.Sub(s.Start)
+		}
+		return res, nil
+	}
+
+	periods := append([]Slice{}, slices...)
+	if err := db.db.View(func(tx kvTx) error {
+		bs := tx.Bucket([]byte(BucketSlices))
+		return bs.ForEach(func(name, v []byte) error {
+			if v != nil {
+				return nil
+			}
+
+			// A slice starting before min may still run into the range.
+			c := bs.Bucket(name).Cursor()
+			k, v := c.Seek(min)
+			if k == nil {
+				k, v = c.Last()
+			} else if k, v = c.Prev(); k == nil {
+				k, v = c.First()
+			}
+
+			for ; k != nil && bytes.Compare(k, max) < 0; k, v = c.Next() {
+				// Slices of the given tasks within the range are already included.
+				if buckets[string(name)] && bytes.Compare(k, min) >= 0 {
+					break
+				}
+
+				start, r, err := decodeSliceEntry(k, v)
+				if err != nil || r.Open() {
+					continue
+				}
+
+				periods = append(periods, Slice{Start: start, End: r.End})
+			}
+
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return splitParallel(periods)[:len(slices)], nil
+}
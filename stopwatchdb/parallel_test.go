@@ -0,0 +1,140 @@
+package stopwatchdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitParallel(t *testing.T) {
+	at := func(h, m int) time.Time {
+		return time.Date(2017, 12, 5, h, m, 0, 0, time.UTC)
+	}
+
+	periods := []Slice{
+		{Start: at(8, 0), End: at(10, 0)},
+		{Start: at(9, 0), End: at(11, 0)},
+		{Start: at(9, 30), End: at(10, 0)},
+		{Start: at(11, 0), End: at(12, 0)},
+	}
+	want := []time.Duration{
+		// Alone for an hour, shared by two for 30 min, by three for 30 min.
+		60*time.Minute + 15*time.Minute + 10*time.Minute,
+		15*time.Minute + 10*time.Minute + 60*time.Minute,
+		10 * time.Minute,
+		// Adjacent periods don't overlap.
+		60 * time.Minute,
+	}
+
+	for i, d := range splitParallel(periods) {
+		if d != want[i] {
+			t.Errorf("Period %d has share %s (not %s)", i, d, want[i])
+		}
+	}
+}
+
+func TestMultiTimer(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+	db.SetMultiTimer(true)
+
+	g, _ := db.AddGroup("group")
+	a, _ := db.AddTask(g.ID, "a", "code")
+	b, _ := db.AddTask(g.ID, "b", "code")
+
+	db.SwitchTask(g.ID, a.ID)
+	db.SwitchTask(g.ID, b.ID)
+
+	active, err := db.GetActiveTasks()
+	if err != nil || len(active) != 2 || active[0].Running == nil || active[1].Running == nil {
+		t.Fatalf("Expected two running tasks, got %+v, %v", active, err)
+	}
+
+	if _, err = db.StopTask(g.ID, a.ID); err != nil {
+		t.Fatalf("Unable to stop a: %s", err)
+	}
+
+	if active, _ = db.GetActiveTasks(); len(active) != 1 || active[0].ID != b.ID {
+		t.Errorf("Expected b to be the only active task, got %+v", active)
+	}
+
+	// Back to a single timer, switching to a task that is still running stops
+	// the rest.
+	db.SwitchTask(g.ID, a.ID)
+	db.SetMultiTimer(false)
+	if _, err = db.SwitchTask(g.ID, b.ID); err != nil {
+		t.Fatalf("Unable to switch to b: %s", err)
+	}
+	if active, _ = db.GetActiveTasks(); len(active) != 1 || active[0].ID != b.ID || active[0].Running == nil {
+		t.Errorf("Expected b to be the only active task, got %+v", active)
+	}
+	if a, _ = db.GetTask(g.ID, a.ID); a.Running != nil {
+		t.Errorf("Task a still running: %+v", a)
+	}
+
+	// Switching back stops b.
+	db.SwitchTask(g.ID, a.ID)
+	if active, _ = db.GetActiveTasks(); len(active) != 1 || active[0].ID != a.ID {
+		t.Errorf("Expected a to be the only active task, got %+v", active)
+	}
+
+	if b, _ = db.GetTask(g.ID, b.ID); b.Running != nil {
+		t.Errorf("Task b still running: %+v", b)
+	}
+}
+
+func TestGetUsageParallel(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	a, _ := db.AddTask(g.ID, "a", "meeting")
+	other, _ := db.AddGroup("other")
+	b, _ := db.AddTask(other.ID, "b", "migration")
+
+	start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+	db.SetSlice(g.ID, a.ID, start, start.Add(2*time.Hour))
+	db.SetSlice(other.ID, b.ID, start.Add(time.Hour), start.Add(3*time.Hour))
+
+	for mode, want := range map[ParallelMode]time.Duration{
+		ParallelFull:  2 * time.Hour,
+		ParallelSplit: 90 * time.Minute,
+	} {
+		db.SetParallelMode(mode)
+		rep, err := db.GetUsage(g.ID, start, start)
+		if err != nil {
+			t.Fatalf("Unable to get usage: %s", err)
+		}
+
+		if rep.Combined.Duration != want {
+			t.Errorf("Mode %d reported %s (not %s)", mode, rep.Combined, want)
+		}
+	}
+}
+
+func TestGetUsageParallelRangeStart(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+	db.SetParallelMode(ParallelSplit)
+
+	g, _ := db.AddGroup("group")
+	a, _ := db.AddTask(g.ID, "a", "meeting")
+	c, _ := db.AddTask(g.ID, "c", "meeting")
+	other, _ := db.AddGroup("other")
+	b, _ := db.AddTask(other.ID, "b", "migration")
+
+	// Slices of b and c start the day before and overlap the start of a.
+	start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+	db.SetSlice(g.ID, a.ID, start, start.Add(2*time.Hour))
+	db.SetSlice(g.ID, c.ID, start.Add(-10*time.Hour), start.Add(30*time.Minute))
+	db.SetSlice(other.ID, b.ID, start.Add(-9*time.Hour), start.Add(time.Hour))
+
+	rep, err := db.GetUsage(g.ID, start, start)
+	if err != nil {
+		t.Fatalf("Unable to get usage: %s", err)
+	}
+
+	// Shared by three for 30 min, by two for 30 min, alone for an hour.
+	if want := 10*time.Minute + 15*time.Minute + time.Hour; rep.Combined.Duration != want {
+		t.Errorf("Reported %s (not %s)", rep.Combined, want)
+	}
+}
@@ -0,0 +1,257 @@
+package stopwatchdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Slices are stored in a bucket per task under BucketSlices. The key of a
+// slice is its start time in nanoseconds since the Unix epoch, as an 8-byte
+// big endian value, so that slices sort by start time. The value is a record
+// with the following layout:
+//
+//	byte  0     record format, sliceFormat
+//	byte  1     flags, see sliceFlag constants
+//	bytes 2-9   end time in nanoseconds since the Unix epoch, 0 while running
+//	bytes 10-   metadata, optional JSON object, see sliceMeta
+const (
+	sliceFormat     = 1
+	sliceHeaderSize = 10
+	sliceKeySize    = 8
+)
+
+// Slice flags
+const (
+	// sliceFlagReview marks a slice that was ended automatically and should be
+	// checked by the user
+	sliceFlagReview byte = 1 << iota
+)
+
+// sliceRecord is a decoded slice value
+type sliceRecord struct {
+	// End of the slice. Zero while the slice is still open.
+	End time.Time
+	// Flags of the slice
+	Flags byte
+	// Meta is the raw metadata of the slice
+	Meta []byte
+}
+
+// sliceMeta is the metadata of a slice. Unknown fields of stored metadata are
+// kept when it's updated.
+type sliceMeta struct {
+	// Note describes the work done during the slice
+	Note string `json:"note,omitempty"`
+}
+
+// Note returns the note of the slice. Metadata that can't be parsed has no
+// note.
+func (r sliceRecord) Note() string {
+	var m sliceMeta
+	if len(r.Meta) == 0 || json.Unmarshal(r.Meta, &m) != nil {
+		return ""
+	}
+	return m.Note
+}
+
+// SetNote sets the note of the slice, removing it when empty.
+func (r *sliceRecord) SetNote(note string) error {
+	fields := map[string]json.RawMessage{}
+	if len(r.Meta) > 0 {
+		if err := json.Unmarshal(r.Meta, &fields); err != nil {
+			return fmt.Errorf("invalid slice metadata: %s", err)
+		}
+	}
+
+	if note == "" {
+		delete(fields, "note")
+	} else {
+		buf, err := json.Marshal(note)
+		if err != nil {
+			return err
+		}
+		fields["note"] = buf
+	}
+
+	if len(fields) == 0 {
+		r.Meta = nil
+		return nil
+	}
+
+	buf, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	r.Meta = buf
+	return nil
+}
+
+// Open tells if the slice has not been ended yet.
+func (r sliceRecord) Open() bool {
+	return r.End.IsZero()
+}
+
+// sliceBucketID returns the name of the slice bucket for a task.
+func sliceBucketID(group, task int) []byte {
+	return bytes.Join([][]byte{Itob(group), Itob(task)}, []byte("-"))
+}
+
+// sliceKey returns the slice key for given start time.
+func sliceKey(start time.Time) []byte {
+	b := make([]byte, sliceKeySize)
+	binary.BigEndian.PutUint64(b, uint64(start.UnixNano()))
+	return b
+}
+
+// sliceStart returns the start time for given slice key.
+func sliceStart(k []byte) (time.Time, error) {
+	if len(k) != sliceKeySize {
+		return time.Time{}, fmt.Errorf("invalid slice key length %d", len(k))
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k))).UTC(), nil
+}
+
+// encodeSlice returns the stored representation of a slice record.
+func encodeSlice(r sliceRecord) []byte {
+	b := make([]byte, sliceHeaderSize, sliceHeaderSize+len(r.Meta))
+	b[0] = sliceFormat
+	b[1] = r.Flags
+	if !r.End.IsZero() {
+		binary.BigEndian.PutUint64(b[2:sliceHeaderSize], uint64(r.End.UnixNano()))
+	}
+
+	return append(b, r.Meta...)
+}
+
+// decodeSlice parses a stored slice record.
+func decodeSlice(v []byte) (sliceRecord, error) {
+	var r sliceRecord
+
+	if len(v) < sliceHeaderSize {
+		return r, fmt.Errorf("invalid slice record length %d", len(v))
+	}
+
+	if v[0] != sliceFormat {
+		return r, fmt.Errorf("unsupported slice record format %d", v[0])
+	}
+
+	r.Flags = v[1]
+	if end := binary.BigEndian.Uint64(v[2:sliceHeaderSize]); end != 0 {
+		r.End = time.Unix(0, int64(end)).UTC()
+	}
+
+	if len(v) > sliceHeaderSize {
+		r.Meta = append([]byte{}, v[sliceHeaderSize:]...)
+	}
+
+	return r, nil
+}
+
+// decodeSliceEntry parses both the key and the value of a stored slice.
+func decodeSliceEntry(k, v []byte) (time.Time, sliceRecord, error) {
+	start, err := sliceStart(k)
+	if err != nil {
+		return start, sliceRecord{}, err
+	}
+
+	r, err := decodeSlice(v)
+	return start, r, err
+}
+
+// migrateBinarySlices converts slices keyed and valued by RFC 3339 strings into
+// binary slice records. Entries that can't be parsed are dropped, as they were
+// never included in reports either.
+func migrateBinarySlices(tx kvTx) error {
+	type entry struct {
+		key []byte
+		val []byte
+	}
+
+	bs := tx.Bucket([]byte(BucketSlices))
+
+	// Collect bucket names first, buckets are replaced during conversion.
+	names := [][]byte{}
+	if err := bs.ForEach(func(k, v []byte) error {
+		if v == nil {
+			names = append(names, append([]byte{}, k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		entries := []entry{}
+		if err := bs.Bucket(name).ForEach(func(k, v []byte) error {
+			start, err := time.Parse(time.RFC3339, string(k))
+			if err != nil {
+				log.Printf("dropping slice with invalid start '%s': %s", k, err)
+				return nil
+			}
+
+			r := sliceRecord{}
+			if len(v) != 0 {
+				if r.End, err = time.Parse(time.RFC3339, string(v)); err != nil {
+					log.Printf("dropping slice %s with invalid end '%s': %s", k, v, err)
+					return nil
+				}
+			}
+
+			entries = append(entries, entry{sliceKey(start), encodeSlice(r)})
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if err := bs.DeleteBucket(name); err != nil {
+			return err
+		}
+
+		b, err := bs.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err := b.Put(e.key, e.val); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// nextDay returns the start of the day following t in given location.
+func nextDay(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+}
+
+// splitDays splits the period from start to end into consecutive periods that
+// don't cross midnight in given location. Each period ends where the next one
+// starts.
+func splitDays(start, end time.Time, loc *time.Location) []Slice {
+	res := []Slice{}
+
+	for {
+		next := nextDay(start, loc)
+		if !next.Before(end) {
+			break
+		}
+
+		res = append(res, Slice{Start: start, End: next.UTC()})
+		start = next.UTC()
+	}
+
+	return append(res, Slice{Start: start, End: end})
+}
+
+// errSliceNotFound is returned when a slice doesn't exist for given start time.
+var errSliceNotFound = errors.New("slice not found")
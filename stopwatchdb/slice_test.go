@@ -0,0 +1,179 @@
+package stopwatchdb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSliceRecord(t *testing.T) {
+	end := time.Date(2017, 12, 5, 10, 30, 0, 123, time.UTC)
+	in := sliceRecord{End: end, Flags: 0x2, Meta: []byte(`{"a":1}`)}
+
+	out, err := decodeSlice(encodeSlice(in))
+	if err != nil {
+		t.Fatalf("Unable to decode slice: %s", err)
+	}
+
+	if !out.End.Equal(end) || out.Flags != in.Flags || !bytes.Equal(out.Meta, in.Meta) {
+		t.Errorf("Decoded slice differs: %+v (not %+v)", out, in)
+	}
+
+	if out, err = decodeSlice(encodeSlice(sliceRecord{})); err != nil || !out.Open() {
+		t.Errorf("Open slice not decoded as open: %+v, %v", out, err)
+	}
+
+	if _, err = decodeSlice([]byte("2017-12-05T10:30:00Z")); err == nil {
+		t.Error("Expected error decoding a legacy slice value")
+	}
+}
+
+func TestSliceKeyOrder(t *testing.T) {
+	a := time.Date(2017, 12, 5, 10, 30, 0, 0, time.UTC)
+	b := a.Add(time.Nanosecond)
+	c := a.Add(24 * time.Hour)
+
+	if bytes.Compare(sliceKey(a), sliceKey(b)) >= 0 || bytes.Compare(sliceKey(b), sliceKey(c)) >= 0 {
+		t.Error("Slice keys don't sort by start time")
+	}
+
+	if s, err := sliceStart(sliceKey(b)); err != nil || !s.Equal(b) {
+		t.Errorf("Wrong start from slice key: %s, %v", s, err)
+	}
+}
+
+func TestRestartWithinSecond(t *testing.T) {
+	db, done := openTestDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	task, _ := db.AddTask(g.ID, "task", "code")
+
+	for i := 0; i < 3; i++ {
+		if _, err := db.StartTask(g.ID, task.ID); err != nil {
+			t.Fatalf("Unable to start task: %s", err)
+		}
+		if _, err := db.StopTask(g.ID, task.ID); err != nil {
+			t.Fatalf("Unable to stop task: %s", err)
+		}
+	}
+
+	now := time.Now()
+	res, err := db.GetSlices(g.ID, now.AddDate(0, 0, -1), now.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("Unable to read slices: %s", err)
+	}
+
+	if len(res) != 1 || len(res[0].Slices) != 3 {
+		t.Errorf("Expected 3 slices, got %+v", res)
+	}
+}
+
+func TestSliceNote(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		task, _ := db.AddTask(g.ID, "task", "code")
+
+		db.SwitchTask(g.ID, task.ID)
+		if _, err := db.StopTaskNote(g.ID, task.ID, "fixed the build"); err != nil {
+			t.Fatalf("Unable to stop task: %s", err)
+		}
+
+		now := time.Now()
+		res, err := db.GetSlices(g.ID, now.AddDate(0, 0, -1), now.AddDate(0, 0, 1))
+		if err != nil || len(res) != 1 || res[0].Slices[0].Note != "fixed the build" {
+			t.Fatalf("Note not set when stopping: %+v, %v", res, err)
+		}
+
+		// Notes are kept when the slice is set, and can be changed and undone.
+		s := res[0].Slices[0]
+		db.SetSlice(g.ID, task.ID, s.Start, s.End.Add(time.Minute))
+		if n, err := db.SetSliceNote(g.ID, task.ID, s.Start, "reviewed PRs"); err != nil || n.Note != "reviewed PRs" || !n.End.Equal(s.End.Add(time.Minute)) {
+			t.Errorf("Wrong slice after setting note: %+v, %v", n, err)
+		}
+		db.Undo()
+
+		res, _ = db.GetSlices(g.ID, now.AddDate(0, 0, -1), now.AddDate(0, 0, 1))
+		if res[0].Slices[0].Note != "fixed the build" {
+			t.Errorf("Note not restored by undo: %+v", res[0].Slices[0])
+		}
+
+		if _, err = db.SetSliceNote(g.ID, task.ID, s.Start.Add(time.Second), "missing"); err == nil {
+			t.Error("Expected error setting note of a missing slice")
+		}
+	})
+
+	// Other metadata is kept.
+	r := sliceRecord{Meta: []byte(`{"a":1}`)}
+	if err := r.SetNote("note"); err != nil || r.Note() != "note" {
+		t.Fatalf("Unable to set note: %s, %v", r.Meta, err)
+	}
+	if r.SetNote(""); string(r.Meta) != `{"a":1}` {
+		t.Errorf("Wrong metadata after removing note: %s", r.Meta)
+	}
+}
+
+func TestMigrateBinarySlices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stopwatchdb")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data.dat")
+
+	// Create a database using the unversioned RFC 3339 layout.
+	db := New()
+	db.SetAutoMigrate(false)
+	if err = db.Open(path); err != nil {
+		t.Fatalf("Unable to open database: %s", err)
+	}
+	g, _ := db.AddGroup("group")
+	task, _ := db.AddTask(g.ID, "task", "code")
+	if err = db.db.Update(func(tx kvTx) error {
+		tx.Bucket([]byte(BucketState)).Delete([]byte(keySchemaVersion))
+		b := tx.Bucket([]byte(BucketSlices)).Bucket(sliceBucketID(g.ID, task.ID))
+		b.Put([]byte("2017-12-04T08:00:00Z"), []byte("2017-12-04T09:30:00Z"))
+		b.Put([]byte("2017-12-05T08:00:00Z"), []byte("2017-12-05T08:15:00Z"))
+		b.Put([]byte("2017-12-05T10:00:00Z"), []byte{})
+		return b.Put([]byte("garbage"), []byte("2017-12-05T10:00:00Z"))
+	}); err != nil {
+		t.Fatalf("Unable to write legacy slices: %s", err)
+	}
+	db.Close()
+
+	// Reopening migrates.
+	db = New()
+	if err = db.Open(path); err != nil {
+		t.Fatalf("Unable to open database: %s", err)
+	}
+	defer db.Close()
+
+	if v, _ := db.SchemaVersion(); v != LatestSchemaVersion() {
+		t.Errorf("Wrong schema version after migration: %d", v)
+	}
+
+	if snaps, err := db.Backups(); err != nil || len(snaps) != 1 || snaps[0].Reason != BackupMigrate {
+		t.Errorf("No backup taken before migration: %+v, %v", snaps, err)
+	}
+
+	res, err := db.GetSlices(g.ID, time.Date(2017, 12, 4, 0, 0, 0, 0, time.UTC), time.Date(2017, 12, 5, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Unable to read slices: %s", err)
+	}
+
+	if len(res) != 1 || len(res[0].Slices) != 2 {
+		t.Fatalf("Expected 2 closed slices, got %+v", res)
+	}
+
+	if d := res[0].Slices[0].End.Sub(res[0].Slices[0].Start); d != 90*time.Minute {
+		t.Errorf("Wrong duration for first slice: %s", d)
+	}
+
+	// The open slice is still running and can be stopped.
+	if _, err = db.StopTask(g.ID, task.ID); err != nil {
+		t.Errorf("Unable to stop migrated running slice: %s", err)
+	}
+}
@@ -0,0 +1,107 @@
+package stopwatchdb
+
+import (
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// Store is the interface of a stopwatch database. It is implemented by
+// StopwatchDB for both bolt backed and in-memory databases, see New and
+// NewMemory.
+type Store interface {
+	// Lifecycle and options.
+	Open(path string) error
+	Close() error
+	IsOpen() bool
+	SetAutoMigrate(enabled bool)
+	SetLocation(loc *time.Location)
+	Location() *time.Location
+	SetMultiTimer(enabled bool)
+	SetStrictCostCodes(enabled bool)
+	SetParallelMode(mode ParallelMode)
+	SetMaxDuration(d time.Duration)
+	SetDayEnd(d time.Duration)
+	SetGapThreshold(d time.Duration)
+	SetSource(source string)
+	SetUndoLimit(n int)
+	SetBackupDir(dir string)
+	SetBackupRetention(n int)
+	SetAutoBackup(enabled bool)
+
+	// Groups and tasks.
+	AddGroup(group string) (*model.Group, error)
+	GetGroup(group int) (*model.Group, error)
+	SaveGroup(group *model.Group) error
+	ReadGroups(archived bool) ([]model.Group, error)
+	ReadGroupTree(archived bool) ([]*GroupNode, error)
+	MoveGroup(group, parent int) (*model.Group, error)
+	SetGroupArchived(group int, archived bool) (*model.Group, error)
+	DeleteGroup(group int) error
+	AddTask(group int, task, costcode string) (*model.Task, error)
+	GetTask(group, task int) (*model.Task, error)
+	SaveTask(task *model.Task) error
+	SaveTaskFrom(task *model.Task, from time.Time) error
+	ReadTask(group, task int) (*model.Task, error)
+	ReadTasks(group int, archived bool) ([]*model.Task, error)
+	SetTaskArchived(group, task int, archived bool) (*model.Task, error)
+	DeleteTask(group, task int) error
+
+	// Timers.
+	StartTask(group, task int) (*model.Task, error)
+	StopTask(group, task int) (*model.Task, error)
+	StopTaskNote(group, task int, note string) (*model.Task, error)
+	SwitchTask(group, task int) (*model.Task, error)
+	GetActiveTask() (*model.Task, error)
+	GetActiveTasks() ([]*model.Task, error)
+	SetActiveTask(group, task int) error
+	CapForgotten() ([]CappedSlice, error)
+	Heartbeat() (*Gap, error)
+	CheckGap() (*Gap, error)
+	ResolveGap(action string) ([]*model.Task, error)
+	Shutdown() error
+
+	// History.
+	SaveHistory(history []model.HistoryTask) error
+	ReadHistory(archived bool) ([]model.Task, error)
+
+	// Slices and reports.
+	SetSlice(groupID, taskID int, start, end time.Time) (*model.Task, error)
+	RemoveSlice(groupID, taskID int, start time.Time) (*model.Task, error)
+	SetSliceNote(groupID, taskID int, start time.Time, note string) (*Slice, error)
+	ImportSlices(slices []ImportSlice) ([]ImportSlice, error)
+	GetSlices(group int, start, end time.Time) ([]TaskSlices, error)
+	GetUsage(group int, start, end time.Time) (*UsageReport, error)
+
+	// Cost codes.
+	ReadCostCodes(inactive bool) ([]model.CostCode, error)
+	SaveCostCode(code *model.CostCode) error
+	RenameCostCode(from, to string) (int, error)
+	SetTaskCostCode(group, task int, code string, from time.Time) (*model.Task, error)
+	ImportCostCodes(codes []model.CostCode) (*CostCodeResult, error)
+
+	// Tags.
+	SetTaskTags(group, task int, tags []string) (*model.Task, error)
+	GetTagUsage(group int, start, end time.Time, filter TagFilter) (*TagUsageReport, error)
+
+	// Audit log and undo.
+	ReadAudit(filter AuditFilter) ([]AuditEntry, error)
+	Undo() (*Change, error)
+	Redo() (*Change, error)
+
+	// Maintenance.
+	BackupDir() string
+	Backup(reason string) (*Snapshot, error)
+	AutoBackup() (*Snapshot, error)
+	Backups() ([]Snapshot, error)
+	Restore(snapshot string, force bool) error
+	Export() (*Export, error)
+	Import(doc *Export, merge bool) (*ImportResult, error)
+	Check() (*CheckReport, error)
+	Repair() (*CheckReport, error)
+	SchemaVersion() (int, error)
+	PendingMigrations() ([]Migration, error)
+	Migrate() ([]Migration, error)
+}
+
+var _ Store = (*StopwatchDB)(nil)
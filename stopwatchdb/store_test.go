@@ -0,0 +1,291 @@
+package stopwatchdb
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openMemoryDB opens a new in-memory database.
+func openMemoryDB(t *testing.T) (*StopwatchDB, func()) {
+	db := NewMemory()
+	if err := db.Open(""); err != nil {
+		t.Fatalf("Unable to open database: %s", err)
+	}
+
+	return db, func() { db.Close() }
+}
+
+// testBackends runs fn against a new database of each backend.
+func testBackends(t *testing.T, fn func(t *testing.T, db Store)) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) (*StopwatchDB, func())
+	}{
+		{"bolt", openTestDB},
+		{"memory", openMemoryDB},
+	}
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			db, done := b.open(t)
+			defer done()
+			fn(t, db)
+		})
+	}
+}
+
+func TestStoreGroupsAndTasks(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, err := db.AddGroup("group")
+		if err != nil || g.ID != 1 {
+			t.Fatalf("Unable to add group: %+v, %v", g, err)
+		}
+		db.AddGroup("other")
+
+		b, _ := db.AddTask(g.ID, "b", "code")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		if a.ID != b.ID+1 {
+			t.Errorf("Task IDs not sequential: %d, %d", b.ID, a.ID)
+		}
+
+		a.CostCode = "changed"
+		if err = db.SaveTask(a); err != nil {
+			t.Fatalf("Unable to save task: %s", err)
+		}
+		if a, _ = db.GetTask(g.ID, a.ID); a.CostCode != "changed" {
+			t.Errorf("Task not saved: %+v", a)
+		}
+
+		groups, err := db.ReadGroups(false)
+		if err != nil || len(groups) != 2 || groups[0].Name != "group" || groups[1].Name != "other" {
+			t.Errorf("Wrong groups: %+v, %v", groups, err)
+		}
+
+		tasks, err := db.ReadTasks(g.ID, false)
+		if err != nil || len(tasks) != 2 || tasks[0].ID != b.ID || tasks[1].ID != a.ID {
+			t.Errorf("Wrong tasks: %+v, %v", tasks, err)
+		}
+
+		if _, err = db.GetTask(g.ID, 99); err == nil {
+			t.Errorf("Expected error for missing task")
+		}
+	})
+}
+
+func TestStoreTimers(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		b, _ := db.AddTask(g.ID, "b", "code")
+
+		db.SwitchTask(g.ID, a.ID)
+		started, err := db.SwitchTask(g.ID, b.ID)
+		if err != nil {
+			t.Fatalf("Unable to switch to b: %s", err)
+		}
+
+		if at, _ := db.GetActiveTask(); at == nil || at.ID != b.ID {
+			t.Errorf("Wrong active task: %+v", at)
+		}
+
+		now := time.Now()
+		res, err := db.GetSlices(g.ID, now.AddDate(0, 0, -1), now.AddDate(0, 0, 1))
+		if err != nil || len(res) != 1 || res[0].ID != a.ID || !res[0].Slices[0].End.Equal(*started.Running) {
+			t.Errorf("Expected a to stop when b started, got %+v, %v", res, err)
+		}
+
+		if _, err = db.StopTask(g.ID, b.ID); err != nil {
+			t.Fatalf("Unable to stop b: %s", err)
+		}
+		if active, _ := db.GetActiveTasks(); len(active) != 0 {
+			t.Errorf("Active tasks left after stop: %+v", active)
+		}
+	})
+}
+
+func TestStoreSlices(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		task, _ := db.AddTask(g.ID, "task", "code")
+
+		day := time.Date(2017, 12, 5, 0, 0, 0, 0, time.UTC)
+		for _, h := range []int{14, 8, 11} {
+			start := day.Add(time.Duration(h) * time.Hour)
+			if _, err := db.SetSlice(g.ID, task.ID, start, start.Add(time.Hour)); err != nil {
+				t.Fatalf("Unable to set slice: %s", err)
+			}
+		}
+		db.RemoveSlice(g.ID, task.ID, day.Add(11*time.Hour))
+
+		res, err := db.GetSlices(g.ID, day, day)
+		if err != nil || len(res) != 1 || len(res[0].Slices) != 2 {
+			t.Fatalf("Expected two slices, got %+v, %v", res, err)
+		}
+		if s := res[0].Slices; s[0].Start.Hour() != 8 || s[1].Start.Hour() != 14 {
+			t.Errorf("Slices not in order: %+v", s)
+		}
+
+		rep, err := db.GetUsage(g.ID, day, day)
+		if err != nil || len(rep.Dates) != 1 || rep.Combined.Duration != 2*time.Hour {
+			t.Errorf("Wrong usage: %+v, %v", rep, err)
+		}
+
+		if rep, err := db.Check(); err != nil || len(rep.Problems) != 0 {
+			t.Errorf("Unexpected problems: %+v, %v", rep, err)
+		}
+	})
+}
+
+func TestStoreArchiveDelete(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		b, _ := db.AddTask(g.ID, "b", "code")
+
+		if _, err := db.SetTaskArchived(g.ID, a.ID, true); err != nil {
+			t.Fatalf("Unable to archive task: %s", err)
+		}
+		if _, err := db.StartTask(g.ID, a.ID); err == nil {
+			t.Errorf("Started an archived task")
+		}
+		if tasks, _ := db.ReadTasks(g.ID, false); len(tasks) != 1 || tasks[0].ID != b.ID {
+			t.Errorf("Archived task listed: %+v", tasks)
+		}
+
+		db.StartTask(g.ID, b.ID)
+		if err := db.DeleteTask(g.ID, b.ID); err != nil {
+			t.Fatalf("Unable to delete task: %s", err)
+		}
+		if at, _ := db.GetActiveTask(); at != nil {
+			t.Errorf("Deleted task still active: %+v", at)
+		}
+
+		if err := db.DeleteGroup(g.ID); err != nil {
+			t.Fatalf("Unable to delete group: %s", err)
+		}
+		if groups, _ := db.ReadGroups(true); len(groups) != 0 {
+			t.Errorf("Deleted group listed: %+v", groups)
+		}
+	})
+}
+
+func TestKVRollback(t *testing.T) {
+	testBackends(t, func(t *testing.T, s Store) {
+		db := s.(*StopwatchDB)
+		fail := errors.New("fail")
+
+		err := db.db.Update(func(tx kvTx) error {
+			b, _ := tx.CreateBucketIfNotExists([]byte("test"))
+			b.Put([]byte("key"), []byte("value"))
+			return fail
+		})
+		if err != fail {
+			t.Fatalf("Expected update to fail, got %v", err)
+		}
+
+		db.db.View(func(tx kvTx) error {
+			if tx.Bucket([]byte("test")) != nil {
+				t.Errorf("Failed update was not rolled back")
+			}
+			return nil
+		})
+	})
+}
+
+func TestKVCursor(t *testing.T) {
+	testBackends(t, func(t *testing.T, s Store) {
+		db := s.(*StopwatchDB)
+
+		if err := db.db.Update(func(tx kvTx) error {
+			b, _ := tx.CreateBucketIfNotExists([]byte("test"))
+			for _, k := range []string{"b", "d", "a"} {
+				b.Put([]byte(k), []byte(k+k))
+			}
+			_, err := b.CreateBucket([]byte("c"))
+			return err
+		}); err != nil {
+			t.Fatalf("Unable to write: %s", err)
+		}
+
+		db.db.View(func(tx kvTx) error {
+			b := tx.Bucket([]byte("test"))
+			if b.Bucket([]byte("missing")) != nil {
+				t.Errorf("Missing bucket is not nil")
+			}
+
+			var keys []string
+			b.ForEach(func(k, v []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+			if len(keys) != 4 || keys[0] != "a" || keys[3] != "d" {
+				t.Errorf("Wrong key order: %v", keys)
+			}
+
+			c := b.Cursor()
+			if k, v := c.Seek([]byte("bb")); string(k) != "c" || v != nil {
+				t.Errorf("Seek found %s = %s", k, v)
+			}
+			if k, v := c.Prev(); string(k) != "b" || string(v) != "bb" {
+				t.Errorf("Prev found %s = %s", k, v)
+			}
+			if k, _ := c.Last(); string(k) != "d" {
+				t.Errorf("Last found %s", k)
+			}
+			if k, _ := c.Next(); k != nil {
+				t.Errorf("Next after last found %s", k)
+			}
+			return nil
+		})
+	})
+}
+
+func TestMemoryCopyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stopwatchdb")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, done := openMemoryDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("group")
+	db.AddTask(g.ID, "task", "code")
+
+	path := filepath.Join(dir, "copy.dat")
+	if err = db.db.View(func(tx kvTx) error {
+		return tx.CopyFile(path, 0600)
+	}); err != nil {
+		t.Fatalf("Unable to copy database: %s", err)
+	}
+
+	cp := New()
+	if err = cp.Open(path); err != nil {
+		t.Fatalf("Unable to open copy: %s", err)
+	}
+	defer cp.Close()
+
+	if task, err := cp.GetTask(g.ID, 1); err != nil || task.Name != "task" {
+		t.Errorf("Task not copied: %+v, %v", task, err)
+	}
+
+	// Sequences carry over to the copy.
+	if next, _ := cp.AddTask(g.ID, "next", "code"); next == nil || next.ID != 2 {
+		t.Errorf("Wrong ID for next task: %+v", next)
+	}
+
+	var key []byte
+	cp.db.View(func(tx kvTx) error {
+		key, _ = tx.Bucket([]byte(BucketGroups)).Cursor().First()
+		return nil
+	})
+	if !bytes.Equal(key, Itob(g.ID)) {
+		t.Errorf("Wrong group key in copy: %v", key)
+	}
+}
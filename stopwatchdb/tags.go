@@ -0,0 +1,145 @@
+package stopwatchdb
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// TagFilter selects the tasks counted in a tag report. Empty lists don't limit
+// the tasks.
+type TagFilter struct {
+	// Include selects tasks that have any of the tags.
+	Include []string
+	// Exclude leaves out tasks that have any of the tags.
+	Exclude []string
+}
+
+// TagUsage is time used per tag over a period of time.
+type TagUsage struct {
+	Tag   string
+	Usage []Usage
+	Total model.TaskDuration
+}
+
+// TagUsageReport is a time usage report of one group by tag. Time of tasks
+// with several tags is counted for each of them, and once in the totals.
+type TagUsageReport struct {
+	// Dates is an array with the dates in the report
+	Dates []Usage
+	// Tags contains the time used per tag, in alphabetical order. Time of tasks
+	// without tags is under an empty tag.
+	Tags []TagUsage
+	// Combined is the combined total time used
+	Combined model.TaskDuration
+	// Billable is the time used on billable tasks
+	Billable model.TaskDuration
+	// NonBillable is the time used on non-billable tasks
+	NonBillable model.TaskDuration
+}
+
+// Match tells if a task is selected by the filter.
+func (f TagFilter) Match(t *model.Task) bool {
+	has := map[string]bool{}
+	for _, tag := range t.Tags {
+		has[tag] = true
+	}
+
+	for _, tag := range NormalizeTags(f.Exclude) {
+		if has[tag] {
+			return false
+		}
+	}
+
+	include := NormalizeTags(f.Include)
+	for _, tag := range include {
+		if has[tag] {
+			return true
+		}
+	}
+
+	return len(include) == 0
+}
+
+// NormalizeTags returns tags trimmed and lower cased, in alphabetical order and
+// without empty or duplicate tags.
+func NormalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	res := []string{}
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		res = append(res, tag)
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+// SetTaskTags replaces the tags of a task. Tags are normalized with
+// NormalizeTags. Returns the updated task.
+func (db *StopwatchDB) SetTaskTags(group, task int, tags []string) (*model.Task, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	var t *model.Task
+	err := db.undoable(AuditSetTags, func(tx kvTx) error {
+		var err error
+		if t, err = getTask(tx, group, task); err != nil {
+			return err
+		}
+
+		before := t.Tags
+		t.Tags = NormalizeTags(tags)
+		if err = putTask(tx, t); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditSetTags, group, task, before, t.Tags)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// GetTagUsage returns a report of time used for a group during given period of
+// time by tag, for the tasks selected by filter.
+func (db *StopwatchDB) GetTagUsage(group int, start, end time.Time, filter TagFilter) (*TagUsageReport, error) {
+	rep, err := db.usage(group, start, end, func(t *model.Task, at time.Time) []string {
+		if !filter.Match(t) {
+			return nil
+		}
+		if len(t.Tags) == 0 {
+			return []string{""}
+		}
+		return t.Tags
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &TagUsageReport{
+		Dates:       rep.Dates,
+		Tags:        []TagUsage{},
+		Combined:    rep.Combined,
+		Billable:    rep.Billable,
+		NonBillable: rep.NonBillable,
+	}
+
+	for _, c := range rep.CostCodes {
+		res.Tags = append(res.Tags, TagUsage{Tag: c.CostCode, Usage: c.Usage, Total: c.Total})
+	}
+	sort.Slice(res.Tags, func(i, j int) bool { return res.Tags[i].Tag < res.Tags[j].Tag })
+
+	return res, nil
+}
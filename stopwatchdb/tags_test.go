@@ -0,0 +1,70 @@
+package stopwatchdb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	got := NormalizeTags([]string{" Support", "meeting", "", "support", "Review "})
+	if want := []string{"meeting", "review", "support"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong tags: %v (not %v)", got, want)
+	}
+}
+
+func TestTagUsage(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		b, _ := db.AddTask(g.ID, "b", "code")
+		c, _ := db.AddTask(g.ID, "c", "code")
+
+		if a, err := db.SetTaskTags(g.ID, a.ID, []string{"Meeting", "support"}); err != nil || !reflect.DeepEqual(a.Tags, []string{"meeting", "support"}) {
+			t.Fatalf("Unable to set tags: %+v, %v", a, err)
+		}
+		db.SetTaskTags(g.ID, b.ID, []string{"review"})
+
+		start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+		db.SetSlice(g.ID, b.ID, start.Add(time.Hour), start.Add(2*time.Hour))
+		db.SetSlice(g.ID, c.ID, start.Add(2*time.Hour), start.Add(150*time.Minute))
+
+		rep, err := db.GetTagUsage(g.ID, start, start, TagFilter{})
+		if err != nil {
+			t.Fatalf("Unable to get tag usage: %s", err)
+		}
+
+		totals := map[string]time.Duration{}
+		for _, tu := range rep.Tags {
+			totals[tu.Tag] = tu.Total.Duration
+		}
+		want := map[string]time.Duration{"": 30 * time.Minute, "meeting": time.Hour, "review": time.Hour, "support": time.Hour}
+		if !reflect.DeepEqual(totals, want) || rep.Tags[0].Tag != "" {
+			t.Errorf("Wrong tag totals: %v", totals)
+		}
+		if rep.Combined.Duration != 150*time.Minute || rep.Dates[0].Used.Duration != 150*time.Minute {
+			t.Errorf("Time of several tags counted twice: %s, %s", rep.Combined, rep.Dates[0].Used)
+		}
+
+		// Filters
+		if rep, _ = db.GetTagUsage(g.ID, start, start, TagFilter{Include: []string{"Support", "review"}, Exclude: []string{"meeting"}}); rep.Combined.Duration != time.Hour || len(rep.Tags) != 1 || rep.Tags[0].Tag != "review" {
+			t.Errorf("Wrong filtered report: %+v", rep)
+		}
+
+		// Tags are kept when saving the task, and tag changes can be undone.
+		a, _ = db.GetTask(g.ID, a.ID)
+		a.Name = "renamed"
+		db.SaveTask(a)
+		db.SetTaskTags(g.ID, a.ID, nil)
+		db.Undo()
+		if a, _ = db.GetTask(g.ID, a.ID); len(a.Tags) != 2 || a.Name != "renamed" {
+			t.Errorf("Wrong task after undoing tag change: %+v", a)
+		}
+
+		// Cost code report is unchanged.
+		if usage, _ := db.GetUsage(g.ID, start, start); len(usage.CostCodes) != 1 || usage.CostCodes[0].Total.Duration != 150*time.Minute {
+			t.Errorf("Wrong cost code report: %+v", usage)
+		}
+	})
+}
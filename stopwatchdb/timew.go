@@ -0,0 +1,442 @@
+package stopwatchdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTimewRule maps "project:" tags to groups, "code:" tags to cost codes
+// and the first other tag to the task.
+const DefaultTimewRule = "group=project:,task=,code=code:"
+
+// timewTimeFmt is the layout of interval times in Timewarrior data files.
+const timewTimeFmt = "20060102T150405Z"
+
+// timewFileRe matches the names of Timewarrior data files.
+var timewFileRe = regexp.MustCompile(`^\d{4}-\d{2}\.data$`)
+
+// TimewRule maps Timewarrior tags to groups, tasks and cost codes. Each field
+// is a tag prefix. Tags with a prefix are mapped to its field, and fields with
+// an empty prefix take the remaining tags in the order group, task, cost code.
+type TimewRule struct {
+	Group string
+	Task  string
+	Code  string
+	// NoCode is set when cost codes are not mapped.
+	NoCode bool
+}
+
+// TimewInterval is a single interval of a Timewarrior data file. End is zero
+// for open intervals.
+type TimewInterval struct {
+	Start      time.Time
+	End        time.Time
+	Tags       []string
+	Annotation string
+}
+
+// TimewResult tells what was written to Timewarrior data files.
+type TimewResult struct {
+	Files   []string
+	Written int
+	// Skipped counts slices that already had an interval.
+	Skipped int
+}
+
+// ParseTimewRule parses a rule given as comma separated field=prefix pairs,
+// eg. DefaultTimewRule. Group and task are required.
+func ParseTimewRule(s string) (TimewRule, error) {
+	var r TimewRule
+	seen := map[string]bool{}
+
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return r, fmt.Errorf("invalid rule '%s', expected field=prefix", part)
+		}
+
+		switch kv[0] {
+		case "group":
+			r.Group = kv[1]
+		case "task":
+			r.Task = kv[1]
+		case "code":
+			r.Code = kv[1]
+		default:
+			return r, fmt.Errorf("unknown field '%s' in rule", kv[0])
+		}
+		seen[kv[0]] = true
+	}
+
+	if !seen["group"] || !seen["task"] {
+		return r, errors.New("rule must map group and task")
+	}
+
+	r.NoCode = !seen["code"]
+	return r, nil
+}
+
+// fields returns the prefixes of the mapped fields in the order group, task,
+// cost code.
+func (r TimewRule) fields() []*string {
+	res := []*string{&r.Group, &r.Task}
+	if !r.NoCode {
+		res = append(res, &r.Code)
+	}
+	return res
+}
+
+// Entry maps the tags of an interval to a group, task and cost code, and the
+// annotation to the note of the slice. Returns false if the tags don't name
+// both a group and a task.
+func (r TimewRule) Entry(iv TimewInterval) (TrackerEntry, bool) {
+	e := TrackerEntry{Start: iv.Start, End: iv.End, Note: iv.Annotation}
+	values := []*string{&e.Project, &e.Description, &e.Tag}
+	fields := r.fields()
+
+	// Prefixed tags first, longest prefix winning.
+	rest := []string{}
+	for _, tag := range iv.Tags {
+		best := -1
+		for i, prefix := range fields {
+			if *prefix != "" && strings.HasPrefix(tag, *prefix) && *values[i] == "" &&
+				(best < 0 || len(*prefix) > len(*fields[best])) {
+				best = i
+			}
+		}
+
+		if best < 0 {
+			rest = append(rest, tag)
+			continue
+		}
+		*values[best] = strings.TrimPrefix(tag, *fields[best])
+	}
+
+	for i, prefix := range fields {
+		if *prefix == "" && len(rest) > 0 {
+			*values[i] = rest[0]
+			rest = rest[1:]
+		}
+	}
+
+	return e, e.Project != "" && e.Description != ""
+}
+
+// Tags returns the tags of a slice of a task.
+func (r TimewRule) Tags(group, task, code string) []string {
+	values := []string{group, task, code}
+	tags := []string{}
+
+	// Tags without a prefix are positional, so empty values are kept.
+	for i, prefix := range r.fields() {
+		if values[i] != "" || *prefix == "" {
+			tags = append(tags, *prefix+values[i])
+		}
+	}
+
+	return tags
+}
+
+// ParseTimewInterval parses a line of a Timewarrior data file.
+func ParseTimewInterval(line string) (*TimewInterval, error) {
+	tokens, err := splitTimewLine(line)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) < 2 || !tokens[0].is("inc") {
+		return nil, fmt.Errorf("not an interval: %s", line)
+	}
+
+	iv := &TimewInterval{Tags: []string{}}
+	if iv.Start, err = time.Parse(timewTimeFmt, tokens[1].text); err != nil {
+		return nil, fmt.Errorf("invalid start: %s", err)
+	}
+
+	tokens = tokens[2:]
+	if len(tokens) >= 2 && tokens[0].is("-") {
+		if iv.End, err = time.Parse(timewTimeFmt, tokens[1].text); err != nil {
+			return nil, fmt.Errorf("invalid end: %s", err)
+		}
+		tokens = tokens[2:]
+	}
+
+	if len(tokens) == 0 {
+		return iv, nil
+	}
+	if !tokens[0].is("#") {
+		return nil, fmt.Errorf("unexpected '%s'", tokens[0].text)
+	}
+
+	for i, tok := range tokens[1:] {
+		if tok.is("#") {
+			words := []string{}
+			for _, w := range tokens[i+2:] {
+				words = append(words, w.text)
+			}
+			iv.Annotation = strings.Join(words, " ")
+			break
+		}
+		iv.Tags = append(iv.Tags, tok.text)
+	}
+
+	return iv, nil
+}
+
+// String formats the interval as a line of a Timewarrior data file.
+func (iv TimewInterval) String() string {
+	parts := []string{"inc", iv.Start.UTC().Format(timewTimeFmt)}
+	if !iv.End.IsZero() {
+		parts = append(parts, "-", iv.End.UTC().Format(timewTimeFmt))
+	}
+
+	if len(iv.Tags) > 0 || iv.Annotation != "" {
+		parts = append(parts, "#")
+		for _, tag := range iv.Tags {
+			parts = append(parts, quoteTimewTag(tag))
+		}
+	}
+
+	if iv.Annotation != "" {
+		parts = append(parts, "#", quoteTimewTag(iv.Annotation))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// ReadTimewData reads the intervals of all data files in a Timewarrior data
+// directory.
+func ReadTimewData(dir string) ([]TimewInterval, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []TimewInterval{}
+	for _, f := range files {
+		if f.IsDir() || !timewFileRe.MatchString(f.Name()) {
+			continue
+		}
+
+		ivs, err := readTimewFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, ivs...)
+	}
+
+	return res, nil
+}
+
+// ImportTimew adds closed intervals as slices with ImportTracker, mapping tags
+// with rule. Returns the number of intervals that were not imported because
+// they are open or their tags don't name a group and a task.
+func ImportTimew(db Store, intervals []TimewInterval, rule TimewRule, dryRun bool) (*TrackerResult, int, error) {
+	entries := []TrackerEntry{}
+	ignored := 0
+
+	for _, iv := range intervals {
+		e, ok := rule.Entry(iv)
+		if !ok || iv.End.IsZero() || !iv.End.After(iv.Start) {
+			ignored++
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	res, err := ImportTracker(db, entries, dryRun)
+	return res, ignored, err
+}
+
+// WriteTimewData writes the slices of all groups between start and end to the
+// data files of a Timewarrior data directory, with slice notes as annotations.
+// Existing intervals are kept, and slices with an interval starting at the same
+// time are skipped, so writing the same period again doesn't duplicate
+// intervals.
+func WriteTimewData(db Store, dir string, rule TimewRule, start, end time.Time) (*TimewResult, error) {
+	groups, err := db.ReadGroups(true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Intervals to add by data file.
+	months := map[string][]TimewInterval{}
+	for _, g := range groups {
+		slices, err := db.GetSlices(g.ID, start, end)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ts := range slices {
+			for _, s := range ts.Slices {
+				name := s.Start.UTC().Format("2006-01") + ".data"
+				months[name] = append(months[name], TimewInterval{
+					Start:      s.Start,
+					End:        s.End,
+					Tags:       rule.Tags(g.Name, ts.Name, s.CostCode),
+					Annotation: s.Note,
+				})
+			}
+		}
+	}
+
+	res := &TimewResult{Files: []string{}}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range months {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+
+		existing, err := readTimewFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		starts := map[int64]bool{}
+		for _, iv := range existing {
+			starts[iv.Start.Unix()] = true
+		}
+
+		// Intervals have second precision.
+		added := 0
+		for _, iv := range months[name] {
+			if starts[iv.Start.Unix()] {
+				res.Skipped++
+				continue
+			}
+			starts[iv.Start.Unix()] = true
+			existing = append(existing, iv)
+			added++
+		}
+
+		if added == 0 {
+			continue
+		}
+
+		sort.SliceStable(existing, func(i, j int) bool { return existing[i].Start.Before(existing[j].Start) })
+		if err = writeTimewFile(path, existing); err != nil {
+			return nil, err
+		}
+
+		res.Files = append(res.Files, path)
+		res.Written += added
+	}
+
+	return res, nil
+}
+
+// readTimewFile reads the intervals of a data file.
+func readTimewFile(path string) ([]TimewInterval, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := []TimewInterval{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+
+		iv, err := ParseTimewInterval(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filepath.Base(path), line, err)
+		}
+		res = append(res, *iv)
+	}
+
+	return res, sc.Err()
+}
+
+// writeTimewFile replaces a data file with the intervals.
+func writeTimewFile(path string, intervals []TimewInterval) error {
+	var b strings.Builder
+	for _, iv := range intervals {
+		b.WriteString(iv.String() + "\n")
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// timewToken is a token of a Timewarrior data file line. Quoted tokens are
+// never separators, even if their text is '#' or '-'.
+type timewToken struct {
+	text   string
+	quoted bool
+}
+
+// is returns if the token is the unquoted separator sep.
+func (t timewToken) is(sep string) bool {
+	return !t.quoted && t.text == sep
+}
+
+// splitTimewLine splits a line into tokens separated by spaces. Quoted tokens
+// may contain spaces and escaped quotes.
+func splitTimewLine(line string) ([]timewToken, error) {
+	tokens := []timewToken{}
+
+	var cur strings.Builder
+	inToken, quoted, escaped, wasQuoted := false, false, false, false
+	for _, c := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			inToken, wasQuoted = true, true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inToken {
+				tokens = append(tokens, timewToken{cur.String(), wasQuoted})
+				cur.Reset()
+				inToken, wasQuoted = false, false
+			}
+		default:
+			cur.WriteRune(c)
+			inToken = true
+		}
+	}
+
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inToken {
+		tokens = append(tokens, timewToken{cur.String(), wasQuoted})
+	}
+
+	return tokens, nil
+}
+
+// quoteTimewTag quotes a tag if it contains spaces, quotes or is a '#' or '-'
+// separator.
+func quoteTimewTag(tag string) string {
+	if tag != "" && tag != "#" && tag != "-" && !strings.ContainsAny(tag, " \t\"\\") {
+		return tag
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(tag) + `"`
+}
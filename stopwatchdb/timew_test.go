@@ -0,0 +1,125 @@
+package stopwatchdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTimewInterval(t *testing.T) {
+	line := `inc 20171205T080000Z - 20171205T093000Z # project:Acme "Design work" "say \"hi\"" # "an annotation"`
+
+	iv, err := ParseTimewInterval(line)
+	if err != nil {
+		t.Fatalf("Unable to parse interval: %s", err)
+	}
+	if iv.End.Sub(iv.Start) != 90*time.Minute || len(iv.Tags) != 3 || iv.Tags[1] != "Design work" || iv.Tags[2] != `say "hi"` || iv.Annotation != "an annotation" {
+		t.Errorf("Wrong interval: %+v", iv)
+	}
+	if iv.String() != line {
+		t.Errorf("Wrong format:\n%s\nexpected:\n%s", iv.String(), line)
+	}
+
+	// Quoted separators are tags.
+	quoted := TimewInterval{Start: iv.Start, End: iv.End, Tags: []string{"#", "a # b", "-"}, Annotation: "#"}
+	if iv, err = ParseTimewInterval(quoted.String()); err != nil || len(iv.Tags) != 3 || iv.Tags[0] != "#" || iv.Tags[1] != "a # b" || iv.Tags[2] != "-" || iv.Annotation != "#" {
+		t.Errorf("Wrong interval with quoted separators: %s: %+v, %v", quoted, iv, err)
+	}
+
+	if iv, err = ParseTimewInterval("inc 20171205T080000Z # open"); err != nil || !iv.End.IsZero() || iv.Tags[0] != "open" {
+		t.Errorf("Wrong open interval: %+v, %v", iv, err)
+	}
+
+	if _, err = ParseTimewInterval(`inc 20171205T080000Z # "unterminated`); err == nil {
+		t.Errorf("Expected error for unterminated quote")
+	}
+}
+
+func TestTimewRule(t *testing.T) {
+	rule, err := ParseTimewRule(DefaultTimewRule)
+	if err != nil {
+		t.Fatalf("Unable to parse rule: %s", err)
+	}
+
+	e, ok := rule.Entry(TimewInterval{Tags: []string{"code:dev", "Design", "project:Acme", "extra"}})
+	if !ok || e.Project != "Acme" || e.Description != "Design" || e.Tag != "dev" {
+		t.Errorf("Wrong entry: %+v", e)
+	}
+	if _, ok = rule.Entry(TimewInterval{Tags: []string{"Design"}}); ok {
+		t.Errorf("Entry without group accepted")
+	}
+
+	// Positional rule without cost codes.
+	if rule, err = ParseTimewRule("group=,task="); err != nil || !rule.NoCode {
+		t.Fatalf("Unable to parse positional rule: %+v, %v", rule, err)
+	}
+	tags := rule.Tags("Acme", "Design", "dev")
+	if e, ok = rule.Entry(TimewInterval{Tags: tags}); !ok || e.Project != "Acme" || e.Description != "Design" || e.Tag != "" {
+		t.Errorf("Wrong positional entry for %v: %+v", tags, e)
+	}
+
+	for _, bad := range []string{"task=", "group=,task=,colour=x", "group"} {
+		if _, err = ParseTimewRule(bad); err == nil {
+			t.Errorf("Expected error for rule '%s'", bad)
+		}
+	}
+}
+
+func TestTimewRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timew")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rule, _ := ParseTimewRule(DefaultTimewRule)
+
+	db, done := openMemoryDB(t)
+	defer done()
+
+	g, _ := db.AddGroup("Acme")
+	a, _ := db.AddTask(g.ID, "Design work", "dev")
+	start := time.Date(2017, 11, 30, 22, 0, 0, 500, time.UTC)
+	db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+	db.SetSlice(g.ID, a.ID, start.Add(3*time.Hour), start.Add(4*time.Hour))
+	db.SetSliceNote(g.ID, a.ID, start, "wireframes")
+
+	// An interval tracked in Timewarrior.
+	ioutil.WriteFile(filepath.Join(dir, "2017-12.data"), []byte("inc 20171201T080000Z - 20171201T090000Z # project:Acme Meeting code:admin # \"weekly sync\"\n"), 0600)
+
+	res, err := WriteTimewData(db, dir, rule, start, start.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("Unable to write data: %s", err)
+	}
+	if res.Written != 2 || len(res.Files) != 2 {
+		t.Errorf("Wrong write result: %+v", res)
+	}
+
+	if res, _ = WriteTimewData(db, dir, rule, start, start.AddDate(0, 0, 1)); res.Written != 0 || res.Skipped != 2 {
+		t.Errorf("Slices written twice: %+v", res)
+	}
+
+	intervals, err := ReadTimewData(dir)
+	if err != nil || len(intervals) != 3 {
+		t.Fatalf("Wrong intervals: %+v, %v", intervals, err)
+	}
+	if intervals[0].Annotation != "wireframes" {
+		t.Errorf("Note not written as annotation: %+v", intervals[0])
+	}
+
+	// Reading back adds only the interval from Timewarrior.
+	imp, ignored, err := ImportTimew(db, intervals, rule, false)
+	if err != nil || ignored != 0 || imp.Added != 1 || imp.Duplicates != 2 {
+		t.Fatalf("Wrong import: %+v, %d, %v", imp, ignored, err)
+	}
+	if tasks, _ := db.ReadTasks(g.ID, true); len(tasks) != 2 || tasks[1].Name != "Meeting" || tasks[1].CostCode != "admin" {
+		t.Errorf("Wrong tasks after import: %+v", tasks)
+	}
+
+	day := time.Date(2017, 12, 1, 0, 0, 0, 0, time.UTC)
+	if slices, _ := db.GetSlices(g.ID, day, day); len(slices) != 2 || slices[1].Slices[0].Note != "weekly sync" {
+		t.Errorf("Annotation not imported as note: %+v", slices)
+	}
+}
@@ -0,0 +1,372 @@
+package stopwatchdb
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// Formats of time tracker CSV exports.
+const (
+	TrackerToggl    = "toggl"
+	TrackerClockify = "clockify"
+)
+
+// Names used for entries without a project or a description.
+const (
+	trackerNoProject     = "No project"
+	trackerNoDescription = "No description"
+)
+
+// TrackerEntry is a time entry read from a time tracker export.
+type TrackerEntry struct {
+	Project     string
+	Description string
+	Tag         string
+	Start       time.Time
+	End         time.Time
+	// Note is set as the note of the slice.
+	Note string
+}
+
+// TrackerItem tells how an entry is imported. Group and task IDs are zero for
+// groups and tasks that are created by the import.
+type TrackerItem struct {
+	TrackerEntry
+	GroupID   int
+	TaskID    int
+	CostCode  string
+	NewGroup  bool
+	NewTask   bool
+	Duplicate bool
+}
+
+// TrackerResult tells what was, or with a dry run would be, done by an import.
+type TrackerResult struct {
+	Items      []TrackerItem
+	Groups     int
+	Tasks      int
+	Added      int
+	Duplicates int
+}
+
+// trackerColumns names the columns of each supported export format.
+var trackerColumns = map[string]map[string]string{
+	TrackerToggl: {
+		"project":     "Project",
+		"description": "Description",
+		"tags":        "Tags",
+		"startDate":   "Start date",
+		"startTime":   "Start time",
+		"endDate":     "End date",
+		"endTime":     "End time",
+	},
+	TrackerClockify: {
+		"project":     "Project",
+		"description": "Description",
+		"tags":        "Tags",
+		"startDate":   "Start Date",
+		"startTime":   "Start Time",
+		"endDate":     "End Date",
+		"endTime":     "End Time",
+	},
+}
+
+// trackerDateFmts and trackerTimeFmts are the accepted date and time layouts.
+// Dates are read in the first layout that parses, unless another layout gives
+// a different date.
+var (
+	trackerDateFmts = []string{"2006-01-02", "01/02/2006", "02/01/2006", "02.01.2006", "2006/01/02"}
+	trackerTimeFmts = []string{"15:04:05", "03:04:05 PM", "3:04:05 PM", "15:04", "03:04 PM", "3:04 PM"}
+)
+
+// ReadTrackerCSV reads the entries of a Toggl or Clockify detailed CSV export.
+// The format is detected from the header row. Times are read in loc. Entries
+// with several tags use the first one. Dates are read with the Go time layout
+// dateFmt. If it is empty, the layout is detected for each date, and dates that
+// read differently in several layouts, like 03/04/2017, are refused.
+func ReadTrackerCSV(r io.Reader, loc *time.Location, dateFmt string) (string, []TrackerEntry, error) {
+	// Clockify exports start with a byte order mark.
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\ufeff" {
+		br.Discard(3)
+	}
+
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to read header: %s", err)
+	}
+
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+
+	format := TrackerToggl
+	if _, ok := index["Start date"]; !ok {
+		format = TrackerClockify
+	}
+
+	cols := map[string]int{}
+	for key, name := range trackerColumns[format] {
+		i, ok := index[name]
+		if !ok {
+			return "", nil, fmt.Errorf("unrecognized export, column '%s' not found", name)
+		}
+		cols[key] = i
+	}
+
+	entries := []TrackerEntry{}
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", nil, err
+		}
+
+		field := func(key string) string {
+			if cols[key] >= len(rec) {
+				return ""
+			}
+			return strings.TrimSpace(rec[cols[key]])
+		}
+
+		e := TrackerEntry{
+			Project:     field("project"),
+			Description: field("description"),
+			Tag:         strings.TrimSpace(strings.Split(field("tags"), ",")[0]),
+		}
+
+		if e.Start, err = parseTrackerTime(field("startDate"), field("startTime"), loc, dateFmt); err != nil {
+			return "", nil, fmt.Errorf("line %d: invalid start: %s", line, err)
+		}
+		if e.End, err = parseTrackerTime(field("endDate"), field("endTime"), loc, dateFmt); err != nil {
+			return "", nil, fmt.Errorf("line %d: invalid end: %s", line, err)
+		}
+		if !e.End.After(e.Start) {
+			return "", nil, fmt.Errorf("line %d: entry ends before it starts", line)
+		}
+
+		if e.Project == "" {
+			e.Project = trackerNoProject
+		}
+		if e.Description == "" {
+			e.Description = trackerNoDescription
+		}
+
+		entries = append(entries, e)
+	}
+
+	return format, entries, nil
+}
+
+// ImportTracker adds time tracker entries as slices. Projects are matched to
+// groups and descriptions to tasks by name, and missing ones are added with
+// the tag as cost code. Entries starting within the same second as an existing
+// slice of the task, or as an earlier entry, are skipped as duplicates. The
+// entries are written as a single change with ImportSlices. With dryRun nothing
+// is written, and the result tells what would be done.
+func ImportTracker(db Store, entries []TrackerEntry, dryRun bool) (*TrackerResult, error) {
+	res := &TrackerResult{Items: []TrackerItem{}}
+
+	groups, err := db.ReadGroups(true)
+	if err != nil {
+		return nil, err
+	}
+
+	groupIDs := map[string]int{}
+	for _, g := range groups {
+		if _, ok := groupIDs[g.Name]; !ok {
+			groupIDs[g.Name] = g.ID
+		}
+	}
+
+	// Tasks of each group by name, and the slice starts of each task, read
+	// when first needed. New groups and tasks are keyed by name.
+	tasks := map[string]map[string]*model.Task{}
+	starts := map[string]map[int64]bool{}
+
+	for _, e := range entries {
+		item := TrackerItem{TrackerEntry: e}
+
+		item.GroupID = groupIDs[e.Project]
+		if item.GroupID == 0 {
+			item.NewGroup = true
+			if _, ok := tasks[e.Project]; !ok {
+				res.Groups++
+			}
+		}
+
+		if _, ok := tasks[e.Project]; !ok {
+			if tasks[e.Project], err = trackerTasks(db, item.GroupID); err != nil {
+				return nil, err
+			}
+		}
+
+		t, ok := tasks[e.Project][e.Description]
+		if !ok {
+			t = &model.Task{GroupID: item.GroupID, Name: e.Description, CostCode: e.Tag}
+			tasks[e.Project][e.Description] = t
+			res.Tasks++
+		}
+		item.TaskID = t.ID
+		item.NewTask = t.ID == 0
+		item.CostCode = t.CostCode
+
+		key := e.Project + "\x00" + e.Description
+		if _, ok := starts[key]; !ok {
+			if starts[key], err = trackerStarts(db, t, entries); err != nil {
+				return nil, err
+			}
+		}
+
+		if starts[key][e.Start.Unix()] {
+			item.Duplicate = true
+			res.Duplicates++
+		} else {
+			starts[key][e.Start.Unix()] = true
+			res.Added++
+		}
+
+		res.Items = append(res.Items, item)
+	}
+
+	if dryRun {
+		return res, nil
+	}
+
+	// Write everything at once, so a failure doesn't leave a partial import.
+	slices := []ImportSlice{}
+	index := []int{}
+	for i, item := range res.Items {
+		if item.Duplicate {
+			continue
+		}
+
+		t := tasks[item.Project][item.Description]
+		slices = append(slices, ImportSlice{
+			GroupID:  groupIDs[item.Project],
+			Group:    item.Project,
+			TaskID:   t.ID,
+			Task:     t.Name,
+			CostCode: t.CostCode,
+			Start:    item.Start,
+			End:      item.End,
+			Note:     item.Note,
+		})
+		index = append(index, i)
+	}
+
+	if len(slices) == 0 {
+		return res, nil
+	}
+
+	added, err := db.ImportSlices(slices)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, s := range added {
+		res.Items[index[i]].GroupID = s.GroupID
+		res.Items[index[i]].TaskID = s.TaskID
+	}
+
+	return res, nil
+}
+
+// trackerTasks reads the tasks of a group by name. Returns an empty set for
+// groups that don't exist yet.
+func trackerTasks(db Store, group int) (map[string]*model.Task, error) {
+	res := map[string]*model.Task{}
+	if group == 0 {
+		return res, nil
+	}
+
+	tasks, err := db.ReadTasks(group, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tasks {
+		if _, ok := res[t.Name]; !ok {
+			res[t.Name] = t
+		}
+	}
+
+	return res, nil
+}
+
+// trackerStarts returns the slice starts of a task over the time range of the
+// entries. Tasks that don't exist yet have no slices.
+func trackerStarts(db Store, t *model.Task, entries []TrackerEntry) (map[int64]bool, error) {
+	res := map[int64]bool{}
+	if t.ID == 0 || len(entries) == 0 {
+		return res, nil
+	}
+
+	first, last := entries[0].Start, entries[0].Start
+	for _, e := range entries {
+		if e.Start.Before(first) {
+			first = e.Start
+		}
+		if e.Start.After(last) {
+			last = e.Start
+		}
+	}
+
+	loc := db.Location()
+	slices, err := db.GetSlices(t.GroupID, first.In(loc), last.In(loc))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ts := range slices {
+		if ts.ID != t.ID {
+			continue
+		}
+		for _, s := range ts.Slices {
+			res[s.Start.Unix()] = true
+		}
+	}
+
+	return res, nil
+}
+
+// parseTrackerTime parses a date in layout dateFmt, or in any of the accepted
+// layouts if it is empty, and a time in any of the accepted layouts.
+func parseTrackerTime(date, clock string, loc *time.Location, dateFmt string) (time.Time, error) {
+	dateFmts := trackerDateFmts
+	if dateFmt != "" {
+		dateFmts = []string{dateFmt}
+	}
+
+	var res time.Time
+	for _, df := range dateFmts {
+		for _, tf := range trackerTimeFmts {
+			t, err := time.ParseInLocation(df+" "+tf, date+" "+clock, loc)
+			if err != nil {
+				continue
+			}
+			if !res.IsZero() && !t.Equal(res) {
+				return time.Time{}, fmt.Errorf("ambiguous date '%s', date layout must be given", date)
+			}
+			res = t
+			break
+		}
+	}
+
+	if res.IsZero() {
+		return time.Time{}, fmt.Errorf("unrecognized date or time '%s %s'", date, clock)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,134 @@
+package stopwatchdb
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+const togglCSV = `User,Email,Client,Project,Task,Description,Billable,Start date,Start time,End date,End time,Duration,Tags,Amount ()
+Jo,jo@example.com,,Acme,,Design,No,2017-12-05,08:00:00,2017-12-05,09:30:00,01:30:00,"dev, ux",
+Jo,jo@example.com,,Acme,,Meeting,No,2017-12-05,10:00:00,2017-12-05,10:30:00,00:30:00,admin,
+Jo,jo@example.com,,,,,No,2017-12-05,11:00:00,2017-12-05,11:15:00,00:15:00,,
+`
+
+const clockifyCSV = "\ufeff" + `"Project","Client","Description","Task","User","Group","Email","Tags","Billable","Start Date","Start Time","End Date","End Time","Duration (h)","Duration (decimal)"
+"Acme","","Design","","Jo","","jo@example.com","dev","No","12/05/2017","08:00:00 AM","12/05/2017","09:30:00 AM","01:30:00","1.50"
+"Acme","","Design","","Jo","","jo@example.com","dev","No","12/05/2017","01:00:00 PM","12/05/2017","02:00:00 PM","01:00:00","1.00"
+`
+
+func TestReadTrackerCSV(t *testing.T) {
+	format, entries, err := ReadTrackerCSV(strings.NewReader(togglCSV), time.UTC, "")
+	if err != nil || format != TrackerToggl || len(entries) != 3 {
+		t.Fatalf("Unable to read Toggl export: %s, %v, %+v", format, err, entries)
+	}
+	if e := entries[0]; e.Project != "Acme" || e.Description != "Design" || e.Tag != "dev" || e.End.Sub(e.Start) != 90*time.Minute {
+		t.Errorf("Wrong Toggl entry: %+v", e)
+	}
+	if e := entries[2]; e.Project != trackerNoProject || e.Description != trackerNoDescription {
+		t.Errorf("Wrong names for empty entry: %+v", e)
+	}
+
+	format, entries, err = ReadTrackerCSV(strings.NewReader(clockifyCSV), time.UTC, "01/02/2006")
+	if err != nil || format != TrackerClockify || len(entries) != 2 {
+		t.Fatalf("Unable to read Clockify export: %s, %v, %+v", format, err, entries)
+	}
+	if e := entries[1]; !e.Start.Equal(time.Date(2017, 12, 5, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("Wrong Clockify entry: %+v", e)
+	}
+
+	// 12/05/2017 reads as both December 5th and May 12th.
+	if _, _, err = ReadTrackerCSV(strings.NewReader(clockifyCSV), time.UTC, ""); err == nil {
+		t.Errorf("Expected error for ambiguous dates")
+	}
+
+	// Dates that only read one way are detected.
+	dmy := strings.Replace(clockifyCSV, "12/05/2017", "13/05/2017", -1)
+	if _, entries, err = ReadTrackerCSV(strings.NewReader(dmy), time.UTC, ""); err != nil || !entries[0].Start.Equal(time.Date(2017, 5, 13, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("Wrong day first entries: %+v, %v", entries, err)
+	}
+
+	if _, _, err = ReadTrackerCSV(strings.NewReader("a,b,c\n1,2,3\n"), time.UTC, ""); err == nil {
+		t.Errorf("Expected error for unknown export")
+	}
+}
+
+func TestImportTracker(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("Acme")
+		design, _ := db.AddTask(g.ID, "Design", "design")
+		start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		db.SetSlice(g.ID, design.ID, start, start.Add(90*time.Minute))
+
+		_, toggl, _ := ReadTrackerCSV(strings.NewReader(togglCSV), time.UTC, "")
+		_, clockify, _ := ReadTrackerCSV(strings.NewReader(clockifyCSV), time.UTC, "01/02/2006")
+		entries := append(toggl, clockify...)
+
+		res, err := ImportTracker(db, entries, true)
+		if err != nil {
+			t.Fatalf("Dry run failed: %s", err)
+		}
+		if res.Groups != 1 || res.Tasks != 2 || res.Added != 3 || res.Duplicates != 2 {
+			t.Errorf("Wrong dry run result: %+v", res)
+		}
+		if item := res.Items[0]; !item.Duplicate || item.TaskID != design.ID || item.CostCode != "design" {
+			t.Errorf("Existing slice not detected: %+v", item)
+		}
+		if groups, _ := db.ReadGroups(true); len(groups) != 1 {
+			t.Fatalf("Dry run wrote groups: %+v", groups)
+		}
+
+		if res, err = ImportTracker(db, entries, false); err != nil {
+			t.Fatalf("Import failed: %s", err)
+		}
+		if res.Added != 3 {
+			t.Errorf("Wrong import result: %+v", res)
+		}
+
+		if groups, _ := db.ReadGroups(true); len(groups) != 2 || groups[1].Name != trackerNoProject {
+			t.Errorf("Wrong groups after import: %+v", groups)
+		}
+		if tasks, _ := db.ReadTasks(g.ID, true); len(tasks) != 2 || tasks[1].Name != "Meeting" || tasks[1].CostCode != "admin" {
+			t.Errorf("Wrong tasks after import: %+v", tasks)
+		}
+		if design, _ = db.GetTask(g.ID, design.ID); design.Used.Duration != 150*time.Minute {
+			t.Errorf("Wrong time used: %s", design.Used)
+		}
+
+		// Importing again adds nothing.
+		if res, _ = ImportTracker(db, entries, false); res.Added != 0 || res.Duplicates != 5 {
+			t.Errorf("Entries imported twice: %+v", res)
+		}
+	})
+}
+
+func TestImportTrackerAtomic(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		_, entries, _ := ReadTrackerCSV(strings.NewReader(togglCSV), time.UTC, "")
+
+		// The cost code of the second entry isn't registered, which strict mode
+		// refuses after the first entry is already written.
+		db.SetStrictCostCodes(true)
+		db.SaveCostCode(&model.CostCode{Code: "dev", Active: true})
+		if _, err := ImportTracker(db, entries, false); err == nil {
+			t.Fatalf("Expected error for unregistered cost code")
+		}
+		if groups, _ := db.ReadGroups(true); len(groups) != 0 {
+			t.Errorf("Failed import left groups: %+v", groups)
+		}
+
+		// A successful import is undone as one change.
+		db.SetStrictCostCodes(false)
+		if _, err := ImportTracker(db, entries, false); err != nil {
+			t.Fatalf("Import failed: %s", err)
+		}
+		if c, err := db.Undo(); err != nil || c.Op != AuditImportSlices {
+			t.Fatalf("Unable to undo import: %+v, %v", c, err)
+		}
+		if groups, _ := db.ReadGroups(true); len(groups) != 0 {
+			t.Errorf("Undo left groups: %+v", groups)
+		}
+	})
+}
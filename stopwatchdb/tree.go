@@ -0,0 +1,147 @@
+package stopwatchdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	model "github.com/msepp/stopwatch/stopwatchmodel"
+)
+
+// GroupNode is a group with the groups below it.
+type GroupNode struct {
+	model.Group
+	Children []*GroupNode `json:"children"`
+}
+
+// ReadGroupTree returns the groups as a tree, in the order of group IDs on
+// each level. Groups whose parent doesn't exist are at the top level. Unless
+// archived is set, archived groups and the groups below them are left out.
+func (db *StopwatchDB) ReadGroupTree(archived bool) ([]*GroupNode, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	groups, err := db.ReadGroups(true)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := map[int]*GroupNode{}
+	for _, g := range groups {
+		nodes[g.ID] = &GroupNode{Group: g, Children: []*GroupNode{}}
+	}
+
+	roots := []*GroupNode{}
+	for _, g := range groups {
+		n := nodes[g.ID]
+		if g.Archived && !archived {
+			continue
+		}
+
+		if parent, ok := nodes[g.ParentID]; ok {
+			parent.Children = append(parent.Children, n)
+		} else {
+			roots = append(roots, n)
+		}
+	}
+
+	return roots, nil
+}
+
+// MoveGroup moves a group and the groups below it under another group, or to
+// the top level with parent 0. Tasks and slices of the groups are not changed.
+// Returns the moved group.
+func (db *StopwatchDB) MoveGroup(group, parent int) (*model.Group, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	var g *model.Group
+	if err := db.undoable(AuditMoveGroup, func(tx kvTx) error {
+		var err error
+		if g, err = getGroup(tx, group); err != nil {
+			return err
+		}
+
+		if parent != 0 {
+			if _, err = getGroup(tx, parent); err != nil {
+				return fmt.Errorf("parent: %s", err)
+			}
+
+			below, err := groupSubtree(tx, group)
+			if err != nil {
+				return err
+			}
+			for _, id := range below {
+				if id == parent {
+					return errors.New("group can't be moved under itself")
+				}
+			}
+		}
+
+		before := *g
+		g.ParentID = parent
+		if err = putGroup(tx, g); err != nil {
+			return err
+		}
+
+		return db.audit(tx, AuditMoveGroup, group, 0, before, g)
+	}); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// groupSubtree returns the ID of a group followed by the IDs of all groups
+// below it.
+func groupSubtree(tx kvTx, group int) ([]int, error) {
+	children := map[int][]int{}
+	if err := tx.Bucket([]byte(BucketGroups)).ForEach(func(k, v []byte) error {
+		var g model.Group
+		if json.Unmarshal(v, &g) == nil && g.ParentID != 0 {
+			children[g.ParentID] = append(children[g.ParentID], g.ID)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Groups already seen are skipped, so a broken tree with a cycle ends.
+	res := []int{group}
+	seen := map[int]bool{group: true}
+	for i := 0; i < len(res); i++ {
+		for _, id := range children[res[i]] {
+			if !seen[id] {
+				seen[id] = true
+				res = append(res, id)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// reparentChildren moves the groups directly below a group under parent.
+func reparentChildren(tx kvTx, group, parent int) error {
+	moved := []*model.Group{}
+	if err := tx.Bucket([]byte(BucketGroups)).ForEach(func(k, v []byte) error {
+		var g model.Group
+		if json.Unmarshal(v, &g) == nil && g.ParentID == group && g.ID != group {
+			moved = append(moved, &g)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, g := range moved {
+		g.ParentID = parent
+		if err := putGroup(tx, g); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
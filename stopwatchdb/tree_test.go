@@ -0,0 +1,106 @@
+package stopwatchdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupTree(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		client, _ := db.AddGroup("client")
+		project, _ := db.AddGroup("project")
+		sub, _ := db.AddGroup("sub-project")
+		other, _ := db.AddGroup("other")
+
+		if _, err := db.MoveGroup(project.ID, client.ID); err != nil {
+			t.Fatalf("Unable to move group: %s", err)
+		}
+		if _, err := db.MoveGroup(sub.ID, project.ID); err != nil {
+			t.Fatalf("Unable to move group: %s", err)
+		}
+
+		// Cycles and missing parents are refused.
+		if _, err := db.MoveGroup(client.ID, sub.ID); err == nil {
+			t.Error("Expected error moving a group below itself")
+		}
+		if _, err := db.MoveGroup(client.ID, client.ID); err == nil {
+			t.Error("Expected error moving a group under itself")
+		}
+		if _, err := db.MoveGroup(client.ID, 99); err == nil {
+			t.Error("Expected error moving a group under a missing group")
+		}
+
+		tree, err := db.ReadGroupTree(false)
+		if err != nil {
+			t.Fatalf("Unable to read tree: %s", err)
+		}
+		if len(tree) != 2 || tree[0].ID != client.ID || tree[1].ID != other.ID ||
+			len(tree[0].Children) != 1 || tree[0].Children[0].Children[0].ID != sub.ID {
+			t.Errorf("Wrong tree: %+v", tree)
+		}
+
+		// Reports roll up the groups below.
+		a, _ := db.AddTask(client.ID, "a", "admin")
+		b, _ := db.AddTask(project.ID, "b", "dev")
+		c, _ := db.AddTask(sub.ID, "c", "dev")
+		start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		db.SetSlice(client.ID, a.ID, start, start.Add(time.Hour))
+		db.SetSlice(project.ID, b.ID, start.Add(time.Hour), start.Add(2*time.Hour))
+		db.SetSlice(sub.ID, c.ID, start.Add(2*time.Hour), start.Add(3*time.Hour))
+
+		if rep, _ := db.GetUsage(client.ID, start, start); rep.Combined.Duration != 3*time.Hour || len(rep.CostCodes) != 2 {
+			t.Errorf("Wrong rolled up report: %+v", rep)
+		}
+		if rep, _ := db.GetUsage(project.ID, start, start); rep.Combined.Duration != 2*time.Hour {
+			t.Errorf("Wrong project report: %+v", rep)
+		}
+
+		// Moving keeps the slices, and archived groups hide their children.
+		db.MoveGroup(sub.ID, 0)
+		if rep, _ := db.GetUsage(sub.ID, start, start); rep.Combined.Duration != time.Hour {
+			t.Errorf("Wrong report after move: %+v", rep)
+		}
+		db.SetGroupArchived(client.ID, true)
+		if tree, _ = db.ReadGroupTree(false); len(tree) != 2 || tree[0].ID != sub.ID {
+			t.Errorf("Wrong tree with archived group: %+v", tree)
+		}
+
+		// Groups below a deleted group take its place.
+		db.MoveGroup(sub.ID, project.ID)
+		db.DeleteGroup(project.ID)
+		if g, _ := db.GetGroup(sub.ID); g.ParentID != client.ID {
+			t.Errorf("Wrong parent after deleting parent: %+v", g)
+		}
+	})
+}
+
+func TestCheckInvalidParent(t *testing.T) {
+	db, done := openMemoryDB(t)
+	defer done()
+
+	a, _ := db.AddGroup("a")
+	b, _ := db.AddGroup("b")
+	c, _ := db.AddGroup("c")
+
+	a.ParentID = b.ID
+	b.ParentID = a.ID
+	c.ParentID = 99
+	db.SaveGroup(a)
+	db.SaveGroup(b)
+	db.SaveGroup(c)
+
+	rep, err := db.Repair()
+	if err != nil {
+		t.Fatalf("Unable to repair: %s", err)
+	}
+	if len(rep.Problems) != 2 || rep.Problems[0].Kind != ProblemInvalidParent || !rep.Problems[1].Repaired {
+		t.Errorf("Wrong problems: %+v", rep.Problems)
+	}
+
+	if rep, _ = db.Check(); len(rep.Problems) != 0 {
+		t.Errorf("Problems left after repair: %+v", rep.Problems)
+	}
+	if tree, _ := db.ReadGroupTree(true); len(tree) != 2 {
+		t.Errorf("Wrong tree after repair: %+v", tree)
+	}
+}
@@ -0,0 +1,373 @@
+package stopwatchdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// BucketUndo holds the undo and redo stacks.
+const BucketUndo = "undo"
+
+// Keys of the undo bucket.
+const (
+	keyUndo = "undo"
+	keyRedo = "redo"
+)
+
+// defaultUndoLimit is the number of changes kept for undo by default.
+const defaultUndoLimit = 20
+
+// Errors returned when the undo or redo stack is empty.
+var (
+	errNothingToUndo = errors.New("nothing to undo")
+	errNothingToRedo = errors.New("nothing to redo")
+)
+
+// Change describes an operation that can be undone or redone.
+type Change struct {
+	Op   string    `json:"op"`
+	Time time.Time `json:"time"`
+}
+
+// undoRecord holds the writes done by an undoable operation.
+type undoRecord struct {
+	Change
+	Writes []kvWrite `json:"writes"`
+}
+
+// kvWrite is a single recorded write. Old and New are empty when the key
+// didn't exist before or after the write. Bucket is set when the key is a bucket
+// created by the write.
+type kvWrite struct {
+	Path   [][]byte `json:"path"`
+	Key    []byte   `json:"key"`
+	Old    []byte   `json:"old,omitempty"`
+	New    []byte   `json:"new,omitempty"`
+	Bucket bool     `json:"bucket,omitempty"`
+}
+
+// SetUndoLimit sets the number of changes kept for undo. Zero disables undo.
+// Defaults to 20.
+func (db *StopwatchDB) SetUndoLimit(n int) {
+	db.undoLimit = n
+}
+
+// Undo reverts the latest undoable change, and returns it. Fails if the
+// values written by the change have been modified since.
+func (db *StopwatchDB) Undo() (*Change, error) {
+	return db.undoRedo(keyUndo, keyRedo, AuditUndo)
+}
+
+// Redo applies the latest undone change again, and returns it. The redo stack
+// is cleared by new changes.
+func (db *StopwatchDB) Redo() (*Change, error) {
+	return db.undoRedo(keyRedo, keyUndo, AuditRedo)
+}
+
+// undoRedo pops a record from stack from, applies it and pushes it to stack
+// to.
+func (db *StopwatchDB) undoRedo(from, to, op string) (*Change, error) {
+	if db.IsOpen() == false {
+		return nil, errors.New("database not ready")
+	}
+
+	var c *Change
+	err := db.db.Update(func(tx kvTx) error {
+		src, err := getUndoStack(tx, from)
+		if err != nil {
+			return err
+		}
+
+		if len(src) == 0 {
+			if from == keyUndo {
+				return errNothingToUndo
+			}
+			return errNothingToRedo
+		}
+
+		rec := src[len(src)-1]
+		if from == keyUndo {
+			err = revertWrites(tx, rec.Writes)
+		} else {
+			err = applyWrites(tx, rec.Writes)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to %s '%s': %s", op, rec.Op, err)
+		}
+
+		dst, err := getUndoStack(tx, to)
+		if err != nil {
+			return err
+		}
+
+		if err = putUndoStack(tx, from, src[:len(src)-1]); err != nil {
+			return err
+		}
+		if err = putUndoStack(tx, to, append(dst, rec)); err != nil {
+			return err
+		}
+
+		c = &rec.Change
+		return db.audit(tx, op, 0, 0, nil, c)
+	})
+
+	return c, err
+}
+
+// undoable runs fn in a writable transaction and records its writes so that
+// they can be undone. Records beyond the undo limit are dropped, and the redo
+// stack is cleared. Nothing is recorded if fn writes nothing.
+func (db *StopwatchDB) undoable(op string, fn func(tx kvTx) error) error {
+	if db.undoLimit <= 0 {
+		return db.db.Update(fn)
+	}
+
+	return db.db.Update(func(tx kvTx) error {
+		j := &journalTx{tx: tx}
+		if err := fn(j); err != nil {
+			return err
+		}
+
+		// Changes that wrote nothing have nothing to undo, and keep the redo
+		// stack.
+		if len(j.writes) == 0 {
+			return nil
+		}
+
+		stack, err := getUndoStack(tx, keyUndo)
+		if err != nil {
+			return err
+		}
+
+		stack = append(stack, undoRecord{
+			Change: Change{Op: op, Time: time.Now().UTC()},
+			Writes: j.writes,
+		})
+		if len(stack) > db.undoLimit {
+			stack = stack[len(stack)-db.undoLimit:]
+		}
+
+		if err = putUndoStack(tx, keyUndo, stack); err != nil {
+			return err
+		}
+
+		return putUndoStack(tx, keyRedo, nil)
+	})
+}
+
+// revertWrites restores the values before the writes, latest write first.
+func revertWrites(tx kvTx, writes []kvWrite) error {
+	for i := len(writes) - 1; i >= 0; i-- {
+		if err := swapWrite(tx, writes[i], writes[i].New, writes[i].Old, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyWrites sets the values written, in order.
+func applyWrites(tx kvTx, writes []kvWrite) error {
+	for _, w := range writes {
+		if err := swapWrite(tx, w, w.Old, w.New, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapWrite replaces the value of a written key with to, if it still has the
+// value from. Created buckets are removed on revert and created otherwise.
+func swapWrite(tx kvTx, w kvWrite, from, to []byte, revert bool) error {
+	b := tx.Bucket(w.Path[0])
+	for _, name := range w.Path[1:] {
+		if b == nil {
+			break
+		}
+		b = b.Bucket(name)
+	}
+	if b == nil {
+		return errors.New("data has changed since")
+	}
+
+	if w.Bucket {
+		nb := b.Bucket(w.Key)
+		if revert {
+			if nb == nil {
+				return errors.New("data has changed since")
+			}
+			if k, _ := nb.Cursor().First(); k != nil {
+				return errors.New("data has been added since")
+			}
+			return b.DeleteBucket(w.Key)
+		}
+
+		_, err := b.CreateBucket(w.Key)
+		return err
+	}
+
+	if !bytes.Equal(b.Get(w.Key), from) {
+		return errors.New("data has changed since")
+	}
+
+	if len(to) == 0 {
+		return b.Delete(w.Key)
+	}
+	return b.Put(w.Key, to)
+}
+
+// getUndoStack reads the undo or redo stack within a transaction.
+func getUndoStack(tx kvTx, key string) ([]undoRecord, error) {
+	stack := []undoRecord{}
+
+	buf := tx.Bucket([]byte(BucketUndo)).Get([]byte(key))
+	if buf == nil {
+		return stack, nil
+	}
+
+	err := json.Unmarshal(buf, &stack)
+	return stack, err
+}
+
+// putUndoStack writes the undo or redo stack within a transaction.
+func putUndoStack(tx kvTx, key string, stack []undoRecord) error {
+	b := tx.Bucket([]byte(BucketUndo))
+	if len(stack) == 0 {
+		return b.Delete([]byte(key))
+	}
+
+	buf, err := json.Marshal(stack)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(key), buf)
+}
+
+// journalTx records the writes done through it. Writes to the audit log and
+// the undo stacks are not recorded.
+type journalTx struct {
+	tx     kvTx
+	writes []kvWrite
+}
+
+func (j *journalTx) Bucket(name []byte) kvBucket {
+	b := j.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+
+	switch string(name) {
+	case BucketAudit, BucketUndo:
+		return b
+	}
+
+	return &journalBucket{j: j, b: b, path: [][]byte{append([]byte{}, name...)}}
+}
+
+func (j *journalTx) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	return nil, errors.New("can't create buckets in an undoable change")
+}
+
+func (j *journalTx) CopyFile(path string, mode os.FileMode) error {
+	return j.tx.CopyFile(path, mode)
+}
+
+// journalBucket records the writes done to a bucket.
+type journalBucket struct {
+	j    *journalTx
+	b    kvBucket
+	path [][]byte
+}
+
+func (b *journalBucket) sub(name []byte, nb kvBucket) kvBucket {
+	path := append(append([][]byte{}, b.path...), append([]byte{}, name...))
+	return &journalBucket{j: b.j, b: nb, path: path}
+}
+
+func (b *journalBucket) Bucket(name []byte) kvBucket {
+	nb := b.b.Bucket(name)
+	if nb == nil {
+		return nil
+	}
+	return b.sub(name, nb)
+}
+
+func (b *journalBucket) CreateBucket(name []byte) (kvBucket, error) {
+	nb, err := b.b.CreateBucket(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b.j.writes = append(b.j.writes, kvWrite{Path: b.path, Key: append([]byte{}, name...), Bucket: true})
+	return b.sub(name, nb), nil
+}
+
+func (b *journalBucket) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	if nb := b.Bucket(name); nb != nil {
+		return nb, nil
+	}
+	return b.CreateBucket(name)
+}
+
+func (b *journalBucket) DeleteBucket(name []byte) error {
+	return errors.New("can't delete buckets in an undoable change")
+}
+
+func (b *journalBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b *journalBucket) Put(key, value []byte) error {
+	old := copyValue(b.b.Get(key))
+	if err := b.b.Put(key, value); err != nil {
+		return err
+	}
+
+	b.j.writes = append(b.j.writes, kvWrite{
+		Path: b.path,
+		Key:  append([]byte{}, key...),
+		Old:  old,
+		New:  append([]byte{}, value...),
+	})
+	return nil
+}
+
+func (b *journalBucket) Delete(key []byte) error {
+	old := copyValue(b.b.Get(key))
+	if err := b.b.Delete(key); err != nil {
+		return err
+	}
+
+	if old != nil {
+		b.j.writes = append(b.j.writes, kvWrite{Path: b.path, Key: append([]byte{}, key...), Old: old})
+	}
+	return nil
+}
+
+func (b *journalBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b *journalBucket) Cursor() kvCursor {
+	return b.b.Cursor()
+}
+
+func (b *journalBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
+
+func (b *journalBucket) SetSequence(v uint64) error {
+	return b.b.SetSequence(v)
+}
+
+// copyValue returns a copy of v, keeping nil as nil.
+func copyValue(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
@@ -0,0 +1,149 @@
+package stopwatchdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUndoRedo(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		b, _ := db.AddTask(g.ID, "b", "code")
+
+		db.SwitchTask(g.ID, a.ID)
+		db.SwitchTask(g.ID, b.ID)
+
+		// Undo the mis-click on b, a is running again.
+		c, err := db.Undo()
+		if err != nil || c.Op != AuditSwitchTask {
+			t.Fatalf("Unable to undo switch: %+v, %v", c, err)
+		}
+		if at, _ := db.GetActiveTask(); at == nil || at.ID != a.ID || at.Running == nil {
+			t.Errorf("Expected a to be running after undo, got %+v", at)
+		}
+		if b, _ = db.GetTask(g.ID, b.ID); b.Running != nil {
+			t.Errorf("b still running after undo: %+v", b)
+		}
+
+		if c, err = db.Redo(); err != nil || c.Op != AuditSwitchTask {
+			t.Fatalf("Unable to redo switch: %+v, %v", c, err)
+		}
+		if at, _ := db.GetActiveTask(); at == nil || at.ID != b.ID {
+			t.Errorf("Expected b to be active after redo, got %+v", at)
+		}
+		if _, err = db.Redo(); err != errNothingToRedo {
+			t.Errorf("Expected nothing to redo, got %v", err)
+		}
+
+		db.StopTask(g.ID, b.ID)
+
+		// Removed slices come back, with the time used.
+		start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+		before, _ := db.GetTask(g.ID, a.ID)
+		db.RemoveSlice(g.ID, a.ID, start)
+
+		if _, err = db.Undo(); err != nil {
+			t.Fatalf("Unable to undo slice removal: %s", err)
+		}
+		if res, _ := db.GetSlices(g.ID, start, start); len(res) != 1 || len(res[0].Slices) != 1 {
+			t.Errorf("Slice not restored: %+v", res)
+		}
+		if after, _ := db.GetTask(g.ID, a.ID); after.Used != before.Used {
+			t.Errorf("Time used not restored: %s (not %s)", after.Used, before.Used)
+		}
+
+		// A new change clears the redo stack.
+		b.Name = "renamed"
+		db.SaveTask(b)
+		if _, err = db.Redo(); err != errNothingToRedo {
+			t.Errorf("Expected nothing to redo after change, got %v", err)
+		}
+		db.Undo()
+		if b, _ = db.GetTask(g.ID, b.ID); b.Name != "b" {
+			t.Errorf("Rename not undone: %+v", b)
+		}
+
+		// Task adds are undone along with the slice bucket.
+		db.AddTask(g.ID, "c", "code")
+		db.Undo()
+		if tasks, _ := db.ReadTasks(g.ID, true); len(tasks) != 2 {
+			t.Errorf("Added task not removed: %+v", tasks)
+		}
+		if rep, _ := db.Check(); len(rep.Problems) != 0 {
+			t.Errorf("Problems after undo: %+v", rep.Problems)
+		}
+	})
+}
+
+func TestUndoConflict(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		db.StartTask(g.ID, a.ID)
+
+		// Task changed by a change that can't be undone.
+		if err := db.DeleteTask(g.ID, a.ID); err != nil {
+			t.Fatalf("Unable to delete task: %s", err)
+		}
+
+		if _, err := db.Undo(); err == nil {
+			t.Errorf("Undo succeeded over a deleted task")
+		}
+
+		// Failed undo keeps the change on the stack.
+		if _, err := db.Redo(); err != errNothingToRedo {
+			t.Errorf("Expected nothing to redo, got %v", err)
+		}
+	})
+}
+
+func TestUndoLimit(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		db.SetUndoLimit(2)
+
+		for _, name := range []string{"a", "b", "c"} {
+			db.AddGroup(name)
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err := db.Undo(); err != nil {
+				t.Fatalf("Unable to undo %d: %s", i, err)
+			}
+		}
+
+		if _, err := db.Undo(); err != errNothingToUndo {
+			t.Errorf("Expected nothing to undo, got %v", err)
+		}
+
+		if groups, _ := db.ReadGroups(true); len(groups) != 1 || groups[0].Name != "a" {
+			t.Errorf("Wrong groups after undo: %+v", groups)
+		}
+	})
+}
+
+func TestUndoSkipsEmptyChanges(t *testing.T) {
+	testBackends(t, func(t *testing.T, db Store) {
+		g, _ := db.AddGroup("group")
+		a, _ := db.AddTask(g.ID, "a", "code")
+		db.SwitchTask(g.ID, a.ID)
+
+		start := time.Date(2017, 12, 5, 8, 0, 0, 0, time.UTC)
+		db.SetSlice(g.ID, a.ID, start, start.Add(time.Hour))
+
+		// Switching to the running task writes nothing, so undo reverts the slice.
+		if _, err := db.SwitchTask(g.ID, a.ID); err != nil {
+			t.Fatalf("Unable to switch task: %s", err)
+		}
+		if c, err := db.Undo(); err != nil || c.Op != AuditSetSlice {
+			t.Fatalf("Expected to undo the slice, got %+v, %v", c, err)
+		}
+
+		// An empty change doesn't clear the redo stack either.
+		db.SwitchTask(g.ID, a.ID)
+		if c, err := db.Redo(); err != nil || c.Op != AuditSetSlice {
+			t.Errorf("Expected to redo the slice, got %+v, %v", c, err)
+		}
+	})
+}
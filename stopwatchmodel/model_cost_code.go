@@ -0,0 +1,10 @@
+package stopwatchmodel
+
+// CostCode is a registered cost code
+type CostCode struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	// Active codes can be set on tasks. Inactive codes are kept on existing
+	// tasks and in reports.
+	Active bool `json:"active"`
+}
@@ -2,6 +2,9 @@ package stopwatchmodel
 
 // Group defines a single group
 type Group struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Archived bool   `json:"archived"`
+	// ParentID is the group this group is below. Zero for top level groups.
+	ParentID int `json:"parentid,omitempty"`
 }
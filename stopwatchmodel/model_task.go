@@ -6,20 +6,58 @@ import (
 
 // Task describes a single task
 type Task struct {
-	ID       int          `json:"id"`
-	GroupID  int          `json:"groupid"`
-	Name     string       `json:"name"`
-	CostCode string       `json:"costcode"`
-	Used     TaskDuration `json:"duration"`
-	Running  *time.Time   `json:"running,omitempty"`
+	ID       int    `json:"id"`
+	GroupID  int    `json:"groupid"`
+	Name     string `json:"name"`
+	CostCode string `json:"costcode"`
+	// Description is a longer free-form description of the task
+	Description string `json:"description"`
+	// Reference is an external ticket reference or URL
+	Reference string `json:"reference"`
+	// Billable tells if time used on the task is billable
+	Billable bool `json:"billable"`
+	// Tags are free-form categories of the task
+	Tags []string `json:"tags,omitempty"`
+	// CostCodes are the cost codes assigned to the task over time, in the
+	// order they take effect. Empty when the code has never been changed
+	// from a date on, and CostCode applies to all time.
+	CostCodes []CostCodeAssignment `json:"costcodes,omitempty"`
+	Used      TaskDuration         `json:"duration"`
+	Running   *time.Time           `json:"running,omitempty"`
+	Archived  bool                 `json:"archived"`
 }
 
-// NewTask initializes an task
+// CostCodeAssignment is a cost code of a task from a point in time on
+type CostCodeAssignment struct {
+	Code string    `json:"code"`
+	From time.Time `json:"from"`
+}
+
+// CostCodeAt returns the cost code of the task at given time. Times before
+// the first assignment get the first assigned code.
+func (t *Task) CostCodeAt(at time.Time) string {
+	if len(t.CostCodes) == 0 {
+		return t.CostCode
+	}
+
+	code := t.CostCodes[0].Code
+	for _, a := range t.CostCodes[1:] {
+		if a.From.After(at) {
+			break
+		}
+		code = a.Code
+	}
+
+	return code
+}
+
+// NewTask initializes an task. Tasks are billable by default.
 func NewTask(groupid int, name, costcode string) *Task {
 	return &Task{
 		ID:       0,
 		Name:     name,
 		CostCode: costcode,
 		GroupID:  groupid,
+		Billable: true,
 	}
 }
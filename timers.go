@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	app "github.com/msepp/stopwatch/stopwatchapp"
+	"github.com/msepp/stopwatch/stopwatchdb"
+)
+
+// capForgottenTimers ends running slices that exceed the configured limits and
+// alerts the user about them. Callers hold gState.mu.
+func capForgottenTimers() {
+	if gState.db == nil {
+		return
+	}
+
+	capped, err := gState.db.CapForgotten()
+	if err != nil {
+		log.Printf("Unable to cap forgotten timers: %s", err)
+		return
+	}
+
+	if len(capped) == 0 {
+		return
+	}
+
+	gState.app.Send(app.NewAlertInfo(
+		app.AlertSlicesCapped,
+		fmt.Sprintf("Stopped %d forgotten timer(s). Please review the recorded time.", len(capped)),
+		capped,
+	))
+}
+
+// alertTimerGap asks the user how to handle time tracked while the app wasn't
+// running. Each gap is alerted only once.
+func alertTimerGap(gap *stopwatchdb.Gap) {
+	if gap == nil || gap.LastSeen.Equal(gState.lastGap) {
+		return
+	}
+	gState.lastGap = gap.LastSeen
+
+	gState.app.Send(app.NewAlertInfo(
+		app.AlertTimerGap,
+		fmt.Sprintf("Timers kept running while the app was not responding since %s.", gap.LastSeen.In(gState.location).Format("2006-01-02 15:04")),
+		struct {
+			Gap     *stopwatchdb.Gap `json:"gap"`
+			Actions []string         `json:"actions"`
+		}{gap, []string{stopwatchdb.GapEnd, stopwatchdb.GapKeep, stopwatchdb.GapSplit}},
+	))
+}
+
+// checkTimerGap alerts the user if timers have been running without heartbeats.
+// Callers hold gState.mu.
+func checkTimerGap() {
+	if gState.db == nil {
+		return
+	}
+
+	gap, err := gState.db.CheckGap()
+	if err != nil {
+		log.Printf("Unable to check heartbeat: %s", err)
+		return
+	}
+
+	alertTimerGap(gap)
+}
+
+// watchTimers checks for forgotten timers, records heartbeats and takes daily
+// database snapshots on given interval.
+func watchTimers(interval time.Duration) {
+	for range time.Tick(interval) {
+		checkTimers()
+	}
+}
+
+// checkTimers does a single round of the checks done by watchTimers. GUI
+// messages are not handled meanwhile.
+func checkTimers() {
+	gState.mu.Lock()
+	defer gState.mu.Unlock()
+
+	if gState.db == nil {
+		return
+	}
+
+	capForgottenTimers()
+
+	if _, err := gState.db.AutoBackup(); err != nil {
+		log.Printf("Unable to back up database: %s", err)
+	}
+
+	gap, err := gState.db.Heartbeat()
+	if err != nil {
+		log.Printf("Unable to record heartbeat: %s", err)
+		return
+	}
+
+	alertTimerGap(gap)
+}